@@ -0,0 +1,157 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+const (
+	challengeHTTP01    = "http-01"
+	challengeTLSALPN01 = "tls-alpn-01"
+)
+
+// ACMEConfig configures automatic certificates from an ACME directory
+type ACMEConfig struct {
+	Enabled       bool     `mapstructure:"enabled"`
+	DirectoryURL  string   `mapstructure:"directory_url"`  // defaults to Let's Encrypt production
+	Email         string   `mapstructure:"email"`          // account contact
+	CacheDir      string   `mapstructure:"cache_dir"`      // account key and certificate cache
+	Domains       []string `mapstructure:"domains"`        // defaults to hostname
+	Challenge     string   `mapstructure:"challenge"`      // "http-01" or "tls-alpn-01"
+	ChallengeAddr string   `mapstructure:"challenge_addr"` // listener for challenge requests
+}
+
+// initDefaults fills ACME defaults, hostname is used when no domains are configured
+func (a *ACMEConfig) initDefaults(hostname string) {
+	if a.DirectoryURL == "" {
+		a.DirectoryURL = acme.LetsEncryptURL
+	}
+
+	if a.CacheDir == "" {
+		a.CacheDir = "/tmp/smtp-acme"
+	}
+
+	if len(a.Domains) == 0 {
+		a.Domains = []string{hostname}
+	}
+
+	if a.Challenge == "" {
+		a.Challenge = challengeHTTP01
+	}
+
+	if a.ChallengeAddr == "" {
+		if a.Challenge == challengeTLSALPN01 {
+			a.ChallengeAddr = ":443"
+		} else {
+			a.ChallengeAddr = ":80"
+		}
+	}
+}
+
+// acmeManager obtains and renews certificates and answers ACME challenges
+type acmeManager struct {
+	manager *autocert.Manager
+	cfg     *ACMEConfig
+	log     *zap.Logger
+
+	httpServer *http.Server
+	listener   net.Listener
+}
+
+func newACMEManager(cfg *ACMEConfig, log *zap.Logger) *acmeManager {
+	return &acmeManager{
+		manager: &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(cfg.CacheDir),
+			HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+			Email:      cfg.Email,
+			Client:     &acme.Client{DirectoryURL: cfg.DirectoryURL},
+		},
+		cfg: cfg,
+		log: log,
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate; clients without SNI get the first domain
+func (m *acmeManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if hello.ServerName == "" {
+		h := *hello
+		h.ServerName = m.cfg.Domains[0]
+		hello = &h
+	}
+	return m.manager.GetCertificate(hello)
+}
+
+// start begins answering challenges on the configured address
+func (m *acmeManager) start(errCh chan error) error {
+	const op = errors.Op("smtp_acme_start")
+
+	var err error
+	switch m.cfg.Challenge {
+	case challengeTLSALPN01:
+		m.listener, err = tls.Listen("tcp", m.cfg.ChallengeAddr, m.manager.TLSConfig())
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		go func() {
+			for {
+				conn, err := m.listener.Accept()
+				if err != nil {
+					return
+				}
+				// The handshake answers the challenge, nothing else is served here
+				go func() {
+					_ = conn.SetDeadline(time.Now().Add(30 * time.Second))
+					_ = conn.(*tls.Conn).Handshake()
+					_ = conn.Close()
+				}()
+			}
+		}()
+	default:
+		m.listener, err = net.Listen("tcp", m.cfg.ChallengeAddr)
+		if err != nil {
+			return errors.E(op, err)
+		}
+
+		m.httpServer = &http.Server{
+			Handler:           m.manager.HTTPHandler(nil),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+
+		go func() {
+			if err := m.httpServer.Serve(m.listener); err != nil && err != http.ErrServerClosed {
+				m.log.Error("ACME challenge server error", zap.Error(err))
+				errCh <- errors.E(op, err)
+			}
+		}()
+	}
+
+	m.log.Info("ACME challenge listener started",
+		zap.String("challenge", m.cfg.Challenge),
+		zap.String("addr", m.cfg.ChallengeAddr),
+		zap.Strings("domains", m.cfg.Domains),
+	)
+
+	return nil
+}
+
+// stop closes the challenge listener
+func (m *acmeManager) stop(ctx context.Context) {
+	if m.httpServer != nil {
+		_ = m.httpServer.Shutdown(ctx)
+		return
+	}
+
+	if m.listener != nil {
+		_ = m.listener.Close()
+	}
+}
@@ -0,0 +1,202 @@
+package smtp
+
+import (
+	"net"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"go.uber.org/zap"
+)
+
+const (
+	addressStrict  = "strict"
+	addressLenient = "lenient"
+)
+
+// Anomalies recorded for MAIL FROM / RCPT TO paths that are not RFC 5321 mailboxes
+const (
+	anomalyInvalidSender    = "invalid_sender_address"
+	anomalyInvalidRecipient = "invalid_recipient_address"
+)
+
+// RFC 5321 size limits in octets
+const (
+	maxLocalPartLen = 64
+	maxDomainLen    = 255
+	maxLabelLen     = 63
+)
+
+// AddressConfig controls how addresses are validated and normalized before they reach
+// the payload, history, sender baselines and RPC filters
+type AddressConfig struct {
+	// "strict" rejects malformed MAIL FROM / RCPT TO with 501, "lenient" accepts them.
+	// Both record the failure as a session anomaly.
+	Validation string `mapstructure:"validation"`
+
+	// Fold the local part gmail-style: drop dots and everything after the first '+'
+	Fold bool `mapstructure:"fold"`
+}
+
+// normalizeAddress trims whitespace and lowercases the domain. The local part keeps
+// its case, RFC 5321 leaves its interpretation to the receiving host.
+func normalizeAddress(addr string, fold bool) string {
+	addr = strings.TrimSpace(addr)
+
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		return addr
+	}
+
+	local, domain := addr[:at], strings.ToLower(addr[at+1:])
+
+	// Quoted local parts are taken literally
+	if fold && !strings.HasPrefix(local, `"`) {
+		if i := strings.IndexByte(local, '+'); i > 0 {
+			local = local[:i]
+		}
+		if folded := strings.ReplaceAll(local, ".", ""); folded != "" {
+			local = folded
+		}
+	}
+
+	return local + "@" + domain
+}
+
+// normalizeAddress applies the configured address normalization
+func (p *Plugin) normalizeAddress(addr string) string {
+	return normalizeAddress(addr, p.cfg.Addresses.Fold)
+}
+
+// normalized returns the filter with address patterns normalized like stored addresses,
+// so a pattern written with dots or a +tag still matches folded addresses
+func (f TailFilter) normalized(p *Plugin) TailFilter {
+	if f.From != "" {
+		f.From = p.normalizeAddress(f.From)
+	}
+	if f.To != "" {
+		f.To = p.normalizeAddress(f.To)
+	}
+	return f
+}
+
+// checkMailbox validates an address from MAIL FROM / RCPT TO against the RFC 5321
+// Mailbox grammar and returns why it does not match, empty when it is valid.
+// Non-ASCII is allowed only when the transaction uses SMTPUTF8.
+func checkMailbox(addr string, smtpUTF8 bool) string {
+	at := strings.LastIndexByte(addr, '@')
+	if at <= 0 || at == len(addr)-1 {
+		return "missing local part or domain"
+	}
+
+	if reason := checkLocalPart(addr[:at], smtpUTF8); reason != "" {
+		return reason
+	}
+	return checkDomain(addr[at+1:], smtpUTF8)
+}
+
+// checkLocalPart validates a Dot-string, or the content of a Quoted-string. go-smtp has
+// already removed the quotes, specials in the local part mean it was quoted.
+func checkLocalPart(local string, smtpUTF8 bool) string {
+	if len(local) > maxLocalPartLen {
+		return "local part longer than 64 octets"
+	}
+
+	if strings.ContainsAny(local, "()<>[]:;\\,\"@ \t") {
+		for _, r := range local {
+			if r < 0x20 || r == 0x7f || (r >= utf8.RuneSelf && !smtpUTF8) {
+				return "quoted local part contains an invalid character"
+			}
+		}
+		return ""
+	}
+
+	for _, atom := range strings.Split(local, ".") {
+		if atom == "" {
+			return "local part has a leading, trailing or double dot"
+		}
+		for _, r := range atom {
+			if !isAtext(r, smtpUTF8) {
+				return "local part contains " + quoteRune(r)
+			}
+		}
+	}
+
+	return ""
+}
+
+// checkDomain validates a dotted domain or an address literal
+func checkDomain(domain string, smtpUTF8 bool) string {
+	if strings.HasPrefix(domain, "[") {
+		literal, ok := strings.CutSuffix(domain[1:], "]")
+		if !ok {
+			return "unterminated address literal"
+		}
+		if v6, ok := strings.CutPrefix(literal, "IPv6:"); ok {
+			if ip := net.ParseIP(v6); ip == nil || !strings.Contains(v6, ":") {
+				return "invalid IPv6 address literal"
+			}
+			return ""
+		}
+		if ip := net.ParseIP(literal); ip == nil || ip.To4() == nil {
+			return "invalid IPv4 address literal"
+		}
+		return ""
+	}
+
+	if len(domain) > maxDomainLen {
+		return "domain longer than 255 octets"
+	}
+
+	for _, label := range strings.Split(domain, ".") {
+		switch {
+		case label == "":
+			return "domain has an empty label"
+		case len(label) > maxLabelLen:
+			return "domain label longer than 63 octets"
+		case label[0] == '-' || label[len(label)-1] == '-':
+			return "domain label starts or ends with a hyphen"
+		}
+		for _, r := range label {
+			if !isLetDigHyp(r) && (r < utf8.RuneSelf || !smtpUTF8) {
+				return "domain contains " + quoteRune(r)
+			}
+		}
+	}
+
+	return ""
+}
+
+// isAtext reports whether r may appear in an RFC 5322 atom
+func isAtext(r rune, smtpUTF8 bool) bool {
+	if r >= utf8.RuneSelf {
+		return smtpUTF8
+	}
+	return isLetDigHyp(r) || strings.ContainsRune("!#$%&'*+/=?^_`{|}~", r)
+}
+
+func isLetDigHyp(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-'
+}
+
+// quoteRune names a character in a validation reason
+func quoteRune(r rune) string {
+	if r >= utf8.RuneSelf {
+		return "non-ASCII " + string(r) + " without SMTPUTF8"
+	}
+	return "'" + string(r) + "'"
+}
+
+// invalidAddress records a path that failed validation, once per anomaly and session
+func (s *Session) invalidAddress(anomaly, addr, reason string) {
+	s.backend.plugin.stats.invalidAddresses.Add(1)
+	s.log.Warn("malformed address",
+		zap.String("anomaly", anomaly),
+		zap.String("address", addr),
+		zap.String("reason", reason),
+	)
+
+	if !slices.Contains(s.anomalies, anomaly) {
+		s.anomalies = append(s.anomalies, anomaly)
+	}
+}
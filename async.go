@@ -0,0 +1,311 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net/mail"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// Delivery modes
+const (
+	deliveryInline = "inline" // parse and push inside DATA, the reply tells whether it worked
+	deliveryAsync  = "async"  // answer 250 once the message is queued, parse and push in the background
+)
+
+// DeliveryConfig decides whether DATA waits for parsing and the push to Jobs
+type DeliveryConfig struct {
+	// "inline" (default) or "async"
+	Mode string `mapstructure:"mode"`
+	// Messages waiting for a worker in async mode, a full queue answers 452; default 1000
+	QueueSize int `mapstructure:"queue_size"`
+	// Goroutines parsing and pushing queued messages, default 4
+	Workers int `mapstructure:"workers"`
+
+	// MAIL FROM gets 451 4.3.1 while the queue is filled to this ratio, default 1 (full)
+	BackpressureAt float64 `mapstructure:"backpressure_at"`
+	// MAIL FROM gets 451 4.3.1 for this long after a push to Jobs failed, in either mode;
+	// default 5s, negative disables
+	PushFailureBackoff time.Duration `mapstructure:"push_failure_backoff"`
+}
+
+func (d *DeliveryConfig) initDefaults() {
+	if d.Mode == "" {
+		d.Mode = deliveryInline
+	}
+	if d.QueueSize == 0 {
+		d.QueueSize = 1000
+	}
+	if d.Workers == 0 {
+		d.Workers = 4
+	}
+	if d.BackpressureAt == 0 {
+		d.BackpressureAt = 1
+	}
+	if d.PushFailureBackoff == 0 {
+		d.PushFailureBackoff = 5 * time.Second
+	}
+}
+
+func (d *DeliveryConfig) validate() error {
+	const op = errors.Op("smtp_delivery_validate")
+
+	if d.Mode != deliveryInline && d.Mode != deliveryAsync {
+		return errors.E(op, errors.Errorf("delivery.mode must be inline or async, got %q", d.Mode))
+	}
+	if d.QueueSize < 0 || d.Workers < 0 {
+		return errors.E(op, errors.Str("delivery.queue_size and delivery.workers cannot be negative"))
+	}
+	if d.BackpressureAt < 0 || d.BackpressureAt > 1 {
+		return errors.E(op, errors.Errorf("delivery.backpressure_at must be between 0 and 1, got %v", d.BackpressureAt))
+	}
+	return nil
+}
+
+// queuedMessage is a message accepted in async mode, waiting to be parsed and pushed
+type queuedMessage struct {
+	session    *Session // detached copy, the live session goes on with the next transaction
+	raw        []byte
+	size       int64
+	sampledOut bool
+	// Taken while the connection is open, the detached session has none
+	tls        *TLSData
+	transcript string
+}
+
+// deliveryQueue parses and pushes async-mode messages on a fixed set of workers
+type deliveryQueue struct {
+	p        *Plugin
+	messages chan *queuedMessage
+	wg       sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+func newDeliveryQueue(p *Plugin) *deliveryQueue {
+	return &deliveryQueue{
+		p:        p,
+		messages: make(chan *queuedMessage, p.cfg.Delivery.QueueSize),
+	}
+}
+
+// start runs the workers
+func (q *deliveryQueue) start() {
+	for range q.p.cfg.Delivery.Workers {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for msg := range q.messages {
+				q.process(msg)
+			}
+		}()
+	}
+}
+
+// enqueue hands a message to the workers, false when the queue is full or stopped
+func (q *deliveryQueue) enqueue(msg *queuedMessage) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+	select {
+	case q.messages <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// depth returns the messages waiting for a worker
+func (q *deliveryQueue) depth() int {
+	return len(q.messages)
+}
+
+// saturated reports whether the queue is filled to delivery.backpressure_at
+func (q *deliveryQueue) saturated() bool {
+	return float64(q.depth()) >= q.p.cfg.Delivery.BackpressureAt*float64(cap(q.messages))
+}
+
+// stop lets the workers finish the queued messages, or gives up when ctx ends
+func (q *deliveryQueue) stop(ctx context.Context) {
+	q.mu.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.messages)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		q.p.log.Warn("stopped before the delivery queue was drained", zap.Int("queued", len(q.messages)))
+	}
+}
+
+// process parses and pushes a queued message. The client already got 250, so
+// failures can only be logged and counted.
+func (q *deliveryQueue) process(msg *queuedMessage) {
+	p := q.p
+	s := msg.session
+
+	parseStart := time.Now()
+	parsedMessage, err := s.parseEmail(msg.raw)
+	if err != nil {
+		p.stats.asyncFailures.Add(1)
+		s.log.Error("failed to parse queued email, message lost", zap.Error(err))
+		return
+	}
+	p.latency.observe(stageParse, time.Since(parseStart)-s.storageTime)
+	if len(parsedMessage.Attachments) > 0 {
+		p.latency.observe(stageStorage, s.storageTime)
+	}
+
+	emailData := s.newEmailData(parsedMessage)
+	emailData.TLS = msg.tls
+	emailData.Transcript = msg.transcript
+
+	if !msg.sampledOut {
+		if err := p.deliver(emailData); err != nil {
+			p.stats.asyncFailures.Add(1)
+			s.log.Error("failed to push queued email to jobs, message lost",
+				zap.String("message_uuid", emailData.MessageUUID),
+				zap.Error(err),
+			)
+			return
+		}
+	} else {
+		p.stats.sampledOut.Add(1)
+		p.history.record(emailData)
+	}
+
+	if p.senders != nil {
+		p.observeSender(s.from, msg.size)
+	}
+}
+
+// backpressure names why new transactions are refused, empty when they are welcome:
+// the async queue is saturated, or Jobs failed a push within delivery.push_failure_backoff
+func (p *Plugin) backpressure() string {
+	if p.delivery != nil && p.delivery.saturated() {
+		return "delivery queue saturated"
+	}
+	if backoff := p.cfg.Delivery.PushFailureBackoff; backoff > 0 {
+		if failed := p.pushFailedAt.Load(); failed != 0 && time.Since(time.Unix(0, failed)) < backoff {
+			return "recent push to jobs failed"
+		}
+	}
+	return ""
+}
+
+// acceptAsync checks the message against the DATA rules, queues it and answers 250
+// without waiting for parsing or the push. Only the header is read for the rules.
+func (s *Session) acceptAsync(raw []byte, n int64) error {
+	p := s.backend.plugin
+
+	header, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		s.log.Error("failed to parse email", zap.Error(err))
+		return p.smtpError(respParseFailed)
+	}
+
+	if err := s.applyRules(ruleStageData, &ruleInput{
+		from:    s.from,
+		to:      s.to,
+		subject: decodedSubject(header.Header.Get("Subject")),
+		size:    n,
+	}); err != nil {
+		return err
+	}
+
+	if err := s.chaos(chaosData); err != nil {
+		return err
+	}
+
+	// The identity is fixed now, the 250 reply may quote it
+	if s.nextUUID == "" {
+		s.nextUUID, s.nextAt = p.newID(), p.now()
+	}
+	msg := &queuedMessage{
+		session:    s.detach(),
+		raw:        bytes.Clone(raw),
+		size:       n,
+		sampledOut: s.sampledOut(),
+		tls:        s.tlsData(),
+		transcript: s.transcriptText(),
+	}
+	accepted := &EmailData{
+		UUID:        s.uuid,
+		Seq:         s.seq + 1,
+		MessageUUID: s.nextUUID,
+		QueueID:     queueID(s.nextUUID),
+	}
+	s.nextUUID, s.nextAt = "", time.Time{}
+
+	if !p.delivery.enqueue(msg) {
+		p.stats.queueFull.Add(1)
+		s.log.Warn("delivery queue full, message refused")
+		return p.smtpError(respQueueFull)
+	}
+
+	// The detached copy numbers the message when it builds the payload
+	s.seq++
+	return p.acceptedReply(accepted)
+}
+
+// detach copies what building the payload needs from the session, so that it can
+// be done after the session moved on. The copy has no conn: workers must not touch
+// the connection once DATA returned, its TLS state is kept instead.
+func (s *Session) detach() *Session {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var tlsState *tls.ConnectionState
+	if state, ok := s.connectionState(); ok {
+		tlsState = &state
+	}
+
+	return &Session{
+		backend:       s.backend,
+		tlsState:      tlsState,
+		uuid:          s.uuid,
+		remoteAddr:    s.remoteAddr,
+		remoteIP:      s.remoteIP,
+		localAddr:     s.localAddr,
+		listener:      s.listener,
+		log:           s.log,
+		authenticated: s.authenticated,
+		authUsername:  s.authUsername,
+		authPassword:  s.authPassword,
+		authMechanism: s.authMechanism,
+		authDigest:    s.authDigest,
+		authChallenge: s.authChallenge,
+		inbox:         s.inbox,
+		from:          s.from,
+		to:            slices.Clone(s.to),
+		heloName:      s.heloName,
+		ptr:           s.ptr,
+		utf8:          s.utf8,
+		bodyType:      s.bodyType,
+		params:        s.params,
+		bdat:          s.bdat,
+		anomalies:     slices.Clone(s.anomalies),
+		seq:           s.seq,
+		nextUUID:      s.nextUUID,
+		nextAt:        s.nextAt,
+	}
+}
@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"encoding/base64"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// attachmentPath is the endpoint serving tempfile attachments
+const attachmentPath = "/attachment"
+
+// tempAttachmentPrefix starts the name of every attachment saved in tempfile mode
+const tempAttachmentPrefix = "smtp-att-"
+
+// handleAttachment serves a tempfile attachment by the path found in the job payload, so
+// consumers need no access to the server's filesystem. Query parameters:
+//
+//	path         attachment path from the payload, required
+//	encoding     "binary" (default) or "base64"
+//	disposition  "attachment" (default) or "inline"
+func (p *Plugin) handleAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.sendAPIAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	encoding := query.Get("encoding")
+	if encoding == "" {
+		encoding = "binary"
+	}
+	if encoding != "binary" && encoding != "base64" {
+		http.Error(w, "encoding must be binary or base64", http.StatusBadRequest)
+		return
+	}
+	disposition := query.Get("disposition")
+	if disposition == "" {
+		disposition = "attachment"
+	}
+	if disposition != "attachment" && disposition != "inline" {
+		http.Error(w, "disposition must be attachment or inline", http.StatusBadRequest)
+		return
+	}
+
+	path, ok := p.tempAttachment(query.Get("path"))
+	if !ok {
+		http.Error(w, "not an attachment path", http.StatusBadRequest)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		// Removed by attachment_storage.cleanup_after
+		http.Error(w, "attachment not found or expired", http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	filename := attachmentFilename(filepath.Base(path))
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": filename}))
+
+	if encoding == "base64" {
+		w.Header().Set("Content-Type", "text/plain; charset=us-ascii")
+		w.Header().Set("Content-Transfer-Encoding", "base64")
+		if r.Method == http.MethodHead {
+			return
+		}
+		enc := base64.NewEncoder(base64.StdEncoding, w)
+		if _, err := f.WriteTo(enc); err == nil {
+			_ = enc.Close()
+		}
+		return
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, filename, info.ModTime(), f)
+}
+
+// tempAttachment resolves a payload path to a file directly in attachment_storage.temp_dir
+// named like a saved attachment, anything else is refused
+func (p *Plugin) tempAttachment(path string) (string, bool) {
+	if path == "" || p.cfg.AttachmentStorage.Mode != "tempfile" {
+		return "", false
+	}
+
+	dir, err := filepath.Abs(p.cfg.AttachmentStorage.TempDir)
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	if filepath.Dir(abs) != dir || !strings.HasPrefix(filepath.Base(abs), tempAttachmentPrefix) {
+		return "", false
+	}
+	return abs, true
+}
+
+// attachmentFilename recovers the original name from "smtp-att-<session>-<random>-<filename>"
+func attachmentFilename(name string) string {
+	rest := strings.TrimPrefix(name, tempAttachmentPrefix)
+	parts := strings.SplitN(rest, "-", 3)
+	if len(parts) != 3 || parts[2] == "" {
+		return name
+	}
+	return parts[2]
+}
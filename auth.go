@@ -0,0 +1,147 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+	"github.com/emersion/go-smtp"
+	"go.uber.org/zap"
+)
+
+// CRAM-MD5 mechanism name, go-sasl only ships PLAIN and LOGIN servers
+const cramMD5 = "CRAM-MD5"
+
+// AuthMechanisms advertises the mechanisms captured in the EHLO reply
+func (s *Session) AuthMechanisms() []string {
+	// go-smtp leaves AUTH out of EHLO when there are no mechanisms
+	if !s.authAllowed() {
+		return nil
+	}
+	return []string{sasl.Plain, sasl.Login, cramMD5}
+}
+
+// authAllowed reports whether AUTH may be used on the connection in its current state
+func (s *Session) authAllowed() bool {
+	if !s.backend.plugin.cfg.Auth.RequireTLS {
+		return true
+	}
+	_, isTLS := s.conn.TLSConnectionState()
+	return isTLS
+}
+
+// Auth is called for AUTH command. Credentials are captured, and every attempt succeeds
+// unless auth.verify checks them against the configured users.
+func (s *Session) Auth(mech string) (sasl.Server, error) {
+	s.tarpit()
+	if !s.authAllowed() {
+		s.log.Debug("AUTH over plaintext rejected", zap.String("mechanism", mech))
+		return nil, s.backend.plugin.smtpError(respEncryptionRequired)
+	}
+
+	switch mech {
+	case sasl.Plain:
+		return sasl.NewPlainServer(func(_, username, password string) error {
+			return s.captureAuth(mech, username, password, "", "")
+		}), nil
+	case sasl.Login:
+		return sasl.NewLoginServer(func(username, password string) error {
+			return s.captureAuth(mech, username, password, "", "")
+		}), nil
+	case cramMD5:
+		p := s.backend.plugin
+		return &cramMD5Server{
+			// RFC 2195 "<random.timestamp@host>", from the IDs and clock of the payload
+			// so that deterministic mode reproduces it
+			challenge: fmt.Sprintf("<%s.%d@%s>", p.newID(), p.now().Unix(), p.cfg.Hostname),
+			capture: func(username, digest, challenge string) error {
+				return s.captureAuth(mech, username, "", digest, challenge)
+			},
+		}, nil
+	default:
+		return nil, smtp.ErrAuthUnknownMechanism
+	}
+}
+
+// captureAuth stores the credentials of an AUTH exchange for the job payload,
+// rejected attempts are only logged and counted
+func (s *Session) captureAuth(mech, username, password, digest, challenge string) error {
+	p := s.backend.plugin
+	if p.credentials != nil {
+		ok := p.credentials.verify(username, password)
+		if mech == cramMD5 {
+			ok = p.credentials.verifyCRAMMD5(username, digest, challenge)
+		}
+		if !ok {
+			p.stats.authFailures.Add(1)
+			s.strike(respAuthFailed)
+			s.log.Info("AUTH rejected",
+				zap.String("mechanism", mech),
+				zap.String("username", username),
+			)
+			return p.smtpError(respAuthFailed)
+		}
+	}
+
+	var inbox string
+	if len(p.cfg.Auth.Inboxes) > 0 {
+		var ok bool
+		if inbox, ok = p.cfg.Auth.resolveInbox(username); !ok {
+			p.stats.authFailures.Add(1)
+			s.strike(respAuthFailed)
+			s.log.Info("AUTH rejected, username selects no configured inbox",
+				zap.String("mechanism", mech),
+				zap.String("username", username),
+			)
+			return p.smtpError(respAuthFailed)
+		}
+	}
+
+	s.mu.Lock()
+	s.authenticated = true
+	s.inbox = inbox
+	s.authMechanism = mech
+	s.authUsername = username
+	s.authPassword = password
+	s.authDigest = digest
+	s.authChallenge = challenge
+	s.mu.Unlock()
+	s.recordCommand("AUTH", func(u *ClientUsage) { u.AuthMechanisms[mech]++ })
+
+	s.log.Debug("AUTH captured",
+		zap.String("mechanism", mech),
+		zap.String("username", username),
+		zap.String("inbox", inbox),
+	)
+	return nil
+}
+
+// cramMD5Server is a CRAM-MD5 (RFC 2195) server. The digest is handed to capture
+// together with the challenge it answers, it can only be checked against a plain password.
+type cramMD5Server struct {
+	challenge string
+	sent      bool
+	capture   func(username, digest, challenge string) error
+}
+
+func (c *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if !c.sent {
+		// CRAM-MD5 has no initial response
+		if len(response) > 0 {
+			return nil, false, sasl.ErrUnexpectedClientResponse
+		}
+		c.sent = true
+		return []byte(c.challenge), false, nil
+	}
+
+	// "<username> <hex digest>", the username itself may contain spaces
+	i := strings.LastIndexByte(string(response), ' ')
+	if i < 0 {
+		return nil, false, sasl.ErrUnexpectedClientResponse
+	}
+
+	if err := c.capture(string(response[:i]), string(response[i+1:]), c.challenge); err != nil {
+		return nil, false, err
+	}
+	return nil, true, nil
+}
@@ -2,7 +2,6 @@ package smtp
 
 import (
 	"github.com/emersion/go-smtp"
-	"github.com/google/uuid"
 	"go.uber.org/zap"
 )
 
@@ -22,21 +21,82 @@ func NewBackend(plugin *Plugin) *Backend {
 
 // NewSession is called when new SMTP connection is established
 func (b *Backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	if b.plugin.isStopped() {
+		return nil, b.plugin.smtpError(respShuttingDown)
+	}
+
+	id := b.plugin.newID()
+	remoteAddr := remoteAddrOf(c.Conn())
+
+	// go-smtp creates the session on HELO/EHLO, a rejection lets the client greet again
+	if helo := c.Hostname(); len(helo) > b.plugin.cfg.Limits.MaxHeloLength {
+		b.log.Warn("HELO argument too long",
+			zap.String("remote_addr", remoteAddr),
+			zap.Int("length", len(helo)),
+			zap.String("helo", truncateForLog(helo)),
+		)
+		if b.plugin.bans != nil {
+			b.plugin.bans.strike(remoteIP(c.Conn()), respHeloTooLong)
+		}
+		return nil, b.plugin.smtpError(respHeloTooLong)
+	}
+
+	ip := remoteIP(c.Conn())
+	if resp, ok := b.plugin.acquireConn(ip, c); !ok {
+		b.log.Warn("connection limit reached, session refused",
+			zap.String("remote_addr", remoteAddr),
+			zap.String("limit", resp),
+		)
+		return nil, b.plugin.smtpError(resp)
+	}
+
 	session := &Session{
 		backend:    b,
 		conn:       c,
-		uuid:       uuid.NewString(),
-		remoteAddr: c.Conn().RemoteAddr().String(),
-		log:        b.log,
+		uuid:       id,
+		remoteAddr: remoteAddr,
+		remoteIP:   ip,
+		heloName:   c.Hostname(),
+		localAddr:  c.Conn().LocalAddr().String(),
+		listener:   b.plugin.listenerName(c.Conn().LocalAddr()),
+		transcript: transcriptOf(c.Conn()),
+		// Child logger correlates every session line by uuid and client address
+		log: b.log.With(
+			zap.String("uuid", id),
+			zap.String("remote_addr", remoteAddr),
+		),
+	}
+
+	if isEarlyTalker(c.Conn()) {
+		session.log.Warn("client sent data before greeting",
+			zap.String("action", b.plugin.cfg.Greeting.EarlyTalker),
+		)
+		if b.plugin.cfg.Greeting.EarlyTalker == earlyTalkerTempfail {
+			// No session is set, so Logout will not release the slots
+			b.plugin.releaseConn(ip, c, true)
+			if b.plugin.bans != nil {
+				b.plugin.bans.strike(ip, respEarlyTalker)
+			}
+			return nil, b.plugin.smtpError(respEarlyTalker)
+		}
+		session.anomalies = append(session.anomalies, anomalyEarlyTalker)
+	}
+
+	session.startTarpit()
+	session.startReverseDNS()
+
+	if err := session.chaos(chaosHelo); err != nil {
+		b.plugin.releaseConn(ip, c, true)
+		return nil, err
 	}
 
 	// Store connection for management
 	b.plugin.connections.Store(session.uuid, session)
+	if ic := idleConnOf(c.Conn()); ic != nil {
+		ic.session.Store(session)
+	}
 
-	b.log.Debug("new SMTP connection",
-		zap.String("uuid", session.uuid),
-		zap.String("remote_addr", session.remoteAddr),
-	)
+	session.log.Debug("new SMTP connection")
 
 	return session, nil
 }
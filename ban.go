@@ -0,0 +1,271 @@
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	banTempfail = "tempfail"
+	banDrop     = "drop"
+	banTarpit   = "tarpit"
+)
+
+// banMaxTracked bounds the IPs with strikes kept, expired entries are dropped first
+const banMaxTracked = 10000
+
+// BanConfig bans client IPs for a cooldown after repeated protocol errors or failed AUTH,
+// like fail2ban does for log lines
+type BanConfig struct {
+	// Strikes within the window that ban the IP. 0 disables.
+	Threshold int           `mapstructure:"threshold"`
+	Window    time.Duration `mapstructure:"window"`   // default 10m
+	Cooldown  time.Duration `mapstructure:"cooldown"` // default 15m
+	// "tempfail" answers new connections with 421, "drop" closes them without a banner,
+	// "tarpit" lets them in and slows them down with the tarpit delay
+	Action string `mapstructure:"action"`
+}
+
+func (b *BanConfig) initDefaults() {
+	if b.Window == 0 {
+		b.Window = 10 * time.Minute
+	}
+
+	if b.Cooldown == 0 {
+		b.Cooldown = 15 * time.Minute
+	}
+
+	if b.Action == "" {
+		b.Action = banTempfail
+	}
+}
+
+func (b *BanConfig) validate() error {
+	const op = errors.Op("smtp_ban_validate")
+
+	if b.Threshold < 0 || b.Window < 0 || b.Cooldown < 0 {
+		return errors.E(op, errors.Str("limits.ban values cannot be negative"))
+	}
+
+	switch b.Action {
+	case banTempfail, banDrop, banTarpit:
+	default:
+		return errors.E(op, errors.Errorf("limits.ban.action must be %q, %q or %q, got %q", banTempfail, banDrop, banTarpit, b.Action))
+	}
+
+	return nil
+}
+
+// Ban is a banned client IP
+type Ban struct {
+	IP      string    `json:"ip"`
+	Strikes int       `json:"strikes"` // errors counted within the window that led to the ban
+	Reason  string    `json:"reason"`  // the last error
+	Until   time.Time `json:"until"`
+}
+
+// banEntry holds the recent strikes of an IP and its ban, if any
+type banEntry struct {
+	strikes []time.Time
+	reason  string
+	until   time.Time
+}
+
+// banList counts protocol errors per IP and bans IPs reaching the threshold
+type banList struct {
+	cfg *BanConfig
+	log *zap.Logger
+
+	mu  sync.Mutex
+	ips map[string]*banEntry
+}
+
+func newBanList(cfg *BanConfig, log *zap.Logger) *banList {
+	return &banList{
+		cfg: cfg,
+		log: log,
+		ips: make(map[string]*banEntry),
+	}
+}
+
+// strike records an error from ip, banning it once the threshold is reached within the window
+func (b *banList) strike(ip, reason string) {
+	// Unix socket clients have no IP to ban
+	if ip == "" {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	e, ok := b.ips[ip]
+	if !ok {
+		if len(b.ips) >= banMaxTracked {
+			b.prune(now)
+		}
+		e = &banEntry{}
+		b.ips[ip] = e
+	}
+	if now.Before(e.until) {
+		return
+	}
+
+	// Keep only strikes within the window
+	cutoff := now.Add(-b.cfg.Window)
+	kept := e.strikes[:0]
+	for _, t := range e.strikes {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	e.strikes = append(kept, now)
+	e.reason = reason
+
+	if len(e.strikes) >= b.cfg.Threshold {
+		e.until = now.Add(b.cfg.Cooldown)
+		b.log.Warn("client IP banned",
+			zap.String("ip", ip),
+			zap.Int("strikes", len(e.strikes)),
+			zap.String("reason", reason),
+			zap.Time("until", e.until),
+		)
+	}
+}
+
+// banned reports whether ip is currently banned
+func (b *banList) banned(ip string) bool {
+	if ip == "" {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.ips[ip]
+	return ok && time.Now().Before(e.until)
+}
+
+// list returns the active bans, the longest-lasting first
+func (b *banList) list() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	bans := make([]Ban, 0)
+	for ip, e := range b.ips {
+		if now.Before(e.until) {
+			bans = append(bans, Ban{IP: ip, Strikes: len(e.strikes), Reason: e.reason, Until: e.until})
+		}
+	}
+
+	sort.Slice(bans, func(i, j int) bool {
+		if !bans[i].Until.Equal(bans[j].Until) {
+			return bans[i].Until.After(bans[j].Until)
+		}
+		return bans[i].IP < bans[j].IP
+	})
+
+	return bans
+}
+
+// activeBans lists the active bans, none when limits.ban is off
+func (p *Plugin) activeBans() []Ban {
+	if p.bans == nil {
+		return make([]Ban, 0)
+	}
+	return p.bans.list()
+}
+
+// clear lifts the ban and forgets the strikes of ip, or of every IP when ip is empty.
+// It returns how many bans were lifted.
+func (b *banList) clear(ip string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	lifted := 0
+	for key, e := range b.ips {
+		if ip != "" && key != ip {
+			continue
+		}
+		if now.Before(e.until) {
+			lifted++
+		}
+		delete(b.ips, key)
+	}
+
+	return lifted
+}
+
+// prune drops IPs that are neither banned nor have strikes within the window.
+// When every IP is active the map is reset. Caller must hold b.mu.
+func (b *banList) prune(now time.Time) {
+	cutoff := now.Add(-b.cfg.Window)
+	for ip, e := range b.ips {
+		if now.After(e.until) && (len(e.strikes) == 0 || e.strikes[len(e.strikes)-1].Before(cutoff)) {
+			delete(b.ips, ip)
+		}
+	}
+
+	if len(b.ips) >= banMaxTracked {
+		clear(b.ips)
+	}
+}
+
+// strike counts a protocol error of the session's client towards a ban and the tarpit
+func (s *Session) strike(reason string) {
+	p := s.backend.plugin
+	if p.bans != nil {
+		p.bans.strike(s.remoteIP, reason)
+	}
+
+	s.strikes++
+	if !s.tarpitted && p.cfg.Tarpit.Delay > 0 && p.cfg.Tarpit.AfterErrors > 0 && s.strikes >= p.cfg.Tarpit.AfterErrors {
+		s.tarpitted = true
+		s.log.Info("session tarpitted after errors", zap.Int("errors", s.strikes), zap.Duration("delay", p.cfg.Tarpit.Delay))
+	}
+}
+
+// banListener refuses connections from banned IPs before the banner is sent
+type banListener struct {
+	net.Listener
+	p    *Plugin
+	drop bool // close without a reply, also used for implicit TLS where plain text cannot be read
+}
+
+func (l *banListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip := remoteIP(conn)
+		if !l.p.bans.banned(ip) {
+			return conn, nil
+		}
+
+		l.p.stats.banned.Add(1)
+		l.p.log.Debug("connection from banned IP refused", zap.String("ip", ip))
+		if l.drop {
+			_ = conn.Close()
+			continue
+		}
+
+		// A slow client must not hold up accepting the next connection
+		go func() {
+			resp := l.p.smtpError(respBanned)
+			_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			_, _ = fmt.Fprintf(conn, "%d %d.%d.%d %s\r\n", resp.Code,
+				resp.EnhancedCode[0], resp.EnhancedCode[1], resp.EnhancedCode[2], resp.Message)
+			_ = conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,154 @@
+package smtp
+
+import (
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// Client behaviors set by the SetClientBehavior RPC
+const (
+	behaviorNormal        = "normal"          // clears the behavior
+	behaviorTempfail      = "tempfail"        // every MAIL FROM gets 451
+	behaviorDropAfterData = "drop_after_data" // the message is read, then the connection closed without a reply
+	behaviorSlow          = "slow"            // HELO, MAIL, RCPT and DATA wait delay before they are answered
+)
+
+// defaultSlowDelay is the wait of the slow behavior when the request sets none
+const defaultSlowDelay = 5 * time.Second
+
+// ClientBehaviorRequest makes the server misbehave for one client IP only,
+// so a negative-path test does not disturb others sharing the server
+type ClientBehaviorRequest struct {
+	IP string `json:"ip"`
+	// "tempfail", "drop_after_data", "slow", or "normal" to clear
+	Behavior string `json:"behavior"`
+	// Wait of the slow behavior in milliseconds, default 5000
+	Delay int64 `json:"delay_ms"`
+	// Milliseconds until the behavior clears itself, 0 keeps it until cleared
+	TTL int64 `json:"ttl_ms"`
+}
+
+// ClientBehavior is a behavior in effect for a client IP
+type ClientBehavior struct {
+	IP       string        `json:"ip"`
+	Behavior string        `json:"behavior"`
+	Delay    time.Duration `json:"delay"`
+	Expires  time.Time     `json:"expires,omitzero"`
+}
+
+// clientBehaviors holds the behaviors by client IP
+type clientBehaviors struct {
+	mu        sync.Mutex
+	behaviors map[string]ClientBehavior
+}
+
+func newClientBehaviors() *clientBehaviors {
+	return &clientBehaviors{
+		behaviors: make(map[string]ClientBehavior),
+	}
+}
+
+// set installs or, with "normal", clears the behavior of an IP
+func (b *clientBehaviors) set(req ClientBehaviorRequest) error {
+	const op = errors.Op("smtp_set_client_behavior")
+
+	addr, err := netip.ParseAddr(req.IP)
+	if err != nil {
+		return errors.E(op, errors.Errorf("invalid ip %q: %v", req.IP, err))
+	}
+	ip := addr.Unmap().String()
+
+	behavior := ClientBehavior{IP: ip, Behavior: req.Behavior}
+	switch req.Behavior {
+	case behaviorNormal, "":
+		b.mu.Lock()
+		delete(b.behaviors, ip)
+		b.mu.Unlock()
+		return nil
+	case behaviorSlow:
+		behavior.Delay = time.Duration(req.Delay) * time.Millisecond
+		if behavior.Delay <= 0 {
+			behavior.Delay = defaultSlowDelay
+		}
+	case behaviorTempfail, behaviorDropAfterData:
+	default:
+		return errors.E(op, errors.Errorf("behavior must be tempfail, drop_after_data, slow or normal, got %q", req.Behavior))
+	}
+
+	if req.TTL > 0 {
+		behavior.Expires = time.Now().Add(time.Duration(req.TTL) * time.Millisecond)
+	}
+
+	b.mu.Lock()
+	b.behaviors[ip] = behavior
+	b.mu.Unlock()
+	return nil
+}
+
+// get returns the unexpired behavior of an IP
+func (b *clientBehaviors) get(ip string) (ClientBehavior, bool) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ClientBehavior{}, false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	key := addr.Unmap().String()
+	behavior, ok := b.behaviors[key]
+	if ok && !behavior.Expires.IsZero() && time.Now().After(behavior.Expires) {
+		delete(b.behaviors, key)
+		return ClientBehavior{}, false
+	}
+	return behavior, ok
+}
+
+// list returns the behaviors in effect, by IP
+func (b *clientBehaviors) list() []ClientBehavior {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	list := make([]ClientBehavior, 0, len(b.behaviors))
+	for ip, behavior := range b.behaviors {
+		if !behavior.Expires.IsZero() && now.After(behavior.Expires) {
+			delete(b.behaviors, ip)
+			continue
+		}
+		list = append(list, behavior)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IP < list[j].IP })
+	return list
+}
+
+// misbehave applies the behavior set for the session's client at a phase, returning
+// the reply to answer with
+func (s *Session) misbehave(phase string) error {
+	p := s.backend.plugin
+	behavior, ok := p.behaviors.get(s.remoteIP)
+	if !ok {
+		return nil
+	}
+
+	switch {
+	case behavior.Behavior == behaviorSlow:
+		s.log.Debug("client behavior: slowing down", zap.String("phase", phase), zap.Duration("delay", behavior.Delay))
+		time.Sleep(behavior.Delay)
+	case behavior.Behavior == behaviorTempfail && phase == chaosMail:
+		s.log.Info("client behavior: tempfail")
+		return p.smtpError(respChaosTempfail)
+	case behavior.Behavior == behaviorDropAfterData && phase == chaosData:
+		s.log.Info("client behavior: dropping connection after DATA")
+		if s.conn != nil {
+			_ = s.conn.Conn().Close()
+		}
+		return p.smtpError(respChaosTempfail)
+	}
+	return nil
+}
@@ -0,0 +1,229 @@
+package smtp
+
+import (
+	"math/rand/v2"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// Phases faults are injected at
+const (
+	chaosHelo = "helo" // when the session starts on HELO/EHLO
+	chaosMail = "mail"
+	chaosRcpt = "rcpt"
+	chaosData = "data" // after the message was received, before it is queued
+)
+
+// Injected faults
+const (
+	faultLatency  = "latency"
+	faultDrop     = "drop"
+	faultReject   = "reject"
+	faultTempfail = "tempfail"
+)
+
+var chaosPhases = []string{chaosHelo, chaosMail, chaosRcpt, chaosData}
+
+// ChaosFaults are the probabilities, between 0 and 1, of each fault at a phase.
+// Drop, reject and tempfail exclude each other so they may add up to at most 1;
+// latency is rolled on its own and comes on top of them.
+type ChaosFaults struct {
+	Tempfail float64 `mapstructure:"tempfail"` // 451 4.3.0
+	Reject   float64 `mapstructure:"reject"`   // 554 5.3.0
+	Drop     float64 `mapstructure:"drop"`     // close the connection without a reply
+	Latency  float64 `mapstructure:"latency"`  // wait up to latency_max before answering
+}
+
+func (f *ChaosFaults) enabled() bool {
+	return f.Tempfail > 0 || f.Reject > 0 || f.Drop > 0 || f.Latency > 0
+}
+
+func (f *ChaosFaults) validate(name string) error {
+	for _, p := range []float64{f.Tempfail, f.Reject, f.Drop, f.Latency} {
+		if p < 0 || p > 1 {
+			return errors.Errorf("%s: probabilities must be between 0 and 1", name)
+		}
+	}
+	if f.Tempfail+f.Reject+f.Drop > 1 {
+		return errors.Errorf("%s: tempfail, reject and drop add up to more than 1", name)
+	}
+	return nil
+}
+
+// ChaosConfig injects random failures to exercise client retry logic, never enable it in production
+type ChaosConfig struct {
+	// Faults at every phase not listed in phases
+	ChaosFaults `mapstructure:",squash"`
+	// Faults replacing the ones above at "helo", "mail", "rcpt" or "data"
+	Phases map[string]ChaosFaults `mapstructure:"phases"`
+	// Longest injected latency, default 5s
+	LatencyMax time.Duration `mapstructure:"latency_max"`
+	// Seed for reproducible fault sequences, 0 picks a random one
+	Seed uint64 `mapstructure:"seed"`
+}
+
+// enabled reports whether any fault can be injected
+func (c *ChaosConfig) enabled() bool {
+	if c.ChaosFaults.enabled() {
+		return true
+	}
+	for _, faults := range c.Phases {
+		if faults.enabled() {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *ChaosConfig) initDefaults() {
+	if c.LatencyMax == 0 {
+		c.LatencyMax = 5 * time.Second
+	}
+}
+
+func (c *ChaosConfig) validate() error {
+	const op = errors.Op("smtp_chaos_validate")
+
+	if err := c.ChaosFaults.validate("chaos"); err != nil {
+		return errors.E(op, err)
+	}
+	for phase, faults := range c.Phases {
+		if !slices.Contains(chaosPhases, phase) {
+			return errors.E(op, errors.Errorf("chaos.phases: unknown phase %q, use helo, mail, rcpt or data", phase))
+		}
+		if err := faults.validate("chaos.phases." + phase); err != nil {
+			return errors.E(op, err)
+		}
+	}
+	if c.LatencyMax < 0 {
+		return errors.E(op, errors.Str("chaos.latency_max cannot be negative"))
+	}
+	return nil
+}
+
+// faults returns the faults of a phase
+func (c *ChaosConfig) faults(phase string) ChaosFaults {
+	if faults, ok := c.Phases[phase]; ok {
+		return faults
+	}
+	return c.ChaosFaults
+}
+
+// chaosInjector rolls the dice for every phase and counts what it injected
+type chaosInjector struct {
+	cfg *ChaosConfig
+	log *zap.Logger
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+
+	injected sync.Map // "<phase>.<fault>" -> *atomic.Uint64
+}
+
+func newChaosInjector(cfg *ChaosConfig, log *zap.Logger) *chaosInjector {
+	seed := cfg.Seed
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	log.Warn("chaos mode enabled, random failures will be injected", zap.Uint64("seed", seed))
+
+	return &chaosInjector{
+		cfg: cfg,
+		log: log,
+		rnd: rand.New(rand.NewPCG(seed, seed)), //nolint:gosec // not security sensitive
+	}
+}
+
+// roll returns a float in [0, 1)
+func (c *chaosInjector) roll() float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rnd.Float64()
+}
+
+// latency returns a random wait of up to latency_max
+func (c *chaosInjector) latency() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return time.Duration(c.rnd.Int64N(int64(c.cfg.LatencyMax) + 1))
+}
+
+func (c *chaosInjector) count(phase, fault string) {
+	counter, _ := c.injected.LoadOrStore(phase+"."+fault, new(atomic.Uint64))
+	counter.(*atomic.Uint64).Add(1)
+}
+
+// inject sleeps when latency is rolled and returns the fault to answer the phase with, if any
+func (c *chaosInjector) inject(phase string, log *zap.Logger) string {
+	faults := c.cfg.faults(phase)
+
+	if faults.Latency > 0 && c.roll() < faults.Latency {
+		wait := c.latency()
+		c.count(phase, faultLatency)
+		log.Info("chaos: injecting latency", zap.String("phase", phase), zap.Duration("latency", wait))
+		time.Sleep(wait)
+	}
+
+	fault := ""
+	switch r := c.roll(); {
+	case r < faults.Drop:
+		fault = faultDrop
+	case r < faults.Drop+faults.Reject:
+		fault = faultReject
+	case r < faults.Drop+faults.Reject+faults.Tempfail:
+		fault = faultTempfail
+	default:
+		return ""
+	}
+
+	c.count(phase, fault)
+	log.Info("chaos: injecting fault", zap.String("phase", phase), zap.String("fault", fault))
+	return fault
+}
+
+// summary returns how often each fault was injected, keyed "<phase>.<fault>"
+func (c *chaosInjector) summary() map[string]uint64 {
+	if c == nil {
+		return nil
+	}
+
+	injected := make(map[string]uint64)
+	c.injected.Range(func(key, value any) bool {
+		injected[key.(string)] = value.(*atomic.Uint64).Load()
+		return true
+	})
+	return injected
+}
+
+// chaos injects the behavior set for the client and the random faults of a phase into
+// the session, returning the reply to answer with. A dropped connection is closed and
+// answered with an error nobody will read.
+func (s *Session) chaos(phase string) error {
+	if err := s.misbehave(phase); err != nil {
+		return err
+	}
+
+	p := s.backend.plugin
+	if p.chaos == nil {
+		return nil
+	}
+
+	switch p.chaos.inject(phase, s.log) {
+	case faultDrop:
+		if s.conn != nil {
+			_ = s.conn.Conn().Close()
+		}
+		return p.smtpError(respChaosTempfail)
+	case faultReject:
+		return p.smtpError(respChaosReject)
+	case faultTempfail:
+		return p.smtpError(respChaosTempfail)
+	}
+	return nil
+}
@@ -12,7 +12,7 @@ import (
 
 // startCleanupRoutine starts background cleanup of temp files
 func (p *Plugin) startCleanupRoutine(ctx context.Context) {
-	if p.cfg.AttachmentStorage.Mode != "tempfile" {
+	if p.cfg.AttachmentStorage.Mode != "tempfile" && !p.cfg.AttachmentStorage.PartialMessages.Enabled {
 		return
 	}
 
@@ -47,7 +47,7 @@ func (p *Plugin) cleanupTempFiles() {
 
 	removed := 0
 	for _, entry := range entries {
-		if !strings.HasPrefix(entry.Name(), "smtp-att-") {
+		if !strings.HasPrefix(entry.Name(), tempAttachmentPrefix) && !strings.HasPrefix(entry.Name(), partialFilePrefix) {
 			continue
 		}
 
@@ -0,0 +1,128 @@
+package smtp
+
+import (
+	"maps"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// clientsMaxTracked bounds the clients kept, the least recently seen one is evicted
+const clientsMaxTracked = 10000
+
+// ClientUsage is what one client, by HELO name and IP, uses of the protocol
+type ClientUsage struct {
+	Helo string `json:"helo"`
+	IP   string `json:"ip"` // "unix" for Unix socket clients
+
+	// MAIL, RCPT, DATA, BDAT and AUTH commands accepted from the client
+	Commands map[string]uint64 `json:"commands"`
+	// Extensions used per transaction: STARTTLS, SMTPUTF8, 8BITMIME, BINARYMIME, SIZE, CHUNKING
+	Extensions map[string]uint64 `json:"extensions"`
+	// Successful AUTH exchanges by mechanism
+	AuthMechanisms map[string]uint64 `json:"auth_mechanisms"`
+
+	Transactions    uint64    `json:"transactions"`    // MAIL FROM accepted
+	TLS             uint64    `json:"tls"`             // transactions over STARTTLS or implicit TLS
+	Unauthenticated uint64    `json:"unauthenticated"` // transactions without a prior AUTH
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// clientKey identifies a client, HELO names alone are often shared between hosts
+type clientKey struct {
+	helo string
+	ip   string
+}
+
+// clientTracker aggregates ClientUsage per HELO name and IP
+type clientTracker struct {
+	mu      sync.Mutex
+	clients map[clientKey]*ClientUsage
+}
+
+func newClientTracker() *clientTracker {
+	return &clientTracker{
+		clients: make(map[clientKey]*ClientUsage),
+	}
+}
+
+// update applies fn to the usage of the client, creating it on first use
+func (t *clientTracker) update(helo, remoteAddr string, fn func(u *ClientUsage)) {
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	key := clientKey{helo: helo, ip: ip}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	u, ok := t.clients[key]
+	if !ok {
+		if len(t.clients) >= clientsMaxTracked {
+			t.evictOldest()
+		}
+		u = &ClientUsage{
+			Helo:           helo,
+			IP:             ip,
+			Commands:       make(map[string]uint64),
+			Extensions:     make(map[string]uint64),
+			AuthMechanisms: make(map[string]uint64),
+		}
+		t.clients[key] = u
+	}
+
+	fn(u)
+	u.LastSeen = time.Now()
+}
+
+// evictOldest drops the least recently seen client. Caller must hold t.mu.
+func (t *clientTracker) evictOldest() {
+	var oldest clientKey
+	var oldestSeen time.Time
+	first := true
+	for key, u := range t.clients {
+		if first || u.LastSeen.Before(oldestSeen) {
+			oldest, oldestSeen, first = key, u.LastSeen, false
+		}
+	}
+	delete(t.clients, oldest)
+}
+
+// snapshot returns the usage of every tracked client, busiest first
+func (t *clientTracker) snapshot() []ClientUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make([]ClientUsage, 0, len(t.clients))
+	for _, u := range t.clients {
+		c := *u
+		c.Commands = maps.Clone(u.Commands)
+		c.Extensions = maps.Clone(u.Extensions)
+		c.AuthMechanisms = maps.Clone(u.AuthMechanisms)
+		result = append(result, c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Transactions != result[j].Transactions {
+			return result[i].Transactions > result[j].Transactions
+		}
+		if result[i].Helo != result[j].Helo {
+			return result[i].Helo < result[j].Helo
+		}
+		return result[i].IP < result[j].IP
+	})
+
+	return result
+}
+
+// recordCommand counts an accepted command of the session's client
+func (s *Session) recordCommand(cmd string, fn func(u *ClientUsage)) {
+	s.backend.plugin.clients.update(s.conn.Hostname(), s.remoteAddr, func(u *ClientUsage) {
+		u.Commands[cmd]++
+		if fn != nil {
+			fn(u)
+		}
+	})
+}
@@ -0,0 +1,145 @@
+package smtp
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/roadrunner-server/errors"
+)
+
+// Clock tells the time stamped into job payloads (received_at, closed_at, aborted_at...)
+type Clock interface {
+	Now() time.Time
+}
+
+// IDGenerator creates the connection, message and job IDs found in job payloads.
+// Any non-empty string will do, the first 8 letters and digits of a connection ID
+// also name its temp files.
+type IDGenerator interface {
+	NewID() string
+}
+
+// DeterministicConfig makes payloads reproducible for snapshot tests
+type DeterministicConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Time of the first timestamp, RFC 3339, default "2000-01-01T00:00:00Z"
+	Start string `mapstructure:"start"`
+	// How far the clock moves on with every timestamp, 0 keeps it frozen at start
+	Step time.Duration `mapstructure:"step"`
+	// Written into every ID so that several servers in one test do not collide
+	Seed uint32 `mapstructure:"seed"`
+
+	start time.Time // parsed from Start by validate
+}
+
+func (d *DeterministicConfig) initDefaults() {
+	if d.Start == "" {
+		d.Start = "2000-01-01T00:00:00Z"
+	}
+}
+
+func (d *DeterministicConfig) validate() error {
+	const op = errors.Op("smtp_deterministic_validate")
+
+	start, err := time.Parse(time.RFC3339, d.Start)
+	if err != nil {
+		return errors.E(op, errors.Errorf("deterministic.start: %v", err))
+	}
+	if d.Step < 0 {
+		return errors.E(op, errors.Str("deterministic.step cannot be negative"))
+	}
+	d.start = start
+	return nil
+}
+
+// shortID returns the part of an ID used in file names: up to 8 letters and digits,
+// so that IDs of any length and with any separators are safe there
+func shortID(id string) string {
+	short := strings.Map(func(r rune) rune {
+		if r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r)) {
+			return r
+		}
+		return -1
+	}, id)
+	if len(short) > 8 {
+		short = short[:8]
+	}
+	return short
+}
+
+// systemClock is the wall clock
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// randomIDs generates random (version 4) UUIDs
+type randomIDs struct{}
+
+func (randomIDs) NewID() string {
+	return uuid.NewString()
+}
+
+// steppedClock starts at a fixed time and moves on by step every time it is read
+type steppedClock struct {
+	mu   sync.Mutex
+	next time.Time
+	step time.Duration
+}
+
+func (c *steppedClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.next
+	c.next = c.next.Add(c.step)
+	return now
+}
+
+// sequentialIDs generates UUID-shaped IDs counting up from 1, the counter leads
+// so the queue IDs derived from message IDs differ too
+type sequentialIDs struct {
+	seed uint32
+	n    atomic.Uint64
+}
+
+func (g *sequentialIDs) NewID() string {
+	n := g.n.Add(1)
+	return fmt.Sprintf("%08x-%04x-4000-8000-%012x", uint32(n), uint16(n>>32), g.seed)
+}
+
+// initIdentity keeps a Clock and IDGenerator set on the plugin before Init,
+// otherwise picks deterministic or real ones from the config
+func (p *Plugin) initIdentity() {
+	det := &p.cfg.Deterministic
+
+	if p.Clock == nil {
+		p.Clock = systemClock{}
+		if det.Enabled {
+			p.Clock = &steppedClock{next: det.start, step: det.Step}
+		}
+	}
+
+	if p.IDs == nil {
+		p.IDs = randomIDs{}
+		if det.Enabled {
+			p.IDs = &sequentialIDs{seed: det.Seed}
+		}
+	}
+}
+
+// now is the time for job payloads
+func (p *Plugin) now() time.Time {
+	return p.Clock.Now()
+}
+
+// newID is an ID for job payloads
+func (p *Plugin) newID() string {
+	return p.IDs.NewID()
+}
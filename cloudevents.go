@@ -0,0 +1,87 @@
+package smtp
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	cloudEventsStructured = "structured"
+	cloudEventsBinary     = "binary"
+
+	cloudEventsSpecVersion = "1.0"
+)
+
+// CloudEvents types of the jobs pushed by the plugin
+const (
+	ceTypeEmailReceived    = "io.buggregator.smtp.email.received"
+	ceTypeConnectionClosed = "io.buggregator.smtp.connection.closed"
+	ceTypeSenderAnomaly    = "io.buggregator.smtp.sender.anomaly"
+	ceTypeMessageAborted   = "io.buggregator.smtp.message.aborted"
+)
+
+// CloudEventsConfig wraps job payloads in CloudEvents 1.0
+type CloudEventsConfig struct {
+	Mode   string `mapstructure:"mode"`   // "structured" or "binary", empty disables
+	Source string `mapstructure:"source"` // event source, defaults to smtp://<hostname>
+}
+
+// initDefaults fills CloudEvents defaults, hostname is used when no source is configured
+func (c *CloudEventsConfig) initDefaults(hostname string) {
+	if c.Source == "" {
+		c.Source = "smtp://" + hostname
+	}
+}
+
+// validate checks the selected mode
+func (c *CloudEventsConfig) validate() error {
+	const op = errors.Op("smtp_cloud_events_validate")
+
+	switch c.Mode {
+	case "", cloudEventsStructured, cloudEventsBinary:
+		return nil
+	default:
+		return errors.E(op, errors.Str("jobs.cloud_events.mode must be 'structured' or 'binary'"))
+	}
+}
+
+// cloudEvent is the structured mode envelope
+type cloudEvent struct {
+	SpecVersion     string          `json:"specversion"`
+	Type            string          `json:"type"`
+	Source          string          `json:"source"`
+	ID              string          `json:"id"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// wrapCloudEvent applies the configured CloudEvents mode to a serialized payload. Structured
+// mode nests the JSON payload as data, binary mode keeps it and adds ce_ attribute headers.
+func wrapCloudEvent(cfg *CloudEventsConfig, ceType, id string, at time.Time, payload []byte, headers map[string][]string) []byte {
+	switch cfg.Mode {
+	case cloudEventsStructured:
+		headers["content-type"] = []string{"application/cloudevents+json"}
+		wrapped, _ := json.Marshal(cloudEvent{
+			SpecVersion:     cloudEventsSpecVersion,
+			Type:            ceType,
+			Source:          cfg.Source,
+			ID:              id,
+			Time:            at.UTC(),
+			DataContentType: "application/json",
+			Data:            payload,
+		})
+		return wrapped
+	case cloudEventsBinary:
+		headers["ce_specversion"] = []string{cloudEventsSpecVersion}
+		headers["ce_type"] = []string{ceType}
+		headers["ce_source"] = []string{cfg.Source}
+		headers["ce_id"] = []string{id}
+		headers["ce_time"] = []string{at.UTC().Format(time.RFC3339Nano)}
+		return payload
+	default:
+		return payload
+	}
+}
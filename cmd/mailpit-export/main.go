@@ -0,0 +1,102 @@
+// Command mailpit-export writes the messages stored in a Mailpit database
+// (MP_DATABASE) to a directory of .eml files, which the plugin's RPC ImportFile
+// then imports like any other mail directory. It is a separate module so that
+// RoadRunner binaries embedding the plugin do not link SQLite and zstd.
+//
+//	mailpit-export -db /data/mailpit.db -out ./fixtures
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+
+	// SQLite driver for reading Mailpit databases
+	_ "modernc.org/sqlite"
+)
+
+// zstdMagic starts a zstd frame; Mailpit compresses stored messages since v1.16
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// mailpitQuery reads raw messages from Mailpit's database, oldest first
+const mailpitQuery = `SELECT m.ID, d.Email FROM mailbox m JOIN mailbox_data d ON d.ID = m.ID ORDER BY m.Created`
+
+func main() {
+	db := flag.String("db", "", "path to the Mailpit database")
+	out := flag.String("out", ".", "directory the .eml files are written to")
+	flag.Parse()
+
+	if *db == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	written, failed, err := export(*db, *out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "mailpit-export:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("%d messages written to %s, %d failed\n", written, *out, failed)
+}
+
+// export writes every stored message to dir as <position>-<mailpit id>.eml
+func export(path, dir string) (int, int, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return 0, 0, err
+	}
+
+	// Read-only, Mailpit may keep running
+	dsn := (&url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}).String()
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() { _ = db.Close() }()
+
+	rows, err := db.Query(mailpitQuery)
+	if err != nil {
+		return 0, 0, fmt.Errorf("not a Mailpit database: %w", err)
+	}
+	defer func() { _ = rows.Close() }()
+
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer decoder.Close()
+
+	written, failed := 0, 0
+	for rows.Next() {
+		var id string
+		var stored []byte
+		if err := rows.Scan(&id, &stored); err != nil {
+			return written, failed, err
+		}
+
+		// Older Mailpit versions store the message as is
+		raw := stored
+		if bytes.HasPrefix(stored, zstdMagic) {
+			raw, err = decoder.DecodeAll(stored, nil)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "mailpit-export: message %s: %v\n", id, err)
+				failed++
+				continue
+			}
+		}
+
+		// The position keeps the order, the Mailpit ID is a UUID and safe as a name
+		name := fmt.Sprintf("%06d-%s.eml", written+failed+1, filepath.Base(id))
+		if err := os.WriteFile(filepath.Join(dir, name), raw, 0o644); err != nil {
+			return written, failed, err
+		}
+		written++
+	}
+
+	return written, failed, rows.Err()
+}
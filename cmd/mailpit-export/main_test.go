@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// TestExport reads a database laid out like Mailpit's, with zstd-compressed
+// and plain stored messages
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "mailpit.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		`CREATE TABLE mailbox (Created INTEGER, ID TEXT NOT NULL, Subject TEXT)`,
+		`CREATE TABLE mailbox_data (ID TEXT PRIMARY KEY, Email BLOB)`,
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := []byte("From: a@example.com\r\nTo: b@example.com\r\nSubject: one\r\n\r\nfirst\r\n")
+	second := []byte("From: a@example.com\r\nTo: c@example.com\r\nSubject: two\r\n\r\nsecond\r\n")
+	for i, row := range []struct {
+		id   string
+		data []byte
+	}{
+		{"compressed", encoder.EncodeAll(first, nil)},
+		{"plain", second},
+		{"broken", append([]byte{0x28, 0xb5, 0x2f, 0xfd}, "garbage"...)},
+	} {
+		if _, err := db.Exec(`INSERT INTO mailbox (Created, ID) VALUES (?, ?)`, i, row.id); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec(`INSERT INTO mailbox_data (ID, Email) VALUES (?, ?)`, row.id, row.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_ = encoder.Close()
+	_ = db.Close()
+
+	out := filepath.Join(dir, "out")
+	written, failed, err := export(path, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if written != 2 || failed != 1 {
+		t.Fatalf("written %d, failed %d, want 2 and 1", written, failed)
+	}
+
+	for name, want := range map[string][]byte{"000001-compressed.eml": first, "000002-plain.eml": second} {
+		got, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Errorf("%s: got %q", name, got)
+		}
+	}
+}
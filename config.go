@@ -1,6 +1,8 @@
 package smtp
 
 import (
+	"math"
+	"slices"
 	"time"
 
 	"github.com/roadrunner-server/errors"
@@ -9,11 +11,60 @@ import (
 // Config represents SMTP server configuration
 type Config struct {
 	// Server settings
-	Addr           string        `mapstructure:"addr"`
+	Addr           []string      `mapstructure:"addr"` // one or more listen addresses
 	Hostname       string        `mapstructure:"hostname"`
 	ReadTimeout    time.Duration `mapstructure:"read_timeout"`
 	WriteTimeout   time.Duration `mapstructure:"write_timeout"`
 	MaxMessageSize int64         `mapstructure:"max_message_size"`
+	MaxRecipients  int           `mapstructure:"max_recipients"` // RCPT TO accepted per message
+
+	// Length caps for HELO, command arguments and input lines
+	Limits LimitsConfig `mapstructure:"limits"`
+
+	// Address normalization applied to envelope and header addresses
+	Addresses AddressConfig `mapstructure:"addresses"`
+
+	// AUTH capture and optional credential verification
+	Auth AuthConfig `mapstructure:"auth"`
+
+	// Banner timing and early-talker handling
+	Greeting GreetingConfig `mapstructure:"greeting"`
+
+	// STARTTLS settings
+	TLS TLSConfig `mapstructure:"tls"`
+
+	// Global message throughput cap
+	Throughput ThroughputConfig `mapstructure:"throughput"`
+
+	// Answer DATA before the message is parsed and pushed
+	Delivery DeliveryConfig `mapstructure:"delivery"`
+
+	// Push only 1 in N messages during load tests
+	Sampling SamplingConfig `mapstructure:"sampling"`
+
+	// Per-sender baselines and anomaly alerts
+	SenderAlerts SenderAlertsConfig `mapstructure:"sender_alerts"`
+
+	// Per-command delay for misbehaving or denied clients
+	Tarpit TarpitConfig `mapstructure:"tarpit"`
+
+	// Random failures and latency for testing client retries
+	Chaos ChaosConfig `mapstructure:"chaos"`
+
+	// Sequential IDs and a fixed clock in job payloads
+	Deterministic DeterministicConfig `mapstructure:"deterministic"`
+
+	// PTR lookup of client IPs for the job payload
+	ReverseDNS ReverseDNSConfig `mapstructure:"reverse_dns"`
+
+	// Draining of sessions on Stop
+	Shutdown ShutdownConfig `mapstructure:"shutdown"`
+
+	// Load balancer agent-check port
+	Health HealthConfig `mapstructure:"health"`
+
+	// HTTP endpoint submitting JSON-described mail into the capture pipeline
+	SendAPI SendAPIConfig `mapstructure:"send_api"`
 
 	// Attachment storage
 	AttachmentStorage AttachmentConfig `mapstructure:"attachment_storage"`
@@ -23,6 +74,29 @@ type Config struct {
 
 	// Include full raw RFC822 message in JSON (default: false)
 	IncludeRaw bool `mapstructure:"include_raw"`
+
+	// Record the SMTP dialogue of sessions into the payload
+	Transcript TranscriptConfig `mapstructure:"transcript"`
+
+	// Prepend a Received: trace header as a real MTA would
+	ReceivedHeader bool `mapstructure:"received_header"`
+
+	// Check captured messages for faults real MTAs refuse, reported in message.lint
+	LintMIME bool `mapstructure:"lint_mime"`
+
+	// Separate the latest reply from quoted history and signatures into reply_text
+	ExtractReply bool `mapstructure:"extract_reply"`
+
+	// What message.body carries: "text", "html" or "both"
+	BodyPreference string `mapstructure:"body_preference"`
+
+	// Message text overrides for SMTP rejections, keyed by response name
+	Responses map[string]string `mapstructure:"responses"`
+
+	// Match conditions with accept, tempfail, reject or delay actions, evaluated in order
+	Rules []RuleConfig `mapstructure:"rules"`
+
+	rules []*rule // compiled from Rules by validate
 }
 
 // JobsConfig configures Jobs plugin integration
@@ -31,6 +105,116 @@ type JobsConfig struct {
 	Priority int64  `mapstructure:"priority"` // Default priority for jobs
 	Delay    int64  `mapstructure:"delay"`    // Default delay (0 = immediate)
 	AutoAck  bool   `mapstructure:"auto_ack"` // Auto-acknowledge jobs
+
+	// Push a CONNECTION_CLOSED_BY_ADMIN event when a connection is closed via RPC
+	NotifyAdminClose bool `mapstructure:"notify_admin_close"`
+
+	// Push a SENDER_ANOMALY event when sender_alerts flags a sender
+	NotifySenderAnomaly bool `mapstructure:"notify_sender_anomaly"`
+
+	// Push a MESSAGE_ABORTED event when a client disconnects mid-DATA
+	NotifyMessageAborted bool `mapstructure:"notify_message_aborted"`
+
+	// Payload encoding: "json", "msgpack", "protobuf" or a name passed to RegisterSerializer
+	Serializer string `mapstructure:"serializer"`
+	// Per-pipeline overrides of serializer, e.g. for an auth.inboxes pipeline
+	PipelineSerializers map[string]string `mapstructure:"pipeline_serializers"`
+
+	// Wrap payloads in CloudEvents 1.0 for event routers
+	CloudEvents CloudEventsConfig `mapstructure:"cloud_events"`
+
+	// Payload layout, sent in the schema_version job header. Defaults to the current
+	// one; an older version keeps consumers running during a rolling deploy.
+	SchemaVersion int `mapstructure:"schema_version"`
+
+	// Largest payload the broker accepts, e.g. 262144 for SQS. 0 disables the warnings.
+	MaxPayloadSize int64 `mapstructure:"max_payload_size"`
+	// Fraction of max_payload_size from which payloads are logged as approaching it (default 0.8)
+	PayloadWarnRatio float64 `mapstructure:"payload_warn_ratio"`
+
+	// Deadline for a push to a stalled driver, 0 waits as long as the driver does
+	PushTimeout time.Duration `mapstructure:"push_timeout"`
+	// Per-pipeline overrides of push_timeout
+	PipelineTimeouts map[string]time.Duration `mapstructure:"pipeline_timeouts"`
+
+	serializer          Serializer            // resolved from Serializer by validate
+	pipelineSerializers map[string]Serializer // resolved from PipelineSerializers by validate
+	inboxPipelines      map[string]string     // auth.inboxes pipelines by inbox ID, set by validate
+}
+
+// serializerFor returns the payload serializer of the pipeline
+func (j *JobsConfig) serializerFor(pipeline string) Serializer {
+	if s, ok := j.pipelineSerializers[pipeline]; ok {
+		return s
+	}
+	if j.serializer == nil {
+		return jsonSerializer{}
+	}
+	return j.serializer
+}
+
+// pushTimeout returns the push deadline for the pipeline, 0 when unbounded
+func (j *JobsConfig) pushTimeout(pipeline string) time.Duration {
+	if timeout, ok := j.PipelineTimeouts[pipeline]; ok {
+		return timeout
+	}
+	return j.PushTimeout
+}
+
+// GreetingConfig configures the 220 banner
+type GreetingConfig struct {
+	Delay       time.Duration `mapstructure:"delay"`        // hold the banner back, 0 disables
+	EarlyTalker string        `mapstructure:"early_talker"` // "flag", "tempfail" or "drop" clients talking before the banner
+	Banner      string        `mapstructure:"banner"`       // full 220 text, e.g. "smtp.gmail.com ESMTP ready"; not sent on tls.smtps_addr
+
+	// Per-listener banner overrides, matched by addr. Only the banner is per listener,
+	// go-smtp answers EHLO with "Hello <client>" and no server domain.
+	Listeners []ListenerGreeting `mapstructure:"listeners"`
+}
+
+// ListenerGreeting overrides the banner of one addr entry
+type ListenerGreeting struct {
+	Addr   string `mapstructure:"addr"`
+	Banner string `mapstructure:"banner"` // full 220 text, e.g. "smtp.mailgun.org ESMTP Service Ready"
+}
+
+// ThroughputConfig caps accepted transactions across all clients
+type ThroughputConfig struct {
+	MessagesPerSecond float64 `mapstructure:"messages_per_second"` // 0 disables the cap
+	Burst             int     `mapstructure:"burst"`               // bucket size, defaults to one second of traffic
+
+	// Storage from the kv section shared by all instances, the cap then applies
+	// cluster-wide per fixed window (one second, longer below 1/s) and burst is not used
+	KV string `mapstructure:"kv"`
+}
+
+// TLSConfig configures STARTTLS support
+type TLSConfig struct {
+	Cert           string        `mapstructure:"cert"`            // PEM certificate file
+	Key            string        `mapstructure:"key"`             // PEM private key file
+	ReloadInterval time.Duration `mapstructure:"reload_interval"` // how often cert files are checked for changes
+
+	// Automatic certificates, used instead of cert/key
+	ACME ACMEConfig `mapstructure:"acme"`
+
+	// Generate an in-memory self-signed certificate for hostname at startup
+	SelfSigned bool `mapstructure:"self_signed"`
+
+	// Additional implicit TLS (SMTPS) listener, e.g. ":465"
+	SMTPSAddr string `mapstructure:"smtps_addr"`
+
+	// Ask clients for a certificate, it is reported in the message's tls section but not verified
+	RequestClientCert bool `mapstructure:"request_client_cert"`
+}
+
+// enabled reports whether STARTTLS should be offered
+func (t *TLSConfig) enabled() bool {
+	return t.hasFiles() || t.ACME.Enabled || t.SelfSigned
+}
+
+// hasFiles reports whether the certificate is loaded from cert/key files
+func (t *TLSConfig) hasFiles() bool {
+	return t.Cert != "" || t.Key != ""
 }
 
 // AttachmentConfig configures how attachments are stored
@@ -38,12 +222,21 @@ type AttachmentConfig struct {
 	Mode         string        `mapstructure:"mode"`          // "memory" or "tempfile"
 	TempDir      string        `mapstructure:"temp_dir"`      // for tempfile mode
 	CleanupAfter time.Duration `mapstructure:"cleanup_after"` // auto-cleanup temp files
+
+	// Searchable text from PDF/Office attachments
+	TextExtraction TextExtractionConfig `mapstructure:"text_extraction"`
+
+	// Safety limits for containers unpacked from attachments, e.g. .msg files
+	Nested NestedLimitsConfig `mapstructure:"nested"`
+
+	// Bytes of aborted transfers, saved to temp_dir for MESSAGE_ABORTED
+	PartialMessages PartialConfig `mapstructure:"partial_messages"`
 }
 
 // InitDefaults sets default values for configuration
 func (c *Config) InitDefaults() error {
-	if c.Addr == "" {
-		c.Addr = "127.0.0.1:1025"
+	if len(c.Addr) == 0 {
+		c.Addr = []string{"127.0.0.1:1025"}
 	}
 
 	if c.Hostname == "" {
@@ -52,6 +245,10 @@ func (c *Config) InitDefaults() error {
 
 	c.IncludeRaw = true
 
+	if c.BodyPreference == "" {
+		c.BodyPreference = bodyPreferText
+	}
+
 	if c.ReadTimeout == 0 {
 		c.ReadTimeout = 60 * time.Second
 	}
@@ -64,6 +261,22 @@ func (c *Config) InitDefaults() error {
 		c.MaxMessageSize = 10 * 1024 * 1024 // 10MB
 	}
 
+	if c.MaxRecipients == 0 {
+		c.MaxRecipients = 100
+	}
+
+	c.Limits.initDefaults()
+	c.Delivery.initDefaults()
+	c.Chaos.initDefaults()
+	c.Deterministic.initDefaults()
+	c.ReverseDNS.initDefaults()
+	c.Transcript.initDefaults()
+	c.Shutdown.initDefaults()
+
+	if c.Addresses.Validation == "" {
+		c.Addresses.Validation = addressStrict
+	}
+
 	// Attachment defaults
 	if c.AttachmentStorage.Mode == "" {
 		c.AttachmentStorage.Mode = "memory"
@@ -77,11 +290,61 @@ func (c *Config) InitDefaults() error {
 		c.AttachmentStorage.CleanupAfter = 1 * time.Hour
 	}
 
+	if c.AttachmentStorage.TextExtraction.Mode != "" {
+		c.AttachmentStorage.TextExtraction.initDefaults()
+	}
+
+	c.AttachmentStorage.Nested.initDefaults()
+
+	if c.AttachmentStorage.PartialMessages.Enabled {
+		c.AttachmentStorage.PartialMessages.initDefaults()
+	}
+
+	// Greeting defaults
+	if c.Greeting.EarlyTalker == "" {
+		c.Greeting.EarlyTalker = earlyTalkerFlag
+	}
+
+	// Throughput defaults
+	if c.Throughput.MessagesPerSecond > 0 && c.Throughput.Burst == 0 {
+		c.Throughput.Burst = int(math.Ceil(c.Throughput.MessagesPerSecond))
+	}
+
+	// Sender alert defaults
+	if c.SenderAlerts.Enabled {
+		c.SenderAlerts.initDefaults()
+	}
+
+	// TLS defaults
+	if c.TLS.ReloadInterval == 0 {
+		c.TLS.ReloadInterval = 1 * time.Minute
+	}
+
+	if c.TLS.ACME.Enabled {
+		c.TLS.ACME.initDefaults(c.Hostname)
+	}
+
 	// Jobs defaults
 	if c.Jobs.Priority == 0 {
 		c.Jobs.Priority = 10
 	}
 
+	if c.Jobs.PayloadWarnRatio == 0 {
+		c.Jobs.PayloadWarnRatio = 0.8
+	}
+
+	if c.Jobs.Serializer == "" {
+		c.Jobs.Serializer = serializerJSON
+	}
+
+	if c.Jobs.SchemaVersion == 0 {
+		c.Jobs.SchemaVersion = currentSchemaVersion
+	}
+
+	if c.Jobs.CloudEvents.Mode != "" {
+		c.Jobs.CloudEvents.initDefaults(c.Hostname)
+	}
+
 	return c.validate()
 }
 
@@ -89,21 +352,221 @@ func (c *Config) InitDefaults() error {
 func (c *Config) validate() error {
 	const op = errors.Op("smtp_config_validate")
 
-	if c.Addr == "" {
+	if len(c.Addr) == 0 {
 		return errors.E(op, errors.Str("addr is required"))
 	}
 
+	seen := make(map[string]bool, len(c.Addr)+1)
+	for _, addr := range append(c.Addr, c.TLS.SMTPSAddr) {
+		if addr == "" {
+			continue
+		}
+		if seen[addr] {
+			return errors.E(op, errors.Errorf("listen address %q is configured twice", addr))
+		}
+		seen[addr] = true
+	}
+
 	if c.MaxMessageSize < 0 {
 		return errors.E(op, errors.Str("max_message_size cannot be negative"))
 	}
 
+	if c.MaxRecipients < 0 {
+		return errors.E(op, errors.Str("max_recipients cannot be negative"))
+	}
+
+	if err := c.Limits.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := c.Auth.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	c.Jobs.inboxPipelines = c.Auth.inboxPipelines()
+
+	rules, err := compileRules(c.Rules)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	c.rules = rules
+
+	if err := c.Delivery.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := c.Chaos.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if c.Deterministic.Enabled {
+		if err := c.Deterministic.validate(); err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	if err := c.Tarpit.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if c.Limits.Ban.Action == banTarpit && c.Tarpit.Delay == 0 {
+		return errors.E(op, errors.Str("limits.ban.action 'tarpit' requires tarpit.delay"))
+	}
+
+	if c.Auth.RequireTLS && !c.TLS.enabled() {
+		return errors.E(op, errors.Str("auth.require_tls requires a certificate: tls.cert/tls.key, tls.self_signed or tls.acme"))
+	}
+
+	if c.Addresses.Validation != addressStrict && c.Addresses.Validation != addressLenient {
+		return errors.E(op, errors.Str("addresses.validation must be 'strict' or 'lenient'"))
+	}
+
+	switch c.BodyPreference {
+	case bodyPreferText, bodyPreferHTML, bodyPreferBoth:
+	default:
+		return errors.E(op, errors.Str("body_preference must be 'text', 'html' or 'both'"))
+	}
+
 	if c.AttachmentStorage.Mode != "memory" && c.AttachmentStorage.Mode != "tempfile" {
 		return errors.E(op, errors.Str("attachment_storage.mode must be 'memory' or 'tempfile'"))
 	}
 
+	if err := c.AttachmentStorage.TextExtraction.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := c.AttachmentStorage.Nested.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if err := c.AttachmentStorage.PartialMessages.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	if c.Greeting.Delay < 0 {
+		return errors.E(op, errors.Str("greeting.delay cannot be negative"))
+	}
+
+	switch c.Greeting.EarlyTalker {
+	case earlyTalkerFlag, earlyTalkerTempfail, earlyTalkerDrop:
+	default:
+		return errors.E(op, errors.Str("greeting.early_talker must be 'flag', 'tempfail' or 'drop'"))
+	}
+
+	for _, lg := range c.Greeting.Listeners {
+		// SMTPS sends the banner inside TLS, where it cannot be rewritten
+		if !slices.Contains(c.Addr, lg.Addr) {
+			return errors.E(op, errors.Errorf("greeting.listeners: %q is not one of addr", lg.Addr))
+		}
+		if lg.Banner == "" {
+			return errors.E(op, errors.Errorf("greeting.listeners: %q needs banner", lg.Addr))
+		}
+	}
+
+	if c.Throughput.MessagesPerSecond < 0 || c.Throughput.Burst < 0 {
+		return errors.E(op, errors.Str("throughput.messages_per_second and throughput.burst cannot be negative"))
+	}
+
+	if c.Throughput.KV != "" && c.Throughput.MessagesPerSecond == 0 {
+		return errors.E(op, errors.Str("throughput.kv requires throughput.messages_per_second"))
+	}
+
+	if c.SenderAlerts.Window < 0 || c.SenderAlerts.VolumeFactor < 0 || c.SenderAlerts.SizeFactor < 0 || c.SenderAlerts.MinMessages < 0 {
+		return errors.E(op, errors.Str("sender_alerts values cannot be negative"))
+	}
+
+	if c.Health.OverloadConnections < 0 {
+		return errors.E(op, errors.Str("health.overload_connections cannot be negative"))
+	}
+
+	if c.TLS.hasFiles() && (c.TLS.Cert == "" || c.TLS.Key == "") {
+		return errors.E(op, errors.Str("tls.cert and tls.key must be set together"))
+	}
+
+	if c.TLS.SelfSigned && c.TLS.hasFiles() {
+		return errors.E(op, errors.Str("tls.self_signed cannot be combined with tls.cert/tls.key"))
+	}
+
+	if c.TLS.ACME.Enabled {
+		if c.TLS.hasFiles() {
+			return errors.E(op, errors.Str("tls.acme cannot be combined with tls.cert/tls.key"))
+		}
+
+		if c.TLS.SelfSigned {
+			return errors.E(op, errors.Str("tls.acme cannot be combined with tls.self_signed"))
+		}
+
+		if c.TLS.ACME.Challenge != challengeHTTP01 && c.TLS.ACME.Challenge != challengeTLSALPN01 {
+			return errors.E(op, errors.Str("tls.acme.challenge must be 'http-01' or 'tls-alpn-01'"))
+		}
+	}
+
+	if c.TLS.SMTPSAddr != "" {
+		if !c.TLS.enabled() {
+			return errors.E(op, errors.Str("tls.smtps_addr requires a certificate: tls.cert/tls.key, tls.self_signed or tls.acme"))
+		}
+	}
+
 	if c.Jobs.Pipeline == "" {
 		return errors.E(op, errors.Str("jobs.pipeline is required"))
 	}
 
+	serializer, ok := lookupSerializer(c.Jobs.Serializer)
+	if !ok {
+		return errors.E(op, errors.Errorf("jobs.serializer: unknown serializer %q", c.Jobs.Serializer))
+	}
+	c.Jobs.serializer = serializer
+
+	if err := c.Jobs.CloudEvents.validate(); err != nil {
+		return errors.E(op, err)
+	}
+
+	c.Jobs.pipelineSerializers = make(map[string]Serializer, len(c.Jobs.PipelineSerializers))
+	for pipeline, name := range c.Jobs.PipelineSerializers {
+		s, ok := lookupSerializer(name)
+		if !ok {
+			return errors.E(op, errors.Errorf("jobs.pipeline_serializers.%s: unknown serializer %q", pipeline, name))
+		}
+		c.Jobs.pipelineSerializers[pipeline] = s
+	}
+
+	// Structured CloudEvents embed the payload as JSON data
+	if c.Jobs.CloudEvents.Mode == cloudEventsStructured {
+		if c.Jobs.Serializer != serializerJSON {
+			return errors.E(op, errors.Str("jobs.cloud_events.mode 'structured' requires jobs.serializer 'json'"))
+		}
+		for pipeline, name := range c.Jobs.PipelineSerializers {
+			if name != serializerJSON {
+				return errors.E(op, errors.Errorf("jobs.cloud_events.mode 'structured' requires jobs.pipeline_serializers.%s 'json'", pipeline))
+			}
+		}
+	}
+
+	if c.Jobs.SchemaVersion < schemaV1 || c.Jobs.SchemaVersion > currentSchemaVersion {
+		return errors.E(op, errors.Errorf("jobs.schema_version must be between %d and %d", schemaV1, currentSchemaVersion))
+	}
+
+	if c.Jobs.MaxPayloadSize < 0 {
+		return errors.E(op, errors.Str("jobs.max_payload_size cannot be negative"))
+	}
+
+	if c.Jobs.PushTimeout < 0 {
+		return errors.E(op, errors.Str("jobs.push_timeout cannot be negative"))
+	}
+
+	for pipeline, timeout := range c.Jobs.PipelineTimeouts {
+		if timeout < 0 {
+			return errors.E(op, errors.Errorf("jobs.pipeline_timeouts.%s cannot be negative", pipeline))
+		}
+	}
+
+	if c.Jobs.PayloadWarnRatio <= 0 || c.Jobs.PayloadWarnRatio > 1 {
+		return errors.E(op, errors.Str("jobs.payload_warn_ratio must be in (0, 1]"))
+	}
+
+	if err := validateResponses(c.Responses); err != nil {
+		return errors.E(op, err)
+	}
+
 	return nil
 }
@@ -0,0 +1,208 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"  //nolint:gosec // CRAM-MD5 and apr1 hashes are defined on MD5
+	"crypto/sha1" //nolint:gosec // htpasswd {SHA} entries
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AuthConfig configures AUTH handling, by default every attempt is accepted
+type AuthConfig struct {
+	// Reject MAIL FROM with 530 until AUTH succeeded
+	Required bool `mapstructure:"required"`
+	// Advertise and accept AUTH only over TLS, plaintext attempts get 538
+	RequireTLS bool `mapstructure:"require_tls"`
+	// Reject unknown users and wrong passwords with 535
+	Verify bool `mapstructure:"verify"`
+	// Plain text passwords by username, the only source CRAM-MD5 can be checked against
+	Users map[string]string `mapstructure:"users"`
+	// htpasswd file with bcrypt, $apr1$ or {SHA} entries
+	Htpasswd string `mapstructure:"htpasswd"`
+	// Logical inboxes by ID, selected by "<project>.<inbox>" usernames. When set,
+	// AUTH with a username naming no configured inbox gets 535.
+	Inboxes map[string]InboxConfig `mapstructure:"inboxes"`
+}
+
+// validate checks a user source is configured when verification is on
+func (a *AuthConfig) validate() error {
+	const op = errors.Op("smtp_auth_validate")
+
+	if a.Verify && len(a.Users) == 0 && a.Htpasswd == "" {
+		return errors.E(op, errors.Str("auth.verify requires auth.users or auth.htpasswd"))
+	}
+
+	for id := range a.Inboxes {
+		if id == "" || strings.Contains(id, ".") {
+			return errors.E(op, errors.Errorf("auth.inboxes: invalid inbox ID %q, it is the part after the last dot of the username", id))
+		}
+	}
+
+	return nil
+}
+
+// credentialStore checks AUTH attempts against the configured users
+type credentialStore struct {
+	plain  map[string]string // username -> password
+	hashed map[string]string // username -> htpasswd hash
+}
+
+// newCredentialStore loads auth.users and the htpasswd file
+func newCredentialStore(cfg *AuthConfig) (*credentialStore, error) {
+	const op = errors.Op("smtp_credentials_load")
+
+	c := &credentialStore{
+		plain:  make(map[string]string, len(cfg.Users)),
+		hashed: make(map[string]string),
+	}
+	for user, password := range cfg.Users {
+		c.plain[user] = password
+	}
+
+	if cfg.Htpasswd == "" {
+		return c, nil
+	}
+
+	data, err := os.ReadFile(cfg.Htpasswd)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(entry, ":")
+		if !ok || user == "" {
+			return nil, errors.E(op, errors.Errorf("%s:%d: expected user:hash", cfg.Htpasswd, line))
+		}
+		if !isSupportedHash(hash) {
+			return nil, errors.E(op, errors.Errorf("%s:%d: unsupported hash for %q, use bcrypt, $apr1$ or {SHA}", cfg.Htpasswd, line, user))
+		}
+		c.hashed[user] = hash
+	}
+
+	return c, nil
+}
+
+// verify checks a username and password from PLAIN or LOGIN
+func (c *credentialStore) verify(username, password string) bool {
+	if expected, ok := c.plain[username]; ok {
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	}
+
+	if hash, ok := c.hashed[username]; ok {
+		return matchHash(hash, password)
+	}
+
+	return false
+}
+
+// verifyCRAMMD5 checks the hex HMAC-MD5 of the challenge, keyed with the user's password
+func (c *credentialStore) verifyCRAMMD5(username, digest, challenge string) bool {
+	password, ok := c.plain[username]
+	if !ok {
+		return false
+	}
+
+	mac := hmac.New(md5.New, []byte(password))
+	mac.Write([]byte(challenge))
+	expected := hex.EncodeToString(mac.Sum(nil))
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(digest))) == 1
+}
+
+func isSupportedHash(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$") ||
+		strings.HasPrefix(hash, "$apr1$") || strings.HasPrefix(hash, "{SHA}")
+}
+
+// matchHash compares a password with an htpasswd hash
+func matchHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt, _, _ := strings.Cut(strings.TrimPrefix(hash, "$apr1$"), "$")
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(expected), []byte(hash)) == 1
+	default:
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+}
+
+// apr1 computes Apache's MD5-based password hash, "$apr1$<salt>$<digest>"
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		ctx.Write(alt[:min(i, 16)])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := range 1000 {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString(magic + salt + "$")
+	encode := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		encode(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	encode(uint32(final[11]), 2)
+
+	return out.String()
+}
@@ -0,0 +1,196 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// closeSessionsWait is how long Stop waits for sessions busy with a command to
+// go back to reading the next one, sessions still busy are closed without 421
+const closeSessionsWait = time.Second
+
+// ShutdownConfig controls what Stop does with sessions still connected
+type ShutdownConfig struct {
+	// Time message transfers in progress get to finish, default 10s. Sessions still
+	// open afterwards are sent 421 and closed, negative closes them right away.
+	GracePeriod time.Duration `mapstructure:"grace_period"`
+}
+
+func (s *ShutdownConfig) initDefaults() {
+	if s.GracePeriod == 0 {
+		s.GracePeriod = 10 * time.Second
+	}
+}
+
+// drainTransfers waits for DATA/BDAT transfers in progress to be read, parsed
+// and pushed, for shutdown.grace_period at most
+func (p *Plugin) drainTransfers(ctx context.Context) {
+	grace := p.cfg.Shutdown.GracePeriod
+	if grace <= 0 || p.transfers.Load() == 0 {
+		return
+	}
+
+	p.log.Info("waiting for message transfers to finish",
+		zap.Int64("transfers", p.transfers.Load()),
+		zap.Duration("grace_period", grace),
+	)
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+
+	for p.transfers.Load() > 0 {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			p.log.Warn("grace period over, closing sessions with transfers in progress",
+				zap.Int64("transfers", p.transfers.Load()),
+			)
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeSessions tells every connected client the service is going away, as RFC 5321
+// section 3.8 allows at any time, and closes the connection. The 421 is only written
+// while go-smtp waits for the next command, so that it cannot interleave with a reply;
+// sessions busy with a command are retried until closeSessionsWait, a new MAIL FROM
+// is answered by respShuttingDown meanwhile.
+func (p *Plugin) closeSessions(ctx context.Context) {
+	resp := p.smtpError(respShuttingDown)
+	line := []byte(fmt.Sprintf("%d %d.%d.%d %s\r\n", resp.Code,
+		resp.EnhancedCode[0], resp.EnhancedCode[1], resp.EnhancedCode[2], resp.Message))
+
+	timer := time.NewTimer(closeSessionsWait)
+	defer timer.Stop()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		busy := 0
+		p.connections.Range(func(_, value any) bool {
+			if !value.(*Session).closeIfIdle(line) {
+				busy++
+			}
+			return true
+		})
+		if busy == 0 {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			p.log.Warn("sessions busy with a command closed without 421", zap.Int("sessions", busy))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeIfIdle writes line and closes the connection when go-smtp is waiting for the
+// next command, false while the session is busy
+func (s *Session) closeIfIdle(line []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.conn == nil {
+		return true
+	}
+	// Checked first, go-smtp swaps the connection during STARTTLS, which is never idle
+	if !s.idle {
+		return false
+	}
+
+	conn := s.conn.Conn()
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, _ = conn.Write(line)
+	// Logout removes the session once go-smtp notices the closed connection
+	_ = conn.Close()
+	s.closed = true
+	return true
+}
+
+// setIdle records whether go-smtp is blocked reading from the client. Reads of
+// message data do not count, the client is still sending. Clearing it waits for
+// closeIfIdle, so that no reply is written while the 421 goes out.
+func (s *Session) setIdle(idle bool) {
+	s.mu.Lock()
+	s.idle = idle && !s.transferring
+	s.mu.Unlock()
+}
+
+// setTransferring marks message data being read, which Stop does not interrupt
+func (s *Session) setTransferring(transferring bool) {
+	s.mu.Lock()
+	s.transferring = transferring
+	s.mu.Unlock()
+}
+
+// idleListener tracks when sessions wait for the client
+type idleListener struct {
+	net.Listener
+}
+
+func (l *idleListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &idleConn{Conn: conn}, nil
+}
+
+// idleConn is the innermost connection layer, it tells the session using it when a
+// read blocks. Under TLS it sees encrypted bytes, which is fine for telling reads apart.
+type idleConn struct {
+	net.Conn
+	session atomic.Pointer[Session]
+	writes  atomic.Int64
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	s := c.session.Load()
+	if s == nil {
+		return c.Conn.Read(b)
+	}
+
+	s.setIdle(true)
+	n, err := c.Conn.Read(b)
+	s.setIdle(false)
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	// A 220 after the greeting accepts STARTTLS: the reads that follow are the
+	// handshake, and the session is replaced once it completes
+	if c.writes.Add(1) > 1 && bytes.HasPrefix(b, []byte("220 ")) {
+		c.session.Store(nil)
+	}
+	return c.Conn.Write(b)
+}
+
+// idleConnOf finds the idle tracker under the other connection layers
+func idleConnOf(conn net.Conn) *idleConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if gc, ok := conn.(*greetingConn); ok {
+		conn = gc.Conn
+	}
+	if tc, ok := conn.(*transcriptConn); ok {
+		conn = tc.Conn
+	}
+	ic, _ := conn.(*idleConn)
+	return ic
+}
@@ -0,0 +1,130 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// replyLine is a well-formed SMTP reply line
+var replyLine = regexp.MustCompile(`^[2-5][0-9]{2}[ -]`)
+
+// testClient speaks SMTP over a raw connection to see every reply line as sent
+type testClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialTestClient(t *testing.T, addr string) *testClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := &testClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	c.expect("220")
+	c.send("EHLO client.test")
+	c.expect("250")
+	return c
+}
+
+func (c *testClient) send(line string) {
+	c.t.Helper()
+	if _, err := c.conn.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// expect reads a complete, possibly multiline reply and checks its code
+func (c *testClient) expect(code string) string {
+	c.t.Helper()
+
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("waiting for %s: %v", code, err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if !replyLine.MatchString(line) {
+			c.t.Fatalf("malformed reply line %q", line)
+		}
+		if line[3] == ' ' {
+			if !strings.HasPrefix(line, code) {
+				c.t.Fatalf("got %q, want %s", line, code)
+			}
+			return line
+		}
+	}
+}
+
+// closed checks that nothing but the end of the connection follows
+func (c *testClient) closed() {
+	c.t.Helper()
+	if line, err := c.r.ReadString('\n'); err == nil {
+		c.t.Errorf("unexpected %q after 421", line)
+	}
+}
+
+// TestStopDuringTransactions stops the plugin while sessions are idle in a transaction,
+// busy with a command and sending message data; every reply has to stay well-formed
+func TestStopDuringTransactions(t *testing.T) {
+	p, addr := startTestPlugin(t, func(c *Config) {
+		c.Rules = []RuleConfig{{From: "^slow@", Action: ruleDelay, Delay: 300 * time.Millisecond}}
+	})
+
+	// Waiting for the next command inside a transaction
+	idle := dialTestClient(t, addr)
+	idle.send("MAIL FROM:<a@example.com>")
+	idle.expect("250")
+	idle.send("RCPT TO:<b@example.com>")
+	idle.expect("250")
+
+	// Sending message data
+	data := dialTestClient(t, addr)
+	data.send("MAIL FROM:<a@example.com>")
+	data.expect("250")
+	data.send("RCPT TO:<b@example.com>")
+	data.expect("250")
+	data.send("DATA")
+	data.expect("354")
+	data.send("Subject: draining\r\n\r\nfirst half")
+
+	// Inside MAIL FROM, held up by the delay rule
+	busy := dialTestClient(t, addr)
+	busy.send("MAIL FROM:<slow@example.com>")
+	time.Sleep(50 * time.Millisecond)
+
+	stopped := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		stopped <- p.Stop(ctx)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	data.send("second half\r\n.")
+
+	data.expect("250")
+	data.expect("421")
+	data.closed()
+
+	busy.expect("250")
+	busy.expect("421")
+	busy.closed()
+
+	idle.expect("421")
+	idle.closed()
+
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+}
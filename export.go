@@ -0,0 +1,178 @@
+package smtp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// redactedValue replaces secrets in exported state
+const redactedValue = "[redacted]"
+
+// ExportRequest describes which state goes into the archive
+type ExportRequest struct {
+	// Path of the .tar.gz archive to create
+	Path string `json:"path"`
+	// Messages is the number of most recent messages to include (0 = none)
+	Messages int `json:"messages"`
+}
+
+// redacted returns a copy of the configuration safe to share in bug reports
+func (c *Config) redacted() Config {
+	out := *c
+
+	// Static users carry plaintext passwords
+	if c.Auth.Users != nil {
+		out.Auth.Users = make(map[string]string, len(c.Auth.Users))
+		for user := range c.Auth.Users {
+			out.Auth.Users[user] = redactedValue
+		}
+	}
+
+	if c.SendAPI.Token != "" {
+		out.SendAPI.Token = redactedValue
+	}
+
+	// Service URLs may embed credentials
+	out.AttachmentStorage.TextExtraction.TikaURL = redactedURL(c.AttachmentStorage.TextExtraction.TikaURL)
+	out.TLS.ACME.DirectoryURL = redactedURL(c.TLS.ACME.DirectoryURL)
+
+	return out
+}
+
+// redactedURL masks the password of a URL with userinfo
+func redactedURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.User == nil {
+		return raw
+	}
+	// url.URL.String would escape the brackets of redactedValue
+	if _, ok := u.User.Password(); ok {
+		return strings.Replace(raw, u.User.String()+"@", url.User(u.User.Username()).String()+":"+redactedValue+"@", 1)
+	}
+	return raw
+}
+
+// exportStats is stats.json of the archive: counters, latency percentiles,
+// payload sizes and the active bans
+type exportStats struct {
+	Stats
+	Bans []Ban `json:"bans"`
+}
+
+// exportState writes effective config, active connections, stats and optionally
+// recent messages into a gzipped tar archive. The archive is written next to
+// req.Path and renamed into place, a failed export leaves no partial file behind.
+func (p *Plugin) exportState(req ExportRequest) error {
+	const op = errors.Op("smtp_export_state")
+
+	if req.Path == "" {
+		return errors.E(op, errors.Str("path is required"))
+	}
+
+	dir := filepath.Dir(req.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.E(op, err)
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(req.Path)+".*.tmp")
+	if err != nil {
+		return errors.E(op, err)
+	}
+	tmp := f.Name()
+
+	err = p.writeState(f, req)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmp, req.Path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return errors.E(op, err)
+	}
+
+	return nil
+}
+
+// writeState writes the archive contents to w
+func (p *Plugin) writeState(w io.Writer, req ExportRequest) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	type entry struct {
+		name string
+		v    any
+	}
+
+	files := []entry{
+		{"config.json", p.cfg.redacted()},
+		{"connections.json", p.connectionInfos()},
+		{"stats.json", exportStats{Stats: p.statsSnapshot(), Bans: p.activeBans()}},
+	}
+
+	if req.Messages > 0 {
+		files = append(files, entry{"messages.json", p.recentMessages(req.Messages)})
+	}
+
+	now := time.Now()
+	for _, file := range files {
+		data, err := json.MarshalIndent(file.v, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    file.name,
+			Mode:    0644,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// recentMessages returns up to n latest messages with captured credentials and transcripts redacted
+func (p *Plugin) recentMessages(n int) []EmailData {
+	emails, _, _ := p.tail.since(0)
+	if len(emails) > n {
+		emails = emails[len(emails)-n:]
+	}
+
+	result := make([]EmailData, 0, len(emails))
+	for _, email := range emails {
+		e := *email
+		if e.Auth != nil {
+			auth := *e.Auth
+			auth.Password = redactedValue
+			e.Auth = &auth
+		}
+		e.Transcript = ""
+		result = append(result, e)
+	}
+
+	return result
+}
@@ -0,0 +1,78 @@
+package smtp
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExportState(t *testing.T) {
+	p, _ := startTestPlugin(t, nil)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.tar.gz")
+
+	if err := p.exportState(ExportRequest{Path: path}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string][]byte{}
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files[hdr.Name], err = io.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var stats map[string]json.RawMessage
+	if err := json.Unmarshal(files["stats.json"], &stats); err != nil {
+		t.Fatalf("stats.json: %v", err)
+	}
+	for _, key := range []string{"accepted", "latency", "payloads", "bans"} {
+		if _, ok := stats[key]; !ok {
+			t.Errorf("stats.json lacks %s", key)
+		}
+	}
+	if _, ok := files["config.json"]; !ok {
+		t.Error("config.json missing")
+	}
+
+	// A failed export leaves neither the target nor a temporary file behind
+	blocked := filepath.Join(dir, "blocked")
+	if err := os.Mkdir(blocked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(blocked, "keep"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.exportState(ExportRequest{Path: blocked}); err == nil {
+		t.Fatal("exported over a directory")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("left behind %v", entries)
+	}
+}
@@ -0,0 +1,583 @@
+package smtp
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Rule expressions are a small, side-effect free language for rules.when:
+//
+//	count % 3 == 0 && !authenticated
+//	size > 1048576 || matches(subject, "(?i)invoice")
+//	"qa@example.com" in to
+//
+// Values are integers, strings, booleans and string lists. Operators, loosest first:
+// ||, &&, == !=, < <= > >= in, + -, * / %, unary ! and -. Functions: contains,
+// hasPrefix, hasSuffix, lower, len and matches (the pattern must be a string literal).
+
+// exprNode is a parsed expression
+type exprNode interface {
+	eval(env map[string]any) (any, error)
+}
+
+// parseExpr parses src, allowing only the given variable names
+func parseExpr(src string, vars []string) (exprNode, error) {
+	tokens, err := tokenizeExpr(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, vars: vars}
+	node, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+	}
+
+	return node, nil
+}
+
+// evalBool evaluates a condition
+func evalBool(node exprNode, env map[string]any) (bool, error) {
+	v, err := node.eval(env)
+	if err != nil {
+		return false, err
+	}
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("expression is %s, not a boolean", exprType(v))
+	}
+	return b, nil
+}
+
+type exprTokenKind int
+
+const (
+	tokEOF exprTokenKind = iota
+	tokInt
+	tokString
+	tokIdent
+	tokOp
+)
+
+type exprToken struct {
+	kind exprTokenKind
+	text string // operator or identifier, the unquoted value of a string
+	num  int64
+	pos  int
+}
+
+// exprOps are the operators, two-character ones first
+var exprOps = []string{"||", "&&", "==", "!=", "<=", ">=", "<", ">", "+", "-", "*", "/", "%", "!", "(", ")", ","}
+
+func tokenizeExpr(src string) ([]exprToken, error) {
+	var tokens []exprToken
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c >= '0' && c <= '9':
+			start := i
+			for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+				i++
+			}
+			n, err := strconv.ParseInt(src[start:i], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid number at offset %d: %v", start, err)
+			}
+			tokens = append(tokens, exprToken{kind: tokInt, num: n, text: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			var b strings.Builder
+			for i++; ; i++ {
+				if i >= len(src) {
+					return nil, fmt.Errorf("unterminated string at offset %d", start)
+				}
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+					b.WriteByte(src[i])
+					continue
+				}
+				if rune(src[i]) == c {
+					i++
+					break
+				}
+				b.WriteByte(src[i])
+			}
+			tokens = append(tokens, exprToken{kind: tokString, text: b.String(), pos: start})
+		case isExprIdent(c, false):
+			start := i
+			for i < len(src) && isExprIdent(rune(src[i]), true) {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokIdent, text: src[start:i], pos: start})
+		default:
+			op := ""
+			for _, candidate := range exprOps {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+			tokens = append(tokens, exprToken{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+
+	return append(tokens, exprToken{kind: tokEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+// isExprIdent reports whether c may appear in an identifier, digits only after the first character
+func isExprIdent(c rune, digits bool) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (digits && c >= '0' && c <= '9')
+}
+
+// exprVars returns the variables node refers to
+func exprVars(node exprNode) []string {
+	switch n := node.(type) {
+	case *exprVar:
+		return []string{n.name}
+	case *exprUnary:
+		return exprVars(n.operand)
+	case *exprBinary:
+		return append(exprVars(n.left), exprVars(n.right)...)
+	case *exprCall:
+		var vars []string
+		for _, arg := range n.args {
+			vars = append(vars, exprVars(arg)...)
+		}
+		return vars
+	}
+	return nil
+}
+
+// exprPrecedence of binary operators, higher binds tighter
+var exprPrecedence = map[string]int{
+	"||": 1,
+	"&&": 2,
+	"==": 3, "!=": 3,
+	"<": 4, "<=": 4, ">": 4, ">=": 4, "in": 4,
+	"+": 5, "-": 5,
+	"*": 6, "/": 6, "%": 6,
+}
+
+// exprParser is a precedence climbing parser
+type exprParser struct {
+	tokens []exprToken
+	pos    int
+	vars   []string
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(op string) error {
+	if tok := p.next(); tok.kind != tokOp || tok.text != op {
+		return fmt.Errorf("expected %q at offset %d, got %q", op, tok.pos, tok.text)
+	}
+	return nil
+}
+
+// binaryOp returns the binary operator at the current token, if any
+func (p *exprParser) binaryOp() (string, bool) {
+	tok := p.peek()
+	if tok.kind == tokOp || (tok.kind == tokIdent && tok.text == "in") {
+		_, ok := exprPrecedence[tok.text]
+		return tok.text, ok
+	}
+	return "", false
+}
+
+// parse parses operators binding tighter than minPrec
+func (p *exprParser) parse(minPrec int) (exprNode, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, ok := p.binaryOp()
+		if !ok || exprPrecedence[op] <= minPrec {
+			return left, nil
+		}
+		p.next()
+
+		right, err := p.parse(exprPrecedence[op])
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: op, left: left, right: right}
+	}
+}
+
+func (p *exprParser) unary() (exprNode, error) {
+	tok := p.peek()
+	if tok.kind == tokOp && (tok.text == "!" || tok.text == "-") {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprUnary{op: tok.text, operand: operand}, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokInt:
+		return &exprLiteral{value: tok.num}, nil
+	case tokString:
+		return &exprLiteral{value: tok.text}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &exprLiteral{value: true}, nil
+		case "false":
+			return &exprLiteral{value: false}, nil
+		}
+		if next := p.peek(); next.kind == tokOp && next.text == "(" {
+			return p.call(tok)
+		}
+		if !slices.Contains(p.vars, tok.text) {
+			return nil, fmt.Errorf("unknown variable %q at offset %d, expected one of: %s", tok.text, tok.pos, strings.Join(p.vars, ", "))
+		}
+		return &exprVar{name: tok.text}, nil
+	case tokOp:
+		if tok.text == "(" {
+			node, err := p.parse(0)
+			if err != nil {
+				return nil, err
+			}
+			return node, p.expect(")")
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", tok.text, tok.pos)
+}
+
+// exprFuncArity is the number of arguments of every function
+var exprFuncArity = map[string]int{
+	"contains":  2,
+	"hasPrefix": 2,
+	"hasSuffix": 2,
+	"lower":     1,
+	"len":       1,
+	"matches":   2,
+}
+
+func (p *exprParser) call(name exprToken) (exprNode, error) {
+	arity, ok := exprFuncArity[name.text]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %q at offset %d", name.text, name.pos)
+	}
+
+	_ = p.next() // (
+	var args []exprNode
+	for p.peek().kind != tokOp || p.peek().text != ")" {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parse(0)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	_ = p.next() // )
+
+	if len(args) != arity {
+		return nil, fmt.Errorf("%s takes %d arguments, got %d", name.text, arity, len(args))
+	}
+
+	call := &exprCall{name: name.text, args: args}
+	if name.text == "matches" {
+		lit, ok := args[1].(*exprLiteral)
+		pattern, isString := lit.valueString()
+		if !ok || !isString {
+			return nil, fmt.Errorf("matches needs a string literal pattern at offset %d", name.pos)
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("matches pattern: %v", err)
+		}
+		call.re = re
+	}
+
+	return call, nil
+}
+
+type exprLiteral struct {
+	value any
+}
+
+func (l *exprLiteral) eval(map[string]any) (any, error) {
+	return l.value, nil
+}
+
+func (l *exprLiteral) valueString() (string, bool) {
+	if l == nil {
+		return "", false
+	}
+	s, ok := l.value.(string)
+	return s, ok
+}
+
+type exprVar struct {
+	name string
+}
+
+func (v *exprVar) eval(env map[string]any) (any, error) {
+	value, ok := env[v.name]
+	if !ok {
+		return nil, fmt.Errorf("%s is not known at this stage", v.name)
+	}
+	return value, nil
+}
+
+type exprUnary struct {
+	op      string
+	operand exprNode
+}
+
+func (u *exprUnary) eval(env map[string]any) (any, error) {
+	v, err := u.operand.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch x := v.(type) {
+	case bool:
+		if u.op == "!" {
+			return !x, nil
+		}
+	case int64:
+		if u.op == "-" {
+			return -x, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot apply %s to %s", u.op, exprType(v))
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+func (b *exprBinary) eval(env map[string]any) (any, error) {
+	l, err := b.left.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	// Short-circuit logic
+	if b.op == "&&" || b.op == "||" {
+		lb, ok := l.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %s to %s", b.op, exprType(l))
+		}
+		if (b.op == "&&" && !lb) || (b.op == "||" && lb) {
+			return lb, nil
+		}
+		r, err := b.right.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		rb, ok := r.(bool)
+		if !ok {
+			return nil, fmt.Errorf("cannot apply %s to %s", b.op, exprType(r))
+		}
+		return rb, nil
+	}
+
+	r, err := b.right.eval(env)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b.op {
+	case "==":
+		return exprEqual(l, r)
+	case "!=":
+		eq, err := exprEqual(l, r)
+		if err != nil {
+			return nil, err
+		}
+		return !eq, nil
+	case "in":
+		return exprContains(r, l)
+	}
+
+	switch x := l.(type) {
+	case int64:
+		y, ok := r.(int64)
+		if !ok {
+			break
+		}
+		switch b.op {
+		case "<":
+			return x < y, nil
+		case "<=":
+			return x <= y, nil
+		case ">":
+			return x > y, nil
+		case ">=":
+			return x >= y, nil
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "*":
+			return x * y, nil
+		case "/", "%":
+			if y == 0 {
+				return nil, fmt.Errorf("division by zero")
+			}
+			if b.op == "/" {
+				return x / y, nil
+			}
+			return x % y, nil
+		}
+	case string:
+		y, ok := r.(string)
+		if !ok {
+			break
+		}
+		switch b.op {
+		case "<":
+			return x < y, nil
+		case "<=":
+			return x <= y, nil
+		case ">":
+			return x > y, nil
+		case ">=":
+			return x >= y, nil
+		case "+":
+			return x + y, nil
+		}
+	}
+
+	return nil, fmt.Errorf("cannot apply %s to %s and %s", b.op, exprType(l), exprType(r))
+}
+
+func exprEqual(l, r any) (bool, error) {
+	switch x := l.(type) {
+	case int64:
+		if y, ok := r.(int64); ok {
+			return x == y, nil
+		}
+	case string:
+		if y, ok := r.(string); ok {
+			return x == y, nil
+		}
+	case bool:
+		if y, ok := r.(bool); ok {
+			return x == y, nil
+		}
+	}
+	return false, fmt.Errorf("cannot compare %s and %s", exprType(l), exprType(r))
+}
+
+// exprContains reports whether a list holds the string or a string contains the substring
+func exprContains(haystack, needle any) (bool, error) {
+	s, ok := needle.(string)
+	if !ok {
+		return false, fmt.Errorf("cannot look for %s", exprType(needle))
+	}
+
+	switch h := haystack.(type) {
+	case []string:
+		return slices.Contains(h, s), nil
+	case string:
+		return strings.Contains(h, s), nil
+	}
+	return false, fmt.Errorf("cannot look into %s", exprType(haystack))
+}
+
+type exprCall struct {
+	name string
+	args []exprNode
+	re   *regexp.Regexp // compiled pattern of matches
+}
+
+func (c *exprCall) eval(env map[string]any) (any, error) {
+	args := make([]any, len(c.args))
+	for i, arg := range c.args {
+		v, err := arg.eval(env)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = v
+	}
+
+	switch c.name {
+	case "contains":
+		return exprContains(args[0], args[1])
+	case "len":
+		switch x := args[0].(type) {
+		case string:
+			return int64(len(x)), nil
+		case []string:
+			return int64(len(x)), nil
+		}
+	case "lower":
+		if s, ok := args[0].(string); ok {
+			return strings.ToLower(s), nil
+		}
+	case "matches":
+		if s, ok := args[0].(string); ok {
+			return c.re.MatchString(s), nil
+		}
+	case "hasPrefix", "hasSuffix":
+		s, ok1 := args[0].(string)
+		affix, ok2 := args[1].(string)
+		if ok1 && ok2 {
+			if c.name == "hasPrefix" {
+				return strings.HasPrefix(s, affix), nil
+			}
+			return strings.HasSuffix(s, affix), nil
+		}
+	}
+
+	types := make([]string, len(args))
+	for i, arg := range args {
+		types[i] = exprType(arg)
+	}
+	return nil, fmt.Errorf("cannot call %s with %s", c.name, strings.Join(types, ", "))
+}
+
+// exprType names the type of a value for error messages
+func exprType(v any) string {
+	switch v.(type) {
+	case int64:
+		return "integer"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case []string:
+		return "list"
+	}
+	return fmt.Sprintf("%T", v)
+}
@@ -0,0 +1,131 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+var exprTestVars = []string{"count", "size", "subject", "to", "authenticated", "helo"}
+
+func exprTestEnv() map[string]any {
+	return map[string]any{
+		"count":         int64(6),
+		"size":          int64(2048),
+		"subject":       "Invoice 42",
+		"to":            []string{"qa@example.com", "dev@example.com"},
+		"authenticated": false,
+	}
+}
+
+func TestEvalExpr(t *testing.T) {
+	for _, tc := range []struct {
+		src  string
+		want bool
+	}{
+		// Precedence: * over +, + over comparison, comparison over && over ||
+		{"1 + 2 * 3 == 7", true},
+		{"(1 + 2) * 3 == 9", true},
+		{"10 - 4 - 3 == 3", true},
+		{"8 / 2 / 2 == 2", true},
+		{"-count + 6 == 0", true},
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!authenticated && count % 3 == 0", true},
+		{"!(count > 5)", false},
+		{"count > 5 == true", true},
+		{"size >= 2048 && size <= 2048", true},
+
+		{`"qa@example.com" in to`, true},
+		{`"ops@example.com" in to`, false},
+		{`"voice" in subject`, true},
+		{`"x" + "y" in "axyb"`, true},
+
+		{`subject == "Invoice 42"`, true},
+		{`subject != 'Invoice 42'`, false},
+		{`"abc" < "abd"`, true},
+		{`subject + "!" == "Invoice 42!"`, true},
+		{`"say \"hi\"" == 'say "hi"'`, true},
+
+		{`contains(subject, "42")`, true},
+		{`contains(to, "dev@example.com")`, true},
+		{`hasPrefix(lower(subject), "invoice")`, true},
+		{`hasSuffix(subject, "43")`, false},
+		{`len(to) == 2 && len(subject) == 10`, true},
+		{`matches(subject, "(?i)^invoice \\d+$")`, true},
+		{`matches(subject, "receipt")`, false},
+
+		// The right side is not evaluated once the left decides
+		{"authenticated && helo == \"x\"", false},
+		{"!authenticated || helo == \"x\"", true},
+	} {
+		node, err := parseExpr(tc.src, exprTestVars)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		got, err := evalBool(node, exprTestEnv())
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("%s = %v, want %v", tc.src, got, tc.want)
+		}
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		{"sender == 1", `unknown variable "sender"`},
+		{"upper(subject) == \"X\"", `unknown function "upper"`},
+		{"len(subject, to) == 1", "len takes 1 arguments, got 2"},
+		{`matches(subject, "(")`, "matches pattern"},
+		{`matches(subject, subject)`, "matches needs a string literal pattern"},
+		{`matches(subject, 1)`, "matches needs a string literal pattern"},
+		{"count ==", "unexpected"},
+		{"(count == 1", `expected ")"`},
+		{"count == 1)", `unexpected ")"`},
+		{`subject == "open`, "unterminated string"},
+		{"count # 2", "unexpected character"},
+		{"99999999999999999999 > 1", "invalid number"},
+	} {
+		_, err := parseExpr(tc.src, exprTestVars)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.src, err, tc.err)
+		}
+	}
+}
+
+func TestEvalExprErrors(t *testing.T) {
+	for _, tc := range []struct {
+		src string
+		err string
+	}{
+		{"count / 0 == 1", "division by zero"},
+		{"count % (size - 2048) == 1", "division by zero"},
+		{`count == "6"`, "cannot compare integer and string"},
+		{`count < "7"`, "cannot apply < to integer and string"},
+		{`subject - "x" == ""`, "cannot apply - to string and string"},
+		{"count", "expression is integer, not a boolean"},
+		{"!count", "cannot apply ! to integer"},
+		{"-subject == 1", "cannot apply - to string"},
+		{"count && true", "cannot apply && to integer"},
+		{"1 in to", "cannot look for integer"},
+		{`"a" in count`, "cannot look into integer"},
+		{"lower(count) == \"6\"", "cannot call lower with integer"},
+		{"helo == \"x\"", "helo is not known at this stage"},
+	} {
+		node, err := parseExpr(tc.src, exprTestVars)
+		if err != nil {
+			t.Errorf("%s: %v", tc.src, err)
+			continue
+		}
+		_, err = evalBool(node, exprTestEnv())
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: error %v, want %q", tc.src, err, tc.err)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const (
+	extractorCommand = "command"
+	extractorTika    = "tika"
+
+	// extractedTextLimit caps the text kept per attachment
+	extractedTextLimit = 1 << 20
+)
+
+// defaultExtractTypes are the attachment types sent to the extractor when none are configured
+var defaultExtractTypes = []string{
+	"application/pdf",
+	"application/msword",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	"application/vnd.oasis.opendocument.text",
+	"application/rtf",
+}
+
+// TextExtractionConfig configures searchable text extraction from attachments
+type TextExtractionConfig struct {
+	Mode    string        `mapstructure:"mode"`     // "command" or "tika", empty disables extraction
+	Command []string      `mapstructure:"command"`  // program and args, attachment on stdin, text on stdout
+	TikaURL string        `mapstructure:"tika_url"` // Tika server base URL, e.g. http://127.0.0.1:9998
+	Timeout time.Duration `mapstructure:"timeout"`  // per attachment
+	MaxSize int64         `mapstructure:"max_size"` // larger attachments are skipped
+	Types   []string      `mapstructure:"types"`    // content types to extract
+}
+
+// initDefaults fills extraction defaults
+func (t *TextExtractionConfig) initDefaults() {
+	if t.Timeout == 0 {
+		t.Timeout = 10 * time.Second
+	}
+
+	if t.MaxSize == 0 {
+		t.MaxSize = 20 * 1024 * 1024
+	}
+
+	if len(t.Types) == 0 {
+		t.Types = defaultExtractTypes
+	}
+}
+
+// validate checks the selected extractor is usable
+func (t *TextExtractionConfig) validate() error {
+	const op = errors.Op("smtp_text_extraction_validate")
+
+	switch t.Mode {
+	case "":
+	case extractorCommand:
+		if len(t.Command) == 0 {
+			return errors.E(op, errors.Str("attachment_storage.text_extraction.command is required for mode 'command'"))
+		}
+	case extractorTika:
+		if t.TikaURL == "" {
+			return errors.E(op, errors.Str("attachment_storage.text_extraction.tika_url is required for mode 'tika'"))
+		}
+	default:
+		return errors.E(op, errors.Str("attachment_storage.text_extraction.mode must be 'command' or 'tika'"))
+	}
+
+	return nil
+}
+
+// textExtractor produces searchable text from an attachment
+type textExtractor interface {
+	extract(ctx context.Context, contentType string, content []byte) (string, error)
+}
+
+// newTextExtractor returns the configured extractor, nil when extraction is disabled
+func newTextExtractor(cfg *TextExtractionConfig) textExtractor {
+	switch cfg.Mode {
+	case extractorCommand:
+		return &commandExtractor{args: cfg.Command}
+	case extractorTika:
+		return &tikaExtractor{
+			url:    strings.TrimRight(cfg.TikaURL, "/") + "/tika",
+			client: &http.Client{},
+		}
+	default:
+		return nil
+	}
+}
+
+// commandExtractor pipes the attachment through an external program such as pdftotext
+type commandExtractor struct {
+	args []string
+}
+
+func (c *commandExtractor) extract(ctx context.Context, contentType string, content []byte) (string, error) {
+	const op = errors.Op("smtp_extract_command")
+
+	cmd := exec.CommandContext(ctx, c.args[0], c.args[1:]...) //nolint:gosec
+	cmd.Stdin = bytes.NewReader(content)
+	cmd.Env = append(cmd.Environ(), "SMTP_CONTENT_TYPE="+contentType)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return "", errors.E(op, errors.Errorf("%v: %s", err, strings.TrimSpace(stderr.String())))
+	}
+
+	return string(out), nil
+}
+
+// tikaExtractor sends the attachment to an Apache Tika server
+type tikaExtractor struct {
+	url    string
+	client *http.Client
+}
+
+func (t *tikaExtractor) extract(ctx context.Context, contentType string, content []byte) (string, error) {
+	const op = errors.Op("smtp_extract_tika")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, t.url, bytes.NewReader(content))
+	if err != nil {
+		return "", errors.E(op, err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("Accept", "text/plain")
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", errors.E(op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.E(op, errors.Errorf("tika returned %s", resp.Status))
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, extractedTextLimit))
+	if err != nil {
+		return "", errors.E(op, err)
+	}
+
+	return string(body), nil
+}
+
+// extractText runs the configured extractor when the attachment type qualifies
+func (p *Plugin) extractText(contentType string, content []byte) (string, error) {
+	cfg := &p.cfg.AttachmentStorage.TextExtraction
+	if p.extractor == nil || int64(len(content)) > cfg.MaxSize {
+		return "", nil
+	}
+
+	matched := false
+	for _, t := range cfg.Types {
+		if strings.EqualFold(t, contentType) {
+			matched = true
+			break
+		}
+	}
+	if !matched {
+		return "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+
+	text, err := p.extractor.extract(ctx, contentType, content)
+	if err != nil {
+		return "", err
+	}
+
+	text = strings.TrimSpace(text)
+	if len(text) > extractedTextLimit {
+		text = text[:extractedTextLimit]
+	}
+
+	return text, nil
+}
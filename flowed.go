@@ -0,0 +1,70 @@
+package smtp
+
+import "strings"
+
+// isFlowed reports whether text/plain parameters request RFC 3676 format=flowed.
+// The second result is true when delsp=yes.
+func isFlowed(params map[string]string) (bool, bool) {
+	if !strings.EqualFold(params["format"], "flowed") {
+		return false, false
+	}
+	return true, strings.EqualFold(params["delsp"], "yes")
+}
+
+// decodeFlowed joins soft-broken lines of a format=flowed text (RFC 3676)
+func decodeFlowed(text string, delsp bool) string {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	out := make([]string, 0, len(lines))
+
+	var (
+		paragraph strings.Builder
+		depth     int
+		open      bool
+	)
+
+	flush := func() {
+		if !open {
+			return
+		}
+		prefix := ""
+		if depth > 0 {
+			prefix = strings.Repeat(">", depth) + " "
+		}
+		out = append(out, prefix+paragraph.String())
+		paragraph.Reset()
+		open = false
+	}
+
+	for _, line := range lines {
+		lineDepth := 0
+		for lineDepth < len(line) && line[lineDepth] == '>' {
+			lineDepth++
+		}
+		line = line[lineDepth:]
+
+		// Space-stuffing protects lines starting with a space, ">" or "From "
+		line = strings.TrimPrefix(line, " ")
+
+		// A quote depth change always ends the paragraph
+		if open && lineDepth != depth {
+			flush()
+		}
+		depth = lineDepth
+
+		// The signature separator is never flowed
+		flowed := strings.HasSuffix(line, " ") && line != "-- "
+		if flowed && delsp {
+			line = line[:len(line)-1]
+		}
+
+		paragraph.WriteString(line)
+		open = true
+
+		if !flowed {
+			flush()
+		}
+	}
+	flush()
+
+	return strings.Join(out, "\n")
+}
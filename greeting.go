@@ -0,0 +1,139 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	earlyTalkerFlag     = "flag"
+	earlyTalkerTempfail = "tempfail"
+	earlyTalkerDrop     = "drop"
+)
+
+// anomalyEarlyTalker is recorded for clients that sent data before the banner
+const anomalyEarlyTalker = "early_talker"
+
+// greetingListener delays or rewrites the 220 banner of every accepted connection
+type greetingListener struct {
+	net.Listener
+	delay  time.Duration
+	banner []byte
+	// Called for early talkers closed instead of greeted, nil keeps them connected
+	drop func(conn net.Conn)
+}
+
+func (l *greetingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &greetingConn{Conn: conn, delay: l.delay, banner: l.banner, drop: l.drop}, nil
+}
+
+// greetingConn holds back the first write (the banner) for the configured delay,
+// records whether the client started talking before it and may replace its text
+type greetingConn struct {
+	net.Conn
+	delay  time.Duration
+	banner []byte // replacement 220 line, nil keeps go-smtp's banner
+	drop   func(conn net.Conn)
+
+	once        sync.Once
+	earlyTalker bool
+	pending     []byte // bytes received before the banner, served to the next Read
+	readErr     error  // non-timeout error seen while waiting
+}
+
+func (c *greetingConn) Write(b []byte) (int, error) {
+	first := false
+	c.once.Do(func() {
+		first = true
+		if c.delay > 0 {
+			c.waitGreeting()
+		}
+	})
+
+	// Like postscreen, early talkers never see the banner
+	if c.earlyTalker && c.drop != nil {
+		if first {
+			c.drop(c.Conn)
+			_ = c.Conn.Close()
+		}
+		return 0, net.ErrClosed
+	}
+
+	// go-smtp writes the banner as a single "220 ..." response
+	if first && c.banner != nil && bytes.HasPrefix(b, []byte("220 ")) {
+		if _, err := c.Conn.Write(c.banner); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	return c.Conn.Write(b)
+}
+
+func (c *greetingConn) Read(b []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+
+	return c.Conn.Read(b)
+}
+
+// waitGreeting listens for pre-greeting traffic until the delay elapses
+func (c *greetingConn) waitGreeting() {
+	deadline := time.Now().Add(c.delay)
+	_ = c.Conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 1024)
+	n, err := c.Conn.Read(buf)
+	if n > 0 {
+		c.earlyTalker = true
+		c.pending = buf[:n]
+	}
+
+	if ne, ok := err.(net.Error); err != nil && (!ok || !ne.Timeout()) {
+		c.readErr = err
+	}
+
+	_ = c.Conn.SetReadDeadline(time.Time{})
+
+	// Early data ends the read, the banner still waits for the full delay
+	time.Sleep(time.Until(deadline))
+}
+
+// isEarlyTalker reports whether the client behind conn sent data before the banner
+func isEarlyTalker(conn net.Conn) bool {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+
+	gc, ok := conn.(*greetingConn)
+	return ok && gc.earlyTalker
+}
+
+// listenerBanner returns the 220 line for the addr entry, nil keeps the default
+func (c *GreetingConfig) listenerBanner(addr string) []byte {
+	text := c.Banner
+	for _, lg := range c.Listeners {
+		if lg.Addr == addr {
+			text = lg.Banner
+		}
+	}
+
+	if text == "" {
+		return nil
+	}
+	return []byte("220 " + text + "\r\n")
+}
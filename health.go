@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"net"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// HAProxy agent-check states
+const (
+	agentUp    = "up"
+	agentDown  = "down"
+	agentMaint = "maint"
+)
+
+// HealthConfig configures the load balancer agent-check port
+type HealthConfig struct {
+	Addr string `mapstructure:"addr"` // agent-check listener, empty disables
+	// Active SMTP sessions at which the instance reports "down", 0 disables
+	OverloadConnections int `mapstructure:"overload_connections"`
+}
+
+// agentState reports the instance state in HAProxy agent-check terms
+func (p *Plugin) agentState() string {
+	if p.isStopped() {
+		return agentMaint
+	}
+
+	if limit := p.cfg.Health.OverloadConnections; limit > 0 && p.activeSessions() >= limit {
+		return agentDown
+	}
+
+	return agentUp
+}
+
+// activeSessions counts tracked SMTP sessions
+func (p *Plugin) activeSessions() int {
+	n := 0
+	p.connections.Range(func(_, _ any) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+// startHealthAgent serves one status line per connection on the agent-check port
+func (p *Plugin) startHealthAgent(errCh chan error) error {
+	const op = errors.Op("smtp_health_agent")
+
+	if p.cfg.Health.Addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", p.cfg.Health.Addr)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	p.healthListener = l
+
+	p.log.Info("health agent listening", zap.String("addr", p.cfg.Health.Addr))
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				if !p.isStopped() {
+					p.log.Error("health agent accept error", zap.Error(err))
+					errCh <- errors.E(op, err)
+				}
+				return
+			}
+
+			go func() {
+				_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+				_, _ = conn.Write([]byte(p.agentState() + "\n"))
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	return nil
+}
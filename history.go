@@ -0,0 +1,251 @@
+package smtp
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// historyMaxEntries bounds the in-memory history used by reports
+	historyMaxEntries = 10000
+	// defaultReportWindow is used when a report request has no window
+	defaultReportWindow = time.Hour
+)
+
+// historyEntry is a compact record of a delivered message
+type historyEntry struct {
+	at          time.Time
+	messageUUID string
+	sender      string
+	subject     string
+	messageID   string
+	bodyHash    string
+	attachments []attachmentEntry
+}
+
+// attachmentEntry identifies one attachment of a delivered message
+type attachmentEntry struct {
+	sha256   string
+	size     int64
+	filename string
+}
+
+// messageHistory keeps recent delivery records for duplicate reporting
+type messageHistory struct {
+	mu      sync.Mutex
+	entries []historyEntry
+}
+
+func newMessageHistory() *messageHistory {
+	return &messageHistory{
+		entries: make([]historyEntry, 0, 1024),
+	}
+}
+
+// record adds the delivered email to the history
+func (h *messageHistory) record(email *EmailData) {
+	entry := historyEntry{
+		// Record time rather than ReceivedAt keeps entries ordered under concurrency
+		at:          time.Now(),
+		messageUUID: email.MessageUUID,
+		subject:     email.Message.Subject,
+		bodyHash:    bodyHash(email),
+	}
+
+	for _, att := range email.Attachments {
+		entry.attachments = append(entry.attachments, attachmentEntry{
+			sha256:   att.SHA256,
+			size:     att.Size,
+			filename: att.Filename,
+		})
+	}
+
+	if len(email.Envelope.From) > 0 {
+		entry.sender = strings.ToLower(email.Envelope.From[0].Email)
+	}
+
+	if email.Message.Id != nil {
+		entry.messageID = strings.Trim(strings.TrimSpace(*email.Message.Id), "<>")
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.entries) == historyMaxEntries {
+		copy(h.entries, h.entries[1:])
+		h.entries = h.entries[:historyMaxEntries-1]
+	}
+	h.entries = append(h.entries, entry)
+}
+
+// since returns a copy of entries recorded after the cutoff
+func (h *messageHistory) since(cutoff time.Time) []historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	i := sort.Search(len(h.entries), func(i int) bool {
+		return h.entries[i].at.After(cutoff)
+	})
+
+	return append([]historyEntry(nil), h.entries[i:]...)
+}
+
+// bodyHash hashes the body with whitespace collapsed, so re-wrapped copies still match
+func bodyHash(email *EmailData) string {
+	body := email.Message.TextBody
+	if body == "" {
+		body = email.Message.HTMLBody
+	}
+
+	normalized := strings.Join(strings.Fields(body), " ")
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// DuplicateRequest selects the report window
+type DuplicateRequest struct {
+	// Window in milliseconds to look back, defaults to one hour
+	Window int64 `json:"window_ms"`
+}
+
+// DuplicateGroup is a set of messages from one sender sharing a Message-ID or body
+type DuplicateGroup struct {
+	Sender       string    `json:"sender"`
+	Reason       string    `json:"reason"` // "message_id" or "body"
+	Key          string    `json:"key"`    // the shared Message-ID or body hash
+	Subject      string    `json:"subject"`
+	Count        int       `json:"count"`
+	MessageUUIDs []string  `json:"message_uuids"`
+	FirstSeen    time.Time `json:"first_seen"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+// duplicates groups entries within the window which were sent more than once.
+// A message counted as a Message-ID duplicate is not reported again by body.
+func (h *messageHistory) duplicates(window time.Duration) []DuplicateGroup {
+	entries := h.since(time.Now().Add(-window))
+
+	type groupKey struct{ sender, reason, key string }
+	groups := make(map[groupKey]*DuplicateGroup)
+	order := make([]groupKey, 0)
+
+	add := func(k groupKey, e historyEntry) {
+		g, ok := groups[k]
+		if !ok {
+			g = &DuplicateGroup{
+				Sender:    k.sender,
+				Reason:    k.reason,
+				Key:       k.key,
+				Subject:   e.subject,
+				FirstSeen: e.at,
+			}
+			groups[k] = g
+			order = append(order, k)
+		}
+		g.Count++
+		g.MessageUUIDs = append(g.MessageUUIDs, e.messageUUID)
+		g.LastSeen = e.at
+	}
+
+	idCounts := make(map[groupKey]int)
+	for _, e := range entries {
+		if e.messageID != "" {
+			idCounts[groupKey{e.sender, "message_id", e.messageID}]++
+		}
+	}
+
+	for _, e := range entries {
+		idKey := groupKey{e.sender, "message_id", e.messageID}
+		if e.messageID != "" && idCounts[idKey] > 1 {
+			add(idKey, e)
+			continue
+		}
+		add(groupKey{e.sender, "body", e.bodyHash}, e)
+	}
+
+	result := make([]DuplicateGroup, 0)
+	for _, k := range order {
+		if g := groups[k]; g.Count > 1 {
+			result = append(result, *g)
+		}
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Sender != result[j].Sender {
+			return result[i].Sender < result[j].Sender
+		}
+		return result[i].Count > result[j].Count
+	})
+
+	return result
+}
+
+// defaultAttachmentReportLimit caps the report when the request has no limit
+const defaultAttachmentReportLimit = 20
+
+// AttachmentReportRequest selects the report window and size
+type AttachmentReportRequest struct {
+	// Window in milliseconds to look back, defaults to one hour
+	Window int64 `json:"window_ms"`
+	// Limit of hashes returned, defaults to 20
+	Limit int `json:"limit"`
+}
+
+// AttachmentHashCount is an attachment content and how often it was delivered
+type AttachmentHashCount struct {
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	Count     int       `json:"count"`
+	Filenames []string  `json:"filenames"` // distinct names the content was sent under
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// attachmentHashes counts attachment contents within the window, most common first
+func (h *messageHistory) attachmentHashes(window time.Duration, limit int) []AttachmentHashCount {
+	entries := h.since(time.Now().Add(-window))
+
+	counts := make(map[string]*AttachmentHashCount)
+	for _, e := range entries {
+		for _, att := range e.attachments {
+			c, ok := counts[att.sha256]
+			if !ok {
+				c = &AttachmentHashCount{
+					SHA256:    att.sha256,
+					Size:      att.size,
+					Filenames: make([]string, 0, 1),
+					FirstSeen: e.at,
+				}
+				counts[att.sha256] = c
+			}
+			c.Count++
+			c.LastSeen = e.at
+			if !slices.Contains(c.Filenames, att.filename) {
+				c.Filenames = append(c.Filenames, att.filename)
+			}
+		}
+	}
+
+	result := make([]AttachmentHashCount, 0, len(counts))
+	for _, c := range counts {
+		result = append(result, *c)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].SHA256 < result[j].SHA256
+	})
+
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	return result
+}
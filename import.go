@@ -0,0 +1,214 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// importRemoteAddr marks messages which did not arrive over SMTP
+const importRemoteAddr = "import"
+
+// ImportRequest describes a fixture file or a mail directory to import
+type ImportRequest struct {
+	// Path to an .eml file, an mbox file, or a directory of them. A Maildir
+	// (cur/ and new/) and MailHog's maildir storage (-maildir-path, one raw
+	// message per file) are imported whole, which eases moving from MailHog.
+	Path string `json:"path"`
+	// Deliver pushes parsed messages to Jobs, otherwise they are only parsed
+	Deliver bool `json:"deliver"`
+}
+
+// ImportResponse reports the outcome of an import
+type ImportResponse struct {
+	Imported     int      `json:"imported"`
+	Failed       int      `json:"failed"`
+	MessageUUIDs []string `json:"message_uuids"`
+}
+
+// importFile parses every message in the file or directory and optionally delivers it
+func (p *Plugin) importFile(req ImportRequest, resp *ImportResponse) error {
+	const op = errors.Op("smtp_import_file")
+
+	info, err := os.Stat(req.Path)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	files := []string{req.Path}
+	if info.IsDir() {
+		files, err = mailDirFiles(req.Path)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	session := p.importSession(req.Path)
+
+	resp.MessageUUIDs = make([]string, 0, len(files))
+
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			session.log.Warn("failed to read imported file", zap.String("file", file), zap.Error(err))
+			resp.Failed++
+			continue
+		}
+		session.importMessages(req, readMessages(file, data), resp)
+	}
+
+	session.log.Info("import completed",
+		zap.Int("files", len(files)),
+		zap.Int("imported", resp.Imported),
+		zap.Int("failed", resp.Failed),
+		zap.Bool("delivered", req.Deliver),
+	)
+
+	return nil
+}
+
+// importSession returns the session imported messages are parsed in, source names
+// where they come from in the log
+func (p *Plugin) importSession(source string) *Session {
+	id := p.newID()
+	return &Session{
+		backend:    &Backend{plugin: p, log: p.log},
+		uuid:       id,
+		remoteAddr: importRemoteAddr,
+		log: p.log.With(
+			zap.String("uuid", id),
+			zap.String("import", source),
+		),
+	}
+}
+
+// importMessages parses and optionally delivers the messages of one file
+func (s *Session) importMessages(req ImportRequest, messages [][]byte, resp *ImportResponse) {
+	p := s.backend.plugin
+
+	for i, raw := range messages {
+		parsed, err := s.parseEmail(raw)
+		if err != nil {
+			s.log.Warn("failed to parse imported message", zap.Int("index", i), zap.Error(err))
+			resp.Failed++
+			continue
+		}
+
+		// Fixtures have no envelope, recipients come from the headers
+		if len(parsed.AllRecipients) == 0 {
+			for _, addr := range append(parsed.Recipients, parsed.CCs...) {
+				parsed.AllRecipients = append(parsed.AllRecipients, addr.Email)
+			}
+		}
+
+		email := s.newEmailData(parsed)
+
+		if req.Deliver {
+			if err := p.deliver(email); err != nil {
+				s.log.Warn("failed to deliver imported message", zap.Int("index", i), zap.Error(err))
+				resp.Failed++
+				continue
+			}
+		}
+
+		resp.Imported++
+		resp.MessageUUIDs = append(resp.MessageUUIDs, email.MessageUUID)
+	}
+}
+
+// readMessages splits a file into raw messages, an mbox holds many
+func readMessages(path string, data []byte) [][]byte {
+	if isMbox(path, data) {
+		return splitMbox(data)
+	}
+	return [][]byte{data}
+}
+
+// mailDirFiles lists the message files of a directory in name order. A Maildir
+// contributes cur/ and new/, tmp/ holds unfinished deliveries and is skipped.
+// Any other directory, like MailHog's maildir storage, contributes its files.
+// Dot files such as .DS_Store and Dovecot's index files are skipped.
+func mailDirFiles(dir string) ([]string, error) {
+	dirs := []string{dir}
+	if isDir(filepath.Join(dir, "cur")) || isDir(filepath.Join(dir, "new")) {
+		dirs = []string{filepath.Join(dir, "cur"), filepath.Join(dir, "new")}
+	}
+
+	var files []string
+	for _, d := range dirs {
+		entries, err := os.ReadDir(d)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		for _, e := range entries {
+			if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || strings.HasPrefix(e.Name(), "dovecot") {
+				continue
+			}
+			files = append(files, filepath.Join(d, e.Name()))
+		}
+	}
+	return files, nil
+}
+
+func isDir(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// isMbox detects mbox files by extension or the leading "From " separator line
+func isMbox(path string, data []byte) bool {
+	if strings.EqualFold(filepath.Ext(path), ".mbox") {
+		return true
+	}
+	return bytes.HasPrefix(data, []byte("From "))
+}
+
+// splitMbox splits mboxrd/mboxo content into raw messages, unescaping ">From " lines
+func splitMbox(data []byte) [][]byte {
+	var (
+		messages [][]byte
+		current  bytes.Buffer
+		started  bool
+	)
+
+	flush := func() {
+		if started {
+			msg := bytes.TrimRight(current.Bytes(), "\r\n")
+			messages = append(messages, append([]byte(nil), msg...))
+		}
+		current.Reset()
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), len(data)+1)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		if bytes.HasPrefix(line, []byte("From ")) {
+			flush()
+			started = true
+			continue
+		}
+
+		// mboxrd escapes body lines starting with "From " by prefixing '>'
+		if unescaped := bytes.TrimLeft(line, ">"); len(unescaped) < len(line) && bytes.HasPrefix(unescaped, []byte("From ")) {
+			line = line[1:]
+		}
+
+		current.Write(line)
+		current.WriteString("\r\n")
+	}
+
+	flush()
+
+	return messages
+}
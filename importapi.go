@@ -0,0 +1,69 @@
+package smtp
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// importPath is the endpoint importing a posted .eml or mbox
+const importPath = "/import"
+
+// importBodyLimit caps a posted mbox, which can hold many messages
+const importBodyLimit = 256 << 20
+
+// handleImport runs the request body through the same import as the ImportFile RPC and
+// answers with the ImportResponse. The body is an mbox when it starts with a "From "
+// line, otherwise a single message. Query parameters:
+//
+//	deliver  "true" pushes parsed messages to Jobs, otherwise they are only parsed
+func (p *Plugin) handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.sendAPIAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var req ImportRequest
+	if v := r.URL.Query().Get("deliver"); v != "" {
+		deliver, err := strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "deliver must be true or false", http.StatusBadRequest)
+			return
+		}
+		req.Deliver = deliver
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, importBodyLimit))
+	if err != nil {
+		http.Error(w, "failed to read body: "+err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if len(data) == 0 {
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	session := p.importSession(sendRemoteAddr)
+
+	resp := ImportResponse{MessageUUIDs: make([]string, 0)}
+	session.importMessages(req, readMessages("", data), &resp)
+
+	session.log.Info("import completed",
+		zap.Int("bytes", len(data)),
+		zap.Int("imported", resp.Imported),
+		zap.Int("failed", resp.Failed),
+		zap.Bool("delivered", req.Deliver),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,60 @@
+package smtp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandleImport(t *testing.T) {
+	p, _ := startTestPlugin(t, func(c *Config) {
+		c.SendAPI.Token = "secret"
+	})
+
+	const message = "From: a@example.com\r\nTo: b@example.com\r\nSubject: one\r\n\r\nbody\r\n"
+	mbox := "From a@example.com Mon Jan  1 00:00:00 2024\r\n" + message +
+		"\r\nFrom a@example.com Mon Jan  1 00:00:01 2024\r\n" + strings.Replace(message, "one", "two", 1)
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		token    string
+		query    string
+		body     string
+		status   int
+		imported int
+	}{
+		{name: "eml", method: http.MethodPost, token: "secret", body: message, status: http.StatusOK, imported: 1},
+		{name: "mbox", method: http.MethodPost, token: "secret", body: mbox, status: http.StatusOK, imported: 2},
+		{name: "no token", method: http.MethodPost, body: message, status: http.StatusUnauthorized},
+		{name: "wrong token", method: http.MethodPost, token: "guess", body: message, status: http.StatusUnauthorized},
+		{name: "get", method: http.MethodGet, token: "secret", status: http.StatusMethodNotAllowed},
+		{name: "bad deliver", method: http.MethodPost, token: "secret", query: "?deliver=maybe", body: message, status: http.StatusBadRequest},
+		{name: "empty", method: http.MethodPost, token: "secret", status: http.StatusBadRequest},
+	} {
+		r := httptest.NewRequest(tc.method, importPath+tc.query, strings.NewReader(tc.body))
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		p.handleImport(w, r)
+
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d: %s", tc.name, w.Code, tc.status, w.Body)
+			continue
+		}
+		if tc.status != http.StatusOK {
+			continue
+		}
+
+		var resp ImportResponse
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if resp.Imported != tc.imported || resp.Failed != 0 || len(resp.MessageUUIDs) != tc.imported {
+			t.Errorf("%s: %+v, want %d imported", tc.name, resp, tc.imported)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"strings"
+)
+
+// InboxConfig is a logical inbox selected by the AUTH username suffix
+type InboxConfig struct {
+	// Jobs pipeline for the inbox's messages, empty keeps jobs.pipeline
+	Pipeline string `mapstructure:"pipeline"`
+}
+
+// inboxOf returns the inbox ID of a "<project>.<inbox>" username, Mailtrap style.
+// The project part may itself contain dots, the inbox is what follows the last one.
+func inboxOf(username string) string {
+	i := strings.LastIndexByte(username, '.')
+	if i <= 0 || i == len(username)-1 {
+		return ""
+	}
+	return username[i+1:]
+}
+
+// resolveInbox returns the configured inbox a username selects
+func (a *AuthConfig) resolveInbox(username string) (string, bool) {
+	inbox := inboxOf(username)
+	if inbox == "" {
+		return "", false
+	}
+	_, ok := a.Inboxes[inbox]
+	return inbox, ok
+}
+
+// inboxPipelines maps inbox IDs with their own pipeline to it
+func (a *AuthConfig) inboxPipelines() map[string]string {
+	pipelines := make(map[string]string)
+	for id, inbox := range a.Inboxes {
+		if inbox.Pipeline != "" {
+			pipelines[id] = inbox.Pipeline
+		}
+	}
+	return pipelines
+}
@@ -2,7 +2,7 @@ package smtp
 
 import (
 	"context"
-	"encoding/json"
+	"strconv"
 
 	"github.com/google/uuid"
 	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
@@ -112,20 +112,107 @@ func (j *Job) UpdatePriority(p int64) {
 }
 
 // emailToJobMessage converts EmailData to a jobs.Message for the Jobs plugin
-func emailToJobMessage(email *EmailData, cfg *JobsConfig) jobs.Message {
-	payload, _ := json.Marshal(email)
+func emailToJobMessage(email *EmailData, cfg *JobsConfig) (jobs.Message, error) {
+	// Job ID follows the message UUID so broker and consumer logs can be joined
+	jobID := email.MessageUUID
+	if jobID == "" {
+		jobID = uuid.NewString()
+	}
+
+	headers := map[string][]string{
+		"uuid":          {email.UUID},
+		"seq":           {strconv.FormatUint(email.Seq, 10)},
+		"message_uuid":  {jobID},
+		"payload_class": {"smtp:handler"},
+	}
+	if email.CorrelationID != "" {
+		headers["correlation_id"] = []string{email.CorrelationID}
+	}
+
+	// Envelope summary for broker-level routing without decoding the payload
+	if len(email.Envelope.From) > 0 {
+		headers["sender"] = []string{email.Envelope.From[0].Email}
+	}
+	if len(email.Envelope.AllRecipients) > 0 {
+		headers["recipients"] = append([]string(nil), email.Envelope.AllRecipients...)
+	}
+	if email.Inbox != "" {
+		headers["inbox"] = []string{email.Inbox}
+	}
+	headers["subject"] = []string{email.Message.Subject}
+	headers["size"] = []string{strconv.FormatInt(email.Message.Size, 10)}
+
+	pipeline := cfg.Pipeline
+	if inboxPipeline, ok := cfg.inboxPipelines[email.Inbox]; ok {
+		pipeline = inboxPipeline
+	}
+
+	payload, err := marshalPayload(cfg, pipeline, emailPayload(email, cfg), headers)
+	if err != nil {
+		return nil, err
+	}
+
+	payload = wrapCloudEvent(&cfg.CloudEvents, ceTypeEmailReceived, jobID, email.ReceivedAt, payload, headers)
+	job := newJob(jobID, payload, headers, cfg)
+	job.Options.Pipeline = pipeline
+	return job, nil
+}
+
+// closeEventToJobMessage converts ConnectionClosedEvent to a jobs.Message for the Jobs plugin
+func closeEventToJobMessage(event *ConnectionClosedEvent, id string, cfg *JobsConfig) (jobs.Message, error) {
+	headers := map[string][]string{
+		"uuid":          {event.UUID},
+		"payload_class": {"smtp:handler"},
+	}
 
-	// Generate a unique job ID
-	jobID := uuid.NewString()
+	payload, err := marshalPayload(cfg, cfg.Pipeline, event, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	payload = wrapCloudEvent(&cfg.CloudEvents, ceTypeConnectionClosed, id, event.ClosedAt, payload, headers)
+	return newJob(id, payload, headers, cfg), nil
+}
+
+// senderAnomalyToJobMessage converts SenderAnomalyEvent to a jobs.Message for the Jobs plugin
+func senderAnomalyToJobMessage(event *SenderAnomalyEvent, id string, cfg *JobsConfig) (jobs.Message, error) {
+	headers := map[string][]string{
+		"payload_class": {"smtp:handler"},
+	}
+
+	payload, err := marshalPayload(cfg, cfg.Pipeline, event, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	payload = wrapCloudEvent(&cfg.CloudEvents, ceTypeSenderAnomaly, id, event.DetectedAt, payload, headers)
+	return newJob(id, payload, headers, cfg), nil
+}
+
+// messageAbortedToJobMessage converts MessageAbortedEvent to a jobs.Message for the Jobs plugin
+func messageAbortedToJobMessage(event *MessageAbortedEvent, id string, cfg *JobsConfig) (jobs.Message, error) {
+	headers := map[string][]string{
+		"uuid":          {event.UUID},
+		"payload_class": {"smtp:handler"},
+	}
+
+	payload, err := marshalPayload(cfg, cfg.Pipeline, event, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	payload = wrapCloudEvent(&cfg.CloudEvents, ceTypeMessageAborted, id, event.AbortedAt, payload, headers)
+	return newJob(id, payload, headers, cfg), nil
+}
 
+// newJob wraps a payload into a Job using the configured pipeline options
+func newJob(id string, payload []byte, headers map[string][]string, cfg *JobsConfig) *Job {
+	setSchemaVersion(headers, cfg)
 	return &Job{
 		Job:   "smtp.email",
-		Ident: jobID,
+		Ident: id,
 		Pld:   payload,
-		Hdr: map[string][]string{
-			"uuid":          {email.UUID},
-			"payload_class": {"smtp:handler"},
-		},
+		Hdr:   headers,
 		Options: &JobOptions{
 			Pipeline: cfg.Pipeline,
 			Priority: cfg.Priority,
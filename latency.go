@@ -0,0 +1,98 @@
+package smtp
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Pipeline stages measured per message
+const (
+	stageRead    = "read"
+	stageParse   = "parse"
+	stageStorage = "storage"
+	stagePush    = "push"
+)
+
+// latencyWindow is the number of most recent samples kept per stage
+const latencyWindow = 1024
+
+// LatencySummary holds rolling percentiles of a stage in milliseconds
+type LatencySummary struct {
+	Count uint64  `json:"count"`
+	P50   float64 `json:"p50_ms"`
+	P95   float64 `json:"p95_ms"`
+	P99   float64 `json:"p99_ms"`
+}
+
+// latencyRing keeps the last latencyWindow samples of one stage
+type latencyRing struct {
+	samples []time.Duration
+	next    int
+	count   uint64
+}
+
+// latencyTracker records per-stage durations
+type latencyTracker struct {
+	mu     sync.Mutex
+	stages map[string]*latencyRing
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{
+		stages: make(map[string]*latencyRing),
+	}
+}
+
+// observe adds a sample for the stage
+func (t *latencyTracker) observe(stage string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r, ok := t.stages[stage]
+	if !ok {
+		r = &latencyRing{samples: make([]time.Duration, 0, latencyWindow)}
+		t.stages[stage] = r
+	}
+
+	if len(r.samples) < latencyWindow {
+		r.samples = append(r.samples, d)
+	} else {
+		r.samples[r.next] = d
+		r.next = (r.next + 1) % latencyWindow
+	}
+	r.count++
+}
+
+// summary computes percentiles over the retained samples of every stage
+func (t *latencyTracker) summary() map[string]LatencySummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]LatencySummary, len(t.stages))
+	for stage, r := range t.stages {
+		sorted := append([]time.Duration(nil), r.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		result[stage] = LatencySummary{
+			Count: r.count,
+			P50:   percentile(sorted, 0.50),
+			P95:   percentile(sorted, 0.95),
+			P99:   percentile(sorted, 0.99),
+		}
+	}
+
+	return result
+}
+
+// percentile returns the nearest-rank percentile of sorted samples in milliseconds
+func percentile(sorted []time.Duration, q float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	idx := int(q*float64(len(sorted))+0.5) - 1
+	idx = max(0, min(idx, len(sorted)-1))
+
+	return float64(sorted[idx]) / float64(time.Millisecond)
+}
@@ -0,0 +1,146 @@
+package smtp
+
+import (
+	"sync"
+
+	"github.com/emersion/go-smtp"
+	"github.com/roadrunner-server/errors"
+)
+
+// logValueMax caps how much of an oversized value is written to logs
+const logValueMax = 64
+
+// LimitsConfig caps command input, oversized values get 501 and are logged truncated
+type LimitsConfig struct {
+	MaxHeloLength     int `mapstructure:"max_helo_length"`     // HELO/EHLO domain
+	MaxArgumentLength int `mapstructure:"max_argument_length"` // MAIL FROM / RCPT TO path
+	MaxLineLength     int `mapstructure:"max_line_length"`     // any input line, longer ones close the connection
+
+	// Sessions open at once, further greetings get 421. 0 disables.
+	MaxConnections int `mapstructure:"max_connections"`
+	// Sessions one client IP may hold open, further greetings get 421. 0 disables.
+	MaxConnectionsPerIP int `mapstructure:"max_connections_per_ip"`
+
+	// Messages accepted per minute, excess MAIL FROM gets 451
+	MessagesPerMinute MessageRateConfig `mapstructure:"messages_per_minute"`
+
+	// Temporary IP bans after repeated protocol errors or failed AUTH
+	Ban BanConfig `mapstructure:"ban"`
+}
+
+// initDefaults fills limits from the RFC 5321 sizes, the line limit keeps go-smtp's default
+func (l *LimitsConfig) initDefaults() {
+	if l.MaxHeloLength == 0 {
+		l.MaxHeloLength = 255
+	}
+
+	if l.MaxArgumentLength == 0 {
+		l.MaxArgumentLength = 256
+	}
+
+	if l.MaxLineLength == 0 {
+		l.MaxLineLength = 2000
+	}
+
+	l.Ban.initDefaults()
+}
+
+// validate checks the limits are usable
+func (l *LimitsConfig) validate() error {
+	const op = errors.Op("smtp_limits_validate")
+
+	if l.MaxHeloLength < 0 || l.MaxArgumentLength < 0 || l.MaxLineLength < 0 || l.MaxConnections < 0 || l.MaxConnectionsPerIP < 0 {
+		return errors.E(op, errors.Str("limits cannot be negative"))
+	}
+
+	if l.MessagesPerMinute.PerIP < 0 || l.MessagesPerMinute.Global < 0 {
+		return errors.E(op, errors.Str("limits.messages_per_minute cannot be negative"))
+	}
+
+	// Message lines go through the same limit, RFC 5321 allows them up to 1000 octets
+	if l.MaxLineLength < 1000 {
+		return errors.E(op, errors.Str("limits.max_line_length cannot be below 1000"))
+	}
+
+	return l.Ban.validate()
+}
+
+// connLimiter counts open connections per key, e.g. the client IP. Connections are
+// tracked by their go-smtp Conn, which keeps its identity across STARTTLS and repeated EHLO.
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	conns map[string]map[*smtp.Conn]struct{}
+}
+
+func newConnLimiter(limit int) *connLimiter {
+	return &connLimiter{
+		max:   limit,
+		conns: make(map[string]map[*smtp.Conn]struct{}),
+	}
+}
+
+// acquire registers c under key, false when the key already holds the maximum
+func (l *connLimiter) acquire(key string, c *smtp.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	set := l.conns[key]
+	if _, ok := set[c]; ok {
+		return true
+	}
+	if len(set) >= l.max {
+		return false
+	}
+
+	if set == nil {
+		set = make(map[*smtp.Conn]struct{})
+		l.conns[key] = set
+	}
+	set[c] = struct{}{}
+	return true
+}
+
+// release forgets c once its connection is closed
+func (l *connLimiter) release(key string, c *smtp.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.conns[key], c)
+	if len(l.conns[key]) == 0 {
+		delete(l.conns, key)
+	}
+}
+
+// acquireConn takes a global and a per-IP slot for c, reporting the response for a refusal
+func (p *Plugin) acquireConn(ip string, c *smtp.Conn) (string, bool) {
+	if p.allConns != nil && !p.allConns.acquire("", c) {
+		return respTooBusy, false
+	}
+
+	// Unix socket clients have no IP and are only subject to the global cap
+	if p.perIPConns != nil && ip != "" && !p.perIPConns.acquire(ip, c) {
+		p.releaseConn(ip, c, false)
+		return respTooManyConns, false
+	}
+
+	return "", true
+}
+
+// releaseConn frees the slots taken by acquireConn, perIP is false when only the global one was taken
+func (p *Plugin) releaseConn(ip string, c *smtp.Conn, perIP bool) {
+	if p.allConns != nil {
+		p.allConns.release("", c)
+	}
+	if perIP && p.perIPConns != nil && ip != "" {
+		p.perIPConns.release(ip, c)
+	}
+}
+
+// truncateForLog shortens a value for logging
+func truncateForLog(v string) string {
+	if len(v) <= logValueMax {
+		return v
+	}
+	return v[:logValueMax] + "..."
+}
@@ -0,0 +1,231 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// listenMaxRetries is how many times a failed listener is re-created before giving up
+	listenMaxRetries = 5
+	// listenInitialBackoff is the delay before the first restart attempt
+	listenInitialBackoff = 100 * time.Millisecond
+	// listenMaxBackoff caps the delay between restart attempts
+	listenMaxBackoff = 5 * time.Second
+	// listenStableAfter resets the retry budget once a listener served this long
+	listenStableAfter = 1 * time.Minute
+)
+
+// smtpListener is one address the SMTP server accepts connections on
+type smtpListener struct {
+	addr        string
+	implicitTLS bool         // SMTPS: TLS handshake before the banner
+	l           net.Listener // current listener, replaced on restart
+	bound       *net.TCPAddr // address the current listener is bound to
+}
+
+// unixScheme prefixes addr entries which listen on a unix domain socket
+const unixScheme = "unix://"
+
+// listenNetwork splits a configured address into network and address, e.g.
+// "unix:///var/run/smtp.sock" is ("unix", "/var/run/smtp.sock")
+func listenNetwork(addr string) (string, string) {
+	if path, ok := strings.CutPrefix(addr, unixScheme); ok {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// listen opens the listener for sl. Caller must hold p.mu.
+func (p *Plugin) listen(sl *smtpListener) error {
+	network, address := listenNetwork(sl.addr)
+	if network == "unix" {
+		if err := removeStaleSocket(address); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	sl.bound, _ = l.Addr().(*net.TCPAddr)
+
+	// Innermost, it only tells when a session waits for the client
+	l = &idleListener{Listener: l}
+
+	if p.bans != nil && p.cfg.Limits.Ban.Action != banTarpit {
+		l = &banListener{Listener: l, p: p, drop: sl.implicitTLS || p.cfg.Limits.Ban.Action == banDrop}
+	}
+
+	// Under the greeting layer so that the banner is recorded as it goes out
+	if p.cfg.Transcript.Enabled && !sl.implicitTLS {
+		l = &transcriptListener{Listener: l, maxBytes: p.cfg.Transcript.MaxBytes}
+	}
+
+	if sl.implicitTLS {
+		// The greeting delay is not applied: the client speaks first with its ClientHello
+		sl.l = tls.NewListener(l, p.smtpServer.TLSConfig)
+	} else {
+		sl.l = p.wrapListener(sl, l)
+	}
+
+	return nil
+}
+
+// serveListener runs the SMTP server on the listener. When the listener fails at
+// runtime it is re-created with exponential backoff; once retries are exhausted
+// the error is reported to RoadRunner through errCh.
+func (p *Plugin) serveListener(sl *smtpListener, errCh chan error) {
+	const op = errors.Op("smtp_serve_listener")
+
+	attempts := 0
+	backoff := listenInitialBackoff
+	l := sl.l
+
+	for {
+		started := time.Now()
+		err := p.smtpServer.Serve(l)
+		if err == nil || p.isStopped() {
+			return
+		}
+
+		p.log.Error("SMTP listener failed", zap.String("addr", sl.addr), zap.Error(err))
+
+		if time.Since(started) > listenStableAfter {
+			attempts = 0
+			backoff = listenInitialBackoff
+		}
+
+		for {
+			attempts++
+			if attempts > listenMaxRetries {
+				errCh <- errors.E(op, err)
+				return
+			}
+
+			time.Sleep(backoff)
+			backoff = min(backoff*2, listenMaxBackoff)
+
+			var stopped bool
+			l, stopped, err = p.relisten(sl)
+			if stopped {
+				return
+			}
+			if err == nil {
+				break
+			}
+
+			p.log.Warn("SMTP listener restart failed",
+				zap.String("addr", sl.addr),
+				zap.Int("attempt", attempts),
+				zap.Error(err),
+			)
+		}
+
+		p.log.Info("SMTP listener restarted", zap.String("addr", sl.addr), zap.Int("attempt", attempts))
+	}
+}
+
+// relisten re-creates the listener unless the plugin is stopping
+func (p *Plugin) relisten(sl *smtpListener) (net.Listener, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped.Load() {
+		return nil, true, nil
+	}
+
+	if err := p.listen(sl); err != nil {
+		return nil, false, err
+	}
+
+	return sl.l, false, nil
+}
+
+// removeStaleSocket deletes a socket file left behind by a previous run.
+// A socket somebody still accepts on is reported as in use.
+func removeStaleSocket(path string) error {
+	const op = errors.Op("smtp_remove_stale_socket")
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return errors.E(op, err)
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.E(op, errors.Errorf("%s exists and is not a socket", path))
+	}
+
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		_ = conn.Close()
+		return errors.E(op, errors.Errorf("socket %s is in use", path))
+	}
+
+	return os.Remove(path)
+}
+
+// listenerName returns the configured address of the listener a connection arrived on
+func (p *Plugin) listenerName(local net.Addr) string {
+	if ua, ok := local.(*net.UnixAddr); ok {
+		return unixScheme + ua.Name
+	}
+
+	la, ok := local.(*net.TCPAddr)
+	if !ok {
+		return local.String()
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, sl := range p.listeners {
+		if sl.bound == nil || sl.bound.Port != la.Port {
+			continue
+		}
+		// Wildcard listeners accept on any local IP
+		if sl.bound.IP.IsUnspecified() || sl.bound.IP.Equal(la.IP) {
+			return sl.addr
+		}
+	}
+
+	return local.String()
+}
+
+// wrapListener applies connection-level behaviour such as the greeting delay and banner
+func (p *Plugin) wrapListener(sl *smtpListener, l net.Listener) net.Listener {
+	banner := p.cfg.Greeting.listenerBanner(sl.addr)
+	if p.cfg.Greeting.Delay > 0 || banner != nil {
+		gl := &greetingListener{Listener: l, delay: p.cfg.Greeting.Delay, banner: banner}
+		if p.cfg.Greeting.EarlyTalker == earlyTalkerDrop {
+			gl.drop = p.dropEarlyTalker
+		}
+		l = gl
+	}
+	return l
+}
+
+// dropEarlyTalker records a client closed for talking before the banner
+func (p *Plugin) dropEarlyTalker(conn net.Conn) {
+	p.stats.earlyTalkers.Add(1)
+	p.log.Warn("client sent data before greeting, connection dropped",
+		zap.String("remote_addr", remoteAddrOf(conn)),
+	)
+	if p.bans != nil {
+		p.bans.strike(remoteIP(conn), respEarlyTalker)
+	}
+}
+
+// isStopped reports whether Stop was called
+func (p *Plugin) isStopped() bool {
+	return p.stopped.Load()
+}
@@ -0,0 +1,38 @@
+package smtp
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MetricsCollector implements the RoadRunner metrics plugin's StatProvider
+func (p *Plugin) MetricsCollector() []prometheus.Collector {
+	return []prometheus.Collector{newCertExpiryCollector(p)}
+}
+
+// certExpiryCollector reports the days left on the served TLS certificate, nothing
+// while TLS is off. The certificate is only known once the plugin serves.
+type certExpiryCollector struct {
+	p    *Plugin
+	desc *prometheus.Desc
+}
+
+func newCertExpiryCollector(p *Plugin) *certExpiryCollector {
+	return &certExpiryCollector{
+		p: p,
+		desc: prometheus.NewDesc(
+			prometheus.BuildFQName("rr", "smtp", "tls_certificate_days_until_expiry"),
+			"Days until the served TLS certificate expires, negative once it has.",
+			nil, nil,
+		),
+	}
+}
+
+func (c *certExpiryCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *certExpiryCollector) Collect(ch chan<- prometheus.Metric) {
+	if info, ok := c.p.certificateInfo(); ok {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(info.DaysUntilExpiry))
+	}
+}
@@ -0,0 +1,26 @@
+package smtp
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCertExpiryCollector(t *testing.T) {
+	p := &Plugin{}
+	collector := newCertExpiryCollector(p)
+	if n := testutil.CollectAndCount(collector); n != 0 {
+		t.Fatalf("%d metrics without a certificate", n)
+	}
+
+	cert, err := generateSelfSigned("mx.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.selfSigned = cert
+
+	info, _ := p.certificateInfo()
+	if got := testutil.ToFloat64(collector); got != float64(info.DaysUntilExpiry) || got <= 0 {
+		t.Errorf("days until expiry %v, want %d", got, info.DaysUntilExpiry)
+	}
+}
@@ -0,0 +1,215 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/textproto"
+	"strings"
+)
+
+// Lint rules
+const (
+	lintLineTooLong     = "line_too_long"        // a line over the 998 octets of RFC 5322
+	lintBareLF          = "bare_lf"              // a line ending without CR
+	lintBareCR          = "bare_cr"              // a CR not followed by LF
+	lintMissingHeader   = "missing_header"       // From, Date, Message-ID, or MIME-Version of a MIME message
+	lintDuplicateHeader = "duplicate_header"     // a header RFC 5322 allows once, seen more often
+	lintContentType     = "invalid_content_type" // a Content-Type or part header that does not parse
+	lintMissingBoundary = "missing_boundary"     // multipart without a boundary parameter
+	lintBoundaryLength  = "boundary_too_long"    // over the 70 characters of RFC 2046
+	lintBoundaryMissing = "boundary_not_found"   // no part delimiter in the body
+	lintUnclosed        = "unclosed_multipart"   // no closing "--boundary--" delimiter
+)
+
+const (
+	// maxLineOctets is the RFC 5322 line limit without CRLF
+	maxLineOctets = 998
+	// maxLintDepth bounds multipart nesting followed by the linter
+	maxLintDepth = 10
+)
+
+// onceHeaders may appear at most once in a message (RFC 5322 section 3.6)
+var onceHeaders = []string{
+	"Date", "From", "Sender", "Reply-To", "To", "Cc", "Bcc",
+	"Message-ID", "In-Reply-To", "References", "Subject",
+}
+
+// LintFinding is a structural fault real MTAs may refuse a message for
+type LintFinding struct {
+	Rule   string `json:"rule"`
+	Detail string `json:"detail,omitempty"`
+	Part   string `json:"part,omitempty"` // MIME part path like "1.2", empty for the top level
+}
+
+// lintMessage checks line endings and lengths, required headers and multipart structure
+func lintMessage(raw []byte) []LintFinding {
+	findings := lintLines(raw)
+
+	header, body, err := splitHeader(raw)
+	if err != nil {
+		return append(findings, LintFinding{Rule: lintMissingHeader, Detail: "unreadable header: " + err.Error()})
+	}
+
+	for _, name := range []string{"From", "Date", "Message-ID"} {
+		if len(header.Values(name)) == 0 {
+			findings = append(findings, LintFinding{Rule: lintMissingHeader, Detail: name})
+		}
+	}
+	if len(header.Values("MIME-Version")) == 0 &&
+		(len(header.Values("Content-Type")) > 0 || len(header.Values("Content-Transfer-Encoding")) > 0) {
+		findings = append(findings, LintFinding{Rule: lintMissingHeader, Detail: "MIME-Version"})
+	}
+	for _, name := range onceHeaders {
+		if n := len(header.Values(name)); n > 1 {
+			findings = append(findings, LintFinding{Rule: lintDuplicateHeader, Detail: fmt.Sprintf("%s appears %d times", name, n)})
+		}
+	}
+
+	return lintPart(findings, header, body, "", 0)
+}
+
+// lintLines reports lines over the length limit and stray CR or LF, once per rule
+func lintLines(raw []byte) []LintFinding {
+	var long, bareLF, bareCR, firstLong, firstLF, firstCR int
+
+	for n, line := 1, raw; len(line) > 0; n++ {
+		end := bytes.IndexByte(line, '\n')
+		next := []byte(nil)
+		if end >= 0 {
+			line, next = line[:end], line[end+1:]
+			if !bytes.HasSuffix(line, []byte("\r")) {
+				bareLF++
+				firstLF = firstLine(firstLF, n)
+			}
+		}
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if bytes.IndexByte(line, '\r') >= 0 {
+			bareCR++
+			firstCR = firstLine(firstCR, n)
+		}
+		if len(line) > maxLineOctets {
+			long++
+			firstLong = firstLine(firstLong, n)
+		}
+		line = next
+	}
+
+	var findings []LintFinding
+	if long > 0 {
+		findings = append(findings, LintFinding{Rule: lintLineTooLong, Detail: fmt.Sprintf("%d lines over %d octets, first at line %d", long, maxLineOctets, firstLong)})
+	}
+	if bareLF > 0 {
+		findings = append(findings, LintFinding{Rule: lintBareLF, Detail: fmt.Sprintf("%d lines, first at line %d", bareLF, firstLF)})
+	}
+	if bareCR > 0 {
+		findings = append(findings, LintFinding{Rule: lintBareCR, Detail: fmt.Sprintf("%d lines, first at line %d", bareCR, firstCR)})
+	}
+	return findings
+}
+
+func firstLine(first, n int) int {
+	if first == 0 {
+		return n
+	}
+	return first
+}
+
+// splitHeader reads the header block of an entity and returns the body after it
+func splitHeader(raw []byte) (textproto.MIMEHeader, []byte, error) {
+	r := bufio.NewReader(bytes.NewReader(raw))
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+	body, _ := io.ReadAll(r)
+	return header, body, nil
+}
+
+// lintPart checks the multipart structure of an entity and its parts
+func lintPart(findings []LintFinding, header textproto.MIMEHeader, body []byte, path string, depth int) []LintFinding {
+	contentType := header.Get("Content-Type")
+	if contentType == "" || depth > maxLintDepth {
+		return findings
+	}
+
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return append(findings, LintFinding{Rule: lintContentType, Detail: err.Error(), Part: path})
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return findings
+	}
+
+	boundary := params["boundary"]
+	switch {
+	case boundary == "":
+		return append(findings, LintFinding{Rule: lintMissingBoundary, Detail: mediaType, Part: path})
+	case len(boundary) > 70:
+		findings = append(findings, LintFinding{Rule: lintBoundaryLength, Detail: fmt.Sprintf("%d characters", len(boundary)), Part: path})
+	}
+
+	parts, closed := splitParts(body, boundary)
+	if parts == nil {
+		return append(findings, LintFinding{Rule: lintBoundaryMissing, Detail: boundary, Part: path})
+	}
+	if !closed {
+		findings = append(findings, LintFinding{Rule: lintUnclosed, Detail: boundary, Part: path})
+	}
+
+	for i, part := range parts {
+		partPath := fmt.Sprint(i + 1)
+		if path != "" {
+			partPath = path + "." + partPath
+		}
+
+		partHeader, partBody, err := splitHeader(part)
+		if err != nil {
+			findings = append(findings, LintFinding{Rule: lintContentType, Detail: "unreadable part header: " + err.Error(), Part: partPath})
+			continue
+		}
+		findings = lintPart(findings, partHeader, partBody, partPath, depth+1)
+	}
+	return findings
+}
+
+// splitParts cuts a multipart body at its delimiter lines. It returns nil parts when
+// no delimiter is found, and whether the closing delimiter was.
+func splitParts(body []byte, boundary string) ([][]byte, bool) {
+	delimiter := "--" + boundary
+
+	var parts [][]byte
+	start := -1
+	for offset := 0; offset < len(body); {
+		end := bytes.IndexByte(body[offset:], '\n')
+		next := len(body)
+		if end >= 0 {
+			next = offset + end + 1
+		}
+		line := strings.TrimRight(string(body[offset:next]), " \t\r\n")
+
+		switch line {
+		case delimiter + "--":
+			if start >= 0 {
+				parts = append(parts, body[start:offset])
+			}
+			return parts, true
+		case delimiter:
+			if start >= 0 {
+				parts = append(parts, body[start:offset])
+			} else {
+				parts = [][]byte{}
+			}
+			start = next
+		}
+		offset = next
+	}
+
+	if start >= 0 {
+		parts = append(parts, body[start:])
+	}
+	return parts, false
+}
@@ -0,0 +1,540 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// nestedSourceMsg marks nested messages parsed from Outlook .msg attachments
+const nestedSourceMsg = "msg"
+
+// cfbSignature starts every OLE compound file
+var cfbSignature = []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}
+
+const (
+	cfbEndOfChain = 0xFFFFFFFE
+	cfbNoStream   = 0xFFFFFFFF
+	cfbDirSize    = 128
+
+	cfbTypeStorage = 1
+	cfbTypeStream  = 2
+	cfbTypeRoot    = 5
+
+	// msgMaxStream caps a single property stream, bodies larger than this are dropped
+	msgMaxStream = 8 << 20
+)
+
+// MAPI property ids read from .msg files
+const (
+	mapiSubject       = 0x0037
+	mapiSenderName    = 0x0C1A
+	mapiSenderEmail   = 0x0C1F
+	mapiSenderSMTP    = 0x5D01
+	mapiBody          = 0x1000
+	mapiBodyHTML      = 0x1013
+	mapiRecipientType = 0x0C15
+	mapiDisplayName   = 0x3001
+	mapiEmailAddress  = 0x3003
+	mapiSMTPAddress   = 0x39FE
+	mapiAttachName    = 0x3707
+	mapiAttachObject  = 0x3701
+)
+
+// MAPI property types
+const (
+	mapiTypeString8 = 0x001E
+	mapiTypeUnicode = 0x001F
+	mapiTypeBinary  = 0x0102
+	mapiTypeObject  = 0x000D
+)
+
+// MAPI recipient types
+const (
+	mapiRecipientTo = 1
+	mapiRecipientCc = 2
+)
+
+// isOutlookMsg reports whether an attachment is an Outlook message container
+func isOutlookMsg(filename, contentType string, content []byte) bool {
+	if !bytes.HasPrefix(content, cfbSignature) {
+		return false
+	}
+
+	return strings.EqualFold(contentType, "application/vnd.ms-outlook") ||
+		strings.HasSuffix(strings.ToLower(filename), ".msg")
+}
+
+// cfbEntry is a directory entry of a compound file
+type cfbEntry struct {
+	name        string
+	typ         byte
+	left, right uint32
+	child       uint32
+	start       uint32
+	size        uint64
+}
+
+// cfbFile is a read-only view of an OLE compound file
+type cfbFile struct {
+	data       []byte
+	sectorSize int
+	miniSize   int
+	miniCutoff uint64
+	fat        []uint32
+	miniFAT    []uint32
+	miniStream []byte
+	entries    []cfbEntry
+	budget     *nestedBudget
+}
+
+// parseCFB reads the header, allocation tables and directory of a compound file.
+// Every sector chain read, the directory and mini stream included, is charged to budget.
+func parseCFB(data []byte, budget *nestedBudget) (*cfbFile, error) {
+	const op = errors.Op("smtp_parse_cfb")
+
+	if len(data) < 512 || !bytes.HasPrefix(data, cfbSignature) {
+		return nil, errors.E(op, errors.Str("not an OLE compound file"))
+	}
+
+	le := binary.LittleEndian
+	shift := le.Uint16(data[0x1E:])
+	miniShift := le.Uint16(data[0x20:])
+	if shift != 9 && shift != 12 || miniShift != 6 {
+		return nil, errors.E(op, errors.Errorf("unsupported sector shift %d/%d", shift, miniShift))
+	}
+
+	f := &cfbFile{
+		data:       data,
+		sectorSize: 1 << shift,
+		miniSize:   1 << miniShift,
+		miniCutoff: uint64(le.Uint32(data[0x38:])),
+		budget:     budget,
+	}
+
+	// The first 109 FAT sectors are listed in the header, the rest in DIFAT sectors.
+	// Every sector id is checked against the file, so a forged header cannot list more
+	// FAT sectors than the file holds.
+	sectors := f.sectorCount()
+	fatSectors := make([]uint32, 0, 109)
+	listed := make(map[uint32]bool)
+	addFAT := func(s uint32) error {
+		if s >= cfbEndOfChain {
+			return nil
+		}
+		if int(s) >= sectors {
+			return errors.Str("FAT sector out of range")
+		}
+		if listed[s] {
+			return errors.Str("FAT sector listed twice")
+		}
+		listed[s] = true
+		fatSectors = append(fatSectors, s)
+		return nil
+	}
+	for i := 0; i < 109; i++ {
+		if err := addFAT(le.Uint32(data[0x4C+i*4:])); err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+
+	// The DIFAT sector count comes from the header, the chain is bounded by the file instead
+	difat := le.Uint32(data[0x44:])
+	perSector := f.sectorSize/4 - 1
+	visited := make(map[uint32]bool)
+	for n := le.Uint32(data[0x48:]); n > 0 && difat < cfbEndOfChain; n-- {
+		if visited[difat] || len(visited) >= sectors {
+			return nil, errors.E(op, errors.Str("broken DIFAT chain"))
+		}
+		visited[difat] = true
+
+		sec, ok := f.sector(difat)
+		if !ok {
+			return nil, errors.E(op, errors.Str("DIFAT sector out of range"))
+		}
+		for i := 0; i < perSector; i++ {
+			if err := addFAT(le.Uint32(sec[i*4:])); err != nil {
+				return nil, errors.E(op, err)
+			}
+		}
+		difat = le.Uint32(sec[perSector*4:])
+	}
+
+	for _, s := range fatSectors {
+		sec, ok := f.sector(s)
+		if !ok {
+			return nil, errors.E(op, errors.Str("FAT sector out of range"))
+		}
+		for i := 0; i < f.sectorSize; i += 4 {
+			f.fat = append(f.fat, le.Uint32(sec[i:]))
+		}
+	}
+
+	// Directory sectors past the entry limit are not read, links to the entries
+	// they hold are ignored like broken ones
+	limit := budget.limits.MaxEntries
+	err := f.walk(le.Uint32(data[0x30:]), func(sec []byte) bool {
+		for off := 0; off+cfbDirSize <= len(sec); off += cfbDirSize {
+			if len(f.entries) >= limit {
+				budget.flag(anomalyNestedEntries)
+				return false
+			}
+			f.entries = append(f.entries, parseCFBEntry(sec[off:off+cfbDirSize]))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+	if len(f.entries) == 0 || f.entries[0].typ != cfbTypeRoot {
+		return nil, errors.E(op, errors.Str("missing root entry"))
+	}
+
+	if miniFAT := le.Uint32(data[0x3C:]); miniFAT < cfbEndOfChain {
+		raw, err := f.chain(miniFAT, 0)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+		for i := 0; i+4 <= len(raw); i += 4 {
+			f.miniFAT = append(f.miniFAT, le.Uint32(raw[i:]))
+		}
+	}
+
+	// The root entry owns the mini stream holding all small streams
+	root := f.entries[0]
+	if root.start < cfbEndOfChain {
+		f.miniStream, err = f.chain(root.start, root.size)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+
+	return f, nil
+}
+
+func parseCFBEntry(b []byte) cfbEntry {
+	le := binary.LittleEndian
+
+	nameLen := int(le.Uint16(b[64:]))
+	if nameLen > 64 {
+		nameLen = 64
+	}
+	units := make([]uint16, 0, nameLen/2)
+	for i := 0; i+1 < nameLen; i += 2 {
+		if u := le.Uint16(b[i:]); u != 0 {
+			units = append(units, u)
+		}
+	}
+
+	return cfbEntry{
+		name:  string(utf16.Decode(units)),
+		typ:   b[66],
+		left:  le.Uint32(b[68:]),
+		right: le.Uint32(b[72:]),
+		child: le.Uint32(b[76:]),
+		start: le.Uint32(b[116:]),
+		// Version 3 files may leave garbage in the high half
+		size: uint64(le.Uint32(b[120:])),
+	}
+}
+
+// sectorCount returns the number of regular sectors in the file, the header takes the first slot
+func (f *cfbFile) sectorCount() int {
+	return len(f.data)/f.sectorSize - 1
+}
+
+// sector returns the content of a regular sector
+func (f *cfbFile) sector(n uint32) ([]byte, bool) {
+	off := (int(n) + 1) * f.sectorSize
+	if n >= cfbEndOfChain || off+f.sectorSize > len(f.data) {
+		return nil, false
+	}
+	return f.data[off : off+f.sectorSize], true
+}
+
+// walk visits the sectors of a FAT chain in order until fn returns false. Every sector
+// is charged to the budget, a chain visiting a sector twice is broken, which also keeps
+// it within the sectors of the file.
+func (f *cfbFile) walk(start uint32, fn func(sec []byte) bool) error {
+	visited := make([]bool, f.sectorCount())
+	for s := start; s != cfbEndOfChain; s = f.fat[s] {
+		if int(s) >= len(f.fat) || int(s) >= len(visited) || visited[s] {
+			return errors.Str("broken sector chain")
+		}
+		visited[s] = true
+
+		sec, ok := f.sector(s)
+		if !ok {
+			return errors.Str("sector out of range")
+		}
+		if !f.budget.take(int64(len(sec))) {
+			return errors.Str("sector chain exceeds the nested size limit")
+		}
+		if !fn(sec) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// chain concatenates a FAT sector chain, truncated to size when it is not zero
+func (f *cfbFile) chain(start uint32, size uint64) ([]byte, error) {
+	var out []byte
+	err := f.walk(start, func(sec []byte) bool {
+		out = append(out, sec...)
+		return size == 0 || uint64(len(out)) < size
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if size > 0 && uint64(len(out)) > size {
+		out = out[:size]
+	}
+	return out, nil
+}
+
+// miniChain concatenates a mini FAT chain from the mini stream, charging every mini sector
+// to the budget
+func (f *cfbFile) miniChain(start uint32, size uint64) ([]byte, error) {
+	out := make([]byte, 0, min(size, uint64(len(f.miniStream))))
+	visited := make([]bool, len(f.miniFAT))
+	for s := start; s != cfbEndOfChain && uint64(len(out)) < size; s = f.miniFAT[s] {
+		off := int(s) * f.miniSize
+		if int(s) >= len(f.miniFAT) || visited[s] || off+f.miniSize > len(f.miniStream) {
+			return nil, errors.Str("broken mini sector chain")
+		}
+		visited[s] = true
+
+		if !f.budget.take(int64(f.miniSize)) {
+			return nil, errors.Str("mini sector chain exceeds the nested size limit")
+		}
+		out = append(out, f.miniStream[off:off+f.miniSize]...)
+	}
+
+	if uint64(len(out)) > size {
+		out = out[:size]
+	}
+	return out, nil
+}
+
+// stream returns the content of a stream entry
+func (f *cfbFile) stream(e cfbEntry) ([]byte, error) {
+	if e.size == 0 {
+		return nil, nil
+	}
+	if e.size > msgMaxStream {
+		return nil, errors.Errorf("stream %q is too large", e.name)
+	}
+
+	// The chains charge what they read to the budget
+	read := f.chain
+	if e.size < f.miniCutoff {
+		read = f.miniChain
+	}
+	b, err := read(e.start, e.size)
+	if err != nil {
+		return nil, errors.Errorf("stream %q: %v", e.name, err)
+	}
+	return b, nil
+}
+
+// children returns the ids of the entries stored directly in a storage, keyed by name
+func (f *cfbFile) children(id uint32) map[string]uint32 {
+	out := make(map[string]uint32)
+	if int(id) >= len(f.entries) {
+		return out
+	}
+
+	// Siblings form a red-black tree; visited guards against malformed loops
+	visited := make(map[uint32]bool)
+	stack := []uint32{f.entries[id].child}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n == cfbNoStream || int(n) >= len(f.entries) || visited[n] {
+			continue
+		}
+		visited[n] = true
+
+		e := f.entries[n]
+		out[e.name] = n
+		stack = append(stack, e.left, e.right)
+	}
+
+	return out
+}
+
+// mapiProps reads the variable length properties stored as __substg1.0_ streams
+type mapiProps struct {
+	f       *cfbFile
+	streams map[string]uint32
+}
+
+// string returns a string property in either its Unicode or 8-bit form
+func (m mapiProps) string(id uint16) string {
+	if b := m.raw(id, mapiTypeUnicode); b != nil {
+		units := make([]uint16, 0, len(b)/2)
+		for i := 0; i+1 < len(b); i += 2 {
+			units = append(units, binary.LittleEndian.Uint16(b[i:]))
+		}
+		return strings.TrimRight(string(utf16.Decode(units)), "\x00")
+	}
+
+	return strings.TrimRight(string(m.raw(id, mapiTypeString8)), "\x00")
+}
+
+// raw returns the stream content of a property, nil when it is absent
+func (m mapiProps) raw(id, typ uint16) []byte {
+	name := "__substg1.0_" + strings.ToUpper(hex16(id)+hex16(typ))
+	n, ok := m.streams[name]
+	if !ok || m.f.entries[n].typ != cfbTypeStream {
+		return nil
+	}
+
+	b, err := m.f.stream(m.f.entries[n])
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// fixed returns the 32-bit value of a fixed-length property from the __properties stream.
+// headerSize is 8 for recipient and attachment storages, 24 or 32 for messages.
+func (m mapiProps) fixed(id uint16, headerSize int) (uint32, bool) {
+	n, ok := m.streams["__properties_version1.0"]
+	if !ok {
+		return 0, false
+	}
+
+	b, err := m.f.stream(m.f.entries[n])
+	if err != nil {
+		return 0, false
+	}
+
+	le := binary.LittleEndian
+	for off := headerSize; off+16 <= len(b); off += 16 {
+		if uint16(le.Uint32(b[off:])>>16) == id {
+			return le.Uint32(b[off+8:]), true
+		}
+	}
+	return 0, false
+}
+
+func hex16(v uint16) string {
+	s := strconv.FormatUint(uint64(v), 16)
+	return strings.Repeat("0", 4-len(s)) + s
+}
+
+// storages returns the names of storages in props starting with prefix, in file order
+func (m mapiProps) storages(prefix string) []string {
+	names := make([]string, 0)
+	for name, id := range m.streams {
+		if m.f.entries[id].typ == cfbTypeStorage && strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+
+	// Recipient and attachment storages are numbered, sorting keeps the original order
+	sort.Strings(names)
+	return names
+}
+
+// parseOutlookMsg extracts the headline fields of an Outlook .msg file. The first
+// message is the file itself, followed by .msg files embedded as its attachments.
+func parseOutlookMsg(data []byte, budget *nestedBudget) ([]NestedMessage, error) {
+	const op = errors.Op("smtp_parse_outlook_msg")
+
+	f, err := parseCFB(data, budget)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	return f.messages(0, 1, ""), nil
+}
+
+// messages reads the message stored in storage id and the messages embedded in it
+func (f *cfbFile) messages(id uint32, depth int, attachment string) []NestedMessage {
+	if depth > f.budget.limits.MaxDepth {
+		f.budget.flag(anomalyNestedDepth)
+		return nil
+	}
+
+	props := mapiProps{f: f, streams: f.children(id)}
+
+	nested := NestedMessage{
+		Source:     nestedSourceMsg,
+		Attachment: attachment,
+		Subject:    props.string(mapiSubject),
+		TextBody:   props.string(mapiBody),
+		Recipients: make([]EmailAddress, 0),
+		CCs:        make([]EmailAddress, 0),
+	}
+
+	// PR_HTML is usually binary in the message codepage, some writers store it as a string
+	if html := props.raw(mapiBodyHTML, mapiTypeBinary); html != nil {
+		nested.HTMLBody = strings.TrimRight(string(html), "\x00")
+	} else {
+		nested.HTMLBody = props.string(mapiBodyHTML)
+	}
+
+	sender := EmailAddress{Name: props.string(mapiSenderName)}
+	if sender.Email = props.string(mapiSenderSMTP); sender.Email == "" {
+		sender.Email = props.string(mapiSenderEmail)
+	}
+	if sender.Email != "" || sender.Name != "" {
+		nested.Sender = []EmailAddress{sender}
+	} else {
+		nested.Sender = make([]EmailAddress, 0)
+	}
+
+	for _, name := range props.storages("__recip_version1.0_") {
+		rp := mapiProps{f: f, streams: f.children(props.streams[name])}
+
+		addr := EmailAddress{Name: rp.string(mapiDisplayName)}
+		if addr.Email = rp.string(mapiSMTPAddress); addr.Email == "" {
+			addr.Email = rp.string(mapiEmailAddress)
+		}
+
+		typ, ok := rp.fixed(mapiRecipientType, 8)
+		if !ok {
+			typ = mapiRecipientTo
+		}
+
+		switch typ {
+		case mapiRecipientCc:
+			nested.CCs = append(nested.CCs, addr)
+		case mapiRecipientTo:
+			nested.Recipients = append(nested.Recipients, addr)
+		default:
+			// Bcc is not part of what the recipients of the original saw
+		}
+	}
+
+	out := []NestedMessage{nested}
+
+	// Messages attached as Outlook items live in an object storage of the attachment
+	object := "__substg1.0_" + strings.ToUpper(hex16(mapiAttachObject)+hex16(mapiTypeObject))
+	for _, name := range props.storages("__attach_version1.0_") {
+		ap := mapiProps{f: f, streams: f.children(props.streams[name])}
+
+		objID, ok := ap.streams[object]
+		if !ok || f.entries[objID].typ != cfbTypeStorage {
+			continue
+		}
+
+		filename := ap.string(mapiAttachName)
+		if filename == "" {
+			filename = ap.string(mapiDisplayName)
+		}
+
+		out = append(out, f.messages(objID, depth+1, filename)...)
+	}
+
+	return out
+}
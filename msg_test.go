@@ -0,0 +1,248 @@
+package smtp
+
+import (
+	"encoding/binary"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const (
+	cfbTestSector = 512
+	cfbFreeSect   = 0xFFFFFFFF
+	cfbFATSect    = 0xFFFFFFFD
+)
+
+// cfbImage is a version 3 compound file being put together by a test: sector 0 holds
+// the FAT, sector 1 the directory, streams go from sector 2 on
+type cfbImage struct {
+	header  []byte
+	sectors [][]byte
+}
+
+func newCFBImage(sectors int) *cfbImage {
+	le := binary.LittleEndian
+	img := &cfbImage{header: make([]byte, cfbTestSector)}
+
+	h := img.header
+	copy(h, cfbSignature)
+	le.PutUint16(h[0x1A:], 3)
+	le.PutUint16(h[0x1C:], 0xFFFE)
+	le.PutUint16(h[0x1E:], 9)
+	le.PutUint16(h[0x20:], 6)
+	le.PutUint32(h[0x2C:], 1)
+	le.PutUint32(h[0x30:], 1)
+	// Every stream is read from regular sectors
+	le.PutUint32(h[0x38:], 0)
+	le.PutUint32(h[0x3C:], cfbEndOfChain)
+	le.PutUint32(h[0x44:], cfbEndOfChain)
+	for i := 0; i < 109; i++ {
+		le.PutUint32(h[0x4C+i*4:], cfbFreeSect)
+	}
+	le.PutUint32(h[0x4C:], 0)
+
+	for range sectors {
+		img.sectors = append(img.sectors, make([]byte, cfbTestSector))
+	}
+	for i := 0; i < cfbTestSector/4; i++ {
+		img.setFAT(uint32(i), cfbFreeSect)
+	}
+	img.setFAT(0, cfbFATSect)
+	img.setFAT(1, cfbEndOfChain)
+
+	img.setEntry(0, "Root Entry", cfbTypeRoot, cfbNoStream, cfbEndOfChain, 0)
+	for i := 1; i < cfbTestSector/cfbDirSize; i++ {
+		img.setEntry(i, "", 0, cfbNoStream, cfbNoStream, 0)
+	}
+	return img
+}
+
+func (img *cfbImage) setFAT(sector, next uint32) {
+	binary.LittleEndian.PutUint32(img.sectors[0][sector*4:], next)
+}
+
+// setEntry writes directory entry i of the first directory sector
+func (img *cfbImage) setEntry(i int, name string, typ byte, child, start uint32, size uint32) {
+	le := binary.LittleEndian
+	b := img.sectors[1][i*cfbDirSize : (i+1)*cfbDirSize]
+
+	units := utf16.Encode([]rune(name))
+	for j, u := range units {
+		le.PutUint16(b[j*2:], u)
+	}
+	if name != "" {
+		le.PutUint16(b[64:], uint16(len(units)*2+2))
+	}
+	b[66] = typ
+	le.PutUint32(b[68:], cfbNoStream)
+	le.PutUint32(b[72:], cfbNoStream)
+	le.PutUint32(b[76:], child)
+	le.PutUint32(b[116:], start)
+	le.PutUint32(b[120:], size)
+}
+
+// withSubject stores a Unicode PR_SUBJECT stream in sector 2
+func (img *cfbImage) withSubject(subject string) *cfbImage {
+	var data []byte
+	for _, u := range utf16.Encode([]rune(subject)) {
+		data = binary.LittleEndian.AppendUint16(data, u)
+	}
+	copy(img.sectors[2], data)
+	img.setFAT(2, cfbEndOfChain)
+
+	binary.LittleEndian.PutUint32(img.sectors[1][76:], 1)
+	img.setEntry(1, "__substg1.0_0037001F", cfbTypeStream, cfbNoStream, 2, uint32(len(data)))
+	return img
+}
+
+func (img *cfbImage) bytes() []byte {
+	out := slices.Clone(img.header)
+	for _, sec := range img.sectors {
+		out = append(out, sec...)
+	}
+	return out
+}
+
+// cfbCases are crafted compound files, valid and broken
+func cfbCases() []struct {
+	name    string
+	data    []byte
+	err     string
+	anomaly string
+} {
+	le := binary.LittleEndian
+
+	cyclicDir := newCFBImage(3)
+	cyclicDir.setFAT(1, 2)
+	cyclicDir.setFAT(2, 1)
+
+	selfDir := newCFBImage(2)
+	selfDir.setFAT(1, 1)
+
+	// The DIFAT sector points back at itself as the next one
+	repeatedDIFAT := newCFBImage(3)
+	le.PutUint32(repeatedDIFAT.header[0x44:], 2)
+	le.PutUint32(repeatedDIFAT.header[0x48:], 100)
+	for i := 0; i < cfbTestSector/4; i++ {
+		le.PutUint32(repeatedDIFAT.sectors[2][i*4:], cfbFreeSect)
+	}
+	le.PutUint32(repeatedDIFAT.sectors[2][cfbTestSector-4:], 2)
+
+	// Every header slot names the same FAT sector
+	duplicateFAT := newCFBImage(2)
+	for i := 0; i < 109; i++ {
+		le.PutUint32(duplicateFAT.header[0x4C+i*4:], 0)
+	}
+
+	farFAT := newCFBImage(2)
+	le.PutUint32(farFAT.header[0x4C:], 5000)
+
+	// 64 directory sectors chained together hold 256 entries, more than the limit
+	bigDir := newCFBImage(66)
+	for s := uint32(1); s < 65; s++ {
+		bigDir.setFAT(s, s+1)
+		if s > 1 {
+			copy(bigDir.sectors[s], bigDir.sectors[1][cfbDirSize:])
+		}
+	}
+	bigDir.setFAT(65, cfbEndOfChain)
+
+	truncated := newCFBImage(2).bytes()
+	truncated = truncated[:len(truncated)-100]
+
+	// The subject chain loops, the message is still read without it
+	cyclicStream := newCFBImage(3).withSubject("Hi")
+	cyclicStream.setFAT(2, 2)
+	le.PutUint32(cyclicStream.sectors[1][cfbDirSize+120:], 4000)
+
+	return []struct {
+		name    string
+		data    []byte
+		err     string
+		anomaly string
+	}{
+		{name: "valid", data: newCFBImage(3).withSubject("Quarterly report").bytes()},
+		{name: "empty", data: nil, err: "not an OLE compound file"},
+		{name: "signature only", data: cfbSignature, err: "not an OLE compound file"},
+		{name: "cyclic directory chain", data: cyclicDir.bytes(), err: "broken sector chain"},
+		{name: "directory chain to itself", data: selfDir.bytes(), err: "broken sector chain"},
+		{name: "repeated DIFAT sector", data: repeatedDIFAT.bytes(), err: "broken DIFAT chain"},
+		{name: "FAT sector listed twice", data: duplicateFAT.bytes(), err: "FAT sector listed twice"},
+		{name: "FAT sector out of range", data: farFAT.bytes(), err: "FAT sector out of range"},
+		{name: "oversized directory", data: bigDir.bytes(), anomaly: anomalyNestedEntries},
+		{name: "truncated sector", data: truncated, err: "broken sector chain"},
+		{name: "cyclic stream chain", data: cyclicStream.bytes()},
+	}
+}
+
+func testNestedLimits() *NestedLimitsConfig {
+	limits := &NestedLimitsConfig{MaxEntries: 100}
+	limits.initDefaults()
+	return limits
+}
+
+func TestParseOutlookMsg(t *testing.T) {
+	for _, tc := range cfbCases() {
+		t.Run(tc.name, func(t *testing.T) {
+			budget := newNestedBudget(testNestedLimits())
+			messages, err := parseOutlookMsg(tc.data, budget)
+			if tc.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.err) {
+					t.Fatalf("error %v, want %q", err, tc.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) == 0 {
+				t.Fatal("no message read")
+			}
+			if tc.anomaly != "" && !slices.Contains(budget.anomalies, tc.anomaly) {
+				t.Errorf("anomalies %v, want %s", budget.anomalies, tc.anomaly)
+			}
+		})
+	}
+
+	messages, err := parseOutlookMsg(newCFBImage(3).withSubject("Quarterly report").bytes(), newNestedBudget(testNestedLimits()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages[0].Subject != "Quarterly report" {
+		t.Errorf("subject %q", messages[0].Subject)
+	}
+}
+
+func TestParseOutlookMsgSizeLimit(t *testing.T) {
+	limits := testNestedLimits()
+	limits.MaxSize = cfbTestSector - 1
+
+	budget := newNestedBudget(limits)
+	if _, err := parseOutlookMsg(newCFBImage(2).bytes(), budget); err == nil {
+		t.Fatal("directory read past the size limit")
+	}
+	if !slices.Contains(budget.anomalies, anomalyNestedSize) {
+		t.Errorf("anomalies %v, want %s", budget.anomalies, anomalyNestedSize)
+	}
+}
+
+func FuzzParseMsg(f *testing.F) {
+	for _, tc := range cfbCases() {
+		f.Add(tc.data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		limits := testNestedLimits()
+		limits.MaxSize = 1 << 20
+
+		budget := newNestedBudget(limits)
+		messages, err := parseOutlookMsg(data, budget)
+		if err == nil && len(messages) == 0 {
+			t.Error("no error and no message")
+		}
+		if budget.size > limits.MaxSize {
+			t.Errorf("read %d bytes, limit %d", budget.size, limits.MaxSize)
+		}
+	})
+}
@@ -0,0 +1,76 @@
+package smtp
+
+import (
+	"slices"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// Anomalies recorded when a nested container hits a safety limit
+const (
+	anomalyNestedSize    = "nested_size_limit"
+	anomalyNestedDepth   = "nested_depth_limit"
+	anomalyNestedEntries = "nested_entries_limit"
+)
+
+// NestedLimitsConfig bounds the work spent unpacking containers such as .msg attachments
+type NestedLimitsConfig struct {
+	MaxSize    int64 `mapstructure:"max_size"`    // bytes read out of one container
+	MaxDepth   int   `mapstructure:"max_depth"`   // containers inside containers
+	MaxEntries int   `mapstructure:"max_entries"` // directory entries of one container
+}
+
+// initDefaults fills nested content limits
+func (n *NestedLimitsConfig) initDefaults() {
+	if n.MaxSize == 0 {
+		n.MaxSize = 32 * 1024 * 1024
+	}
+
+	if n.MaxDepth == 0 {
+		n.MaxDepth = 3
+	}
+
+	if n.MaxEntries == 0 {
+		n.MaxEntries = 1000
+	}
+}
+
+// validate checks the limits are usable
+func (n *NestedLimitsConfig) validate() error {
+	const op = errors.Op("smtp_nested_limits_validate")
+
+	if n.MaxSize < 0 || n.MaxDepth < 0 || n.MaxEntries < 0 {
+		return errors.E(op, errors.Str("attachment_storage.nested limits cannot be negative"))
+	}
+
+	return nil
+}
+
+// nestedBudget tracks what unpacking one container has consumed so far
+type nestedBudget struct {
+	limits    *NestedLimitsConfig
+	size      int64
+	anomalies []string
+}
+
+func newNestedBudget(limits *NestedLimitsConfig) *nestedBudget {
+	return &nestedBudget{limits: limits}
+}
+
+// take reserves n bytes, false once the container would exceed its size limit
+func (b *nestedBudget) take(n int64) bool {
+	if b.size+n > b.limits.MaxSize {
+		b.flag(anomalyNestedSize)
+		return false
+	}
+
+	b.size += n
+	return true
+}
+
+// flag records a limit that truncated the container, once per kind
+func (b *nestedBudget) flag(anomaly string) {
+	if !slices.Contains(b.anomalies, anomaly) {
+		b.anomalies = append(b.anomalies, anomaly)
+	}
+}
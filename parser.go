@@ -2,7 +2,9 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"mime"
@@ -10,13 +12,19 @@ import (
 	"mime/quotedprintable"
 	"net/mail"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/text/encoding/htmlindex"
 )
 
 // parseEmail parses raw email data into structured format for PHP
 func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
+	p := s.backend.plugin
+	s.storageTime = 0
+
 	// 1. Parse as mail.Message (stdlib)
 	msg, err := mail.ReadMessage(bytes.NewReader(rawData))
 	if err != nil {
@@ -26,6 +34,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 
 	parsed := &ParsedMessage{
 		Raw:           string(rawData),
+		Size:          int64(len(rawData)),
 		Sender:        make([]EmailAddress, 0),
 		Recipients:    make([]EmailAddress, 0),
 		CCs:           make([]EmailAddress, 0),
@@ -39,11 +48,18 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 		parsed.ID = &msgID
 	}
 
+	if p.cfg.LintMIME {
+		parsed.Lint = lintMessage(rawData)
+	}
+
+	// Client-provided correlation ID for cross-system tracing
+	parsed.CorrelationID = strings.TrimSpace(msg.Header.Get("X-Correlation-ID"))
+
 	// 3. Parse From (sender)
 	if fromAddrs, err := msg.Header.AddressList("From"); err == nil {
 		for _, addr := range fromAddrs {
 			parsed.Sender = append(parsed.Sender, EmailAddress{
-				Email: addr.Address,
+				Email: p.normalizeAddress(addr.Address),
 				Name:  addr.Name,
 			})
 		}
@@ -53,7 +69,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 	if toAddrs, err := msg.Header.AddressList("To"); err == nil {
 		for _, addr := range toAddrs {
 			parsed.Recipients = append(parsed.Recipients, EmailAddress{
-				Email: addr.Address,
+				Email: p.normalizeAddress(addr.Address),
 				Name:  addr.Name,
 			})
 		}
@@ -63,7 +79,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 	if ccAddrs, err := msg.Header.AddressList("Cc"); err == nil {
 		for _, addr := range ccAddrs {
 			parsed.CCs = append(parsed.CCs, EmailAddress{
-				Email: addr.Address,
+				Email: p.normalizeAddress(addr.Address),
 				Name:  addr.Name,
 			})
 		}
@@ -73,7 +89,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 	if replyAddrs, err := msg.Header.AddressList("Reply-To"); err == nil {
 		for _, addr := range replyAddrs {
 			parsed.ReplyTo = append(parsed.ReplyTo, EmailAddress{
-				Email: addr.Address,
+				Email: p.normalizeAddress(addr.Address),
 				Name:  addr.Name,
 			})
 		}
@@ -81,6 +97,7 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 
 	// 7. Parse Subject
 	parsed.Subject = msg.Header.Get("Subject")
+	parsed.Priority = parsePriority(msg.Header)
 
 	// 8. Parse body and attachments
 	contentType := msg.Header.Get("Content-Type")
@@ -93,8 +110,11 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 		// Simple email (no attachments)
 		body, _ := io.ReadAll(msg.Body)
 		decoded := s.decodeContent(body, msg.Header.Get("Content-Transfer-Encoding"))
+		decoded = decodeCharset(decoded, params["charset"])
 		if strings.HasPrefix(mediaType, "text/html") {
 			parsed.HTMLBody = string(decoded)
+		} else if flowed, delsp := isFlowed(params); flowed {
+			parsed.TextBody = decodeFlowed(string(decoded), delsp)
 		} else {
 			parsed.TextBody = string(decoded)
 		}
@@ -119,9 +139,77 @@ func (s *Session) parseEmail(rawData []byte) (*ParsedMessage, error) {
 		}
 	}
 
+	// 10. Legacy uuencoded files embedded in the text body
+	s.extractUUEncodedParsed(parsed)
+
+	// 11. Optional reply extraction for reply-by-email testing
+	if s.backend.plugin.cfg.ExtractReply && parsed.TextBody != "" {
+		parsed.ReplyText = extractReply(parsed.TextBody)
+	}
+
 	return parsed, nil
 }
 
+// Values of body_preference
+const (
+	bodyPreferText = "text"
+	bodyPreferHTML = "html"
+	bodyPreferBoth = "both"
+)
+
+// selectBody picks what message.body carries, text_body and html_body always hold both
+func selectBody(parsed *ParsedMessage, preference string) string {
+	switch preference {
+	case bodyPreferHTML:
+		return parsed.HTMLBody
+	case bodyPreferBoth:
+		if parsed.TextBody == "" || parsed.HTMLBody == "" {
+			return parsed.TextBody + parsed.HTMLBody
+		}
+		return parsed.TextBody + "\n\n" + parsed.HTMLBody
+	default:
+		return parsed.TextBody
+	}
+}
+
+// Normalized message priorities
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// parsePriority normalizes X-Priority, Importance and Precedence, in that order of trust
+func parsePriority(h mail.Header) string {
+	// X-Priority is "1".."5", often followed by a comment: "1 (Highest)"
+	if v := strings.TrimSpace(h.Get("X-Priority")); v != "" {
+		switch v[0] {
+		case '1', '2':
+			return priorityHigh
+		case '3':
+			return priorityNormal
+		case '4', '5':
+			return priorityLow
+		}
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Importance"))) {
+	case "high":
+		return priorityHigh
+	case "normal":
+		return priorityNormal
+	case "low":
+		return priorityLow
+	}
+
+	switch strings.ToLower(strings.TrimSpace(h.Get("Precedence"))) {
+	case "bulk", "list", "junk":
+		return priorityLow
+	}
+
+	return priorityNormal
+}
+
 // processPartParsed handles individual MIME parts for ParsedMessage
 func (s *Session) processPartParsed(part *multipart.Part, parsed *ParsedMessage) error {
 	disposition := part.Header.Get("Content-Disposition")
@@ -134,7 +222,25 @@ func (s *Session) processPartParsed(part *multipart.Part, parsed *ParsedMessage)
 	}
 
 	// This is body content
-	mediaType, _, _ := mime.ParseMediaType(contentType)
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+
+	// multipart/alternative nested in multipart/mixed, as sent by most clients with attachments
+	if strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		mr := multipart.NewReader(part, params["boundary"])
+		for {
+			nested, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := s.processPartParsed(nested, parsed); err != nil {
+				return err
+			}
+		}
+	}
+
 	if strings.HasPrefix(mediaType, "text/plain") ||
 		strings.HasPrefix(mediaType, "text/html") ||
 		contentType == "" {
@@ -145,6 +251,10 @@ func (s *Session) processPartParsed(part *multipart.Part, parsed *ParsedMessage)
 
 		// Decode if needed (quoted-printable, base64)
 		decoded := s.decodeContent(bodyBytes, part.Header.Get("Content-Transfer-Encoding"))
+		decoded = decodeCharset(decoded, params["charset"])
+		if flowed, delsp := isFlowed(params); flowed && !strings.HasPrefix(mediaType, "text/html") {
+			decoded = []byte(decodeFlowed(string(decoded), delsp))
+		}
 
 		if strings.HasPrefix(mediaType, "text/html") {
 			if parsed.HTMLBody == "" {
@@ -209,21 +319,97 @@ func (s *Session) processAttachmentParsed(part *multipart.Part, parsed *ParsedMe
 		attachment.ContentID = &contentID
 	}
 
-	// Handle based on storage mode
+	if err := s.storeAttachment(&attachment, content); err != nil {
+		return err
+	}
+
+	// Extraction failures keep the attachment, just without searchable text
+	text, err := s.backend.plugin.extractText(contentType, content)
+	if err != nil {
+		s.log.Warn("attachment text extraction failed", zap.String("filename", filename), zap.Error(err))
+	}
+	attachment.ExtractedText = text
+
+	parsed.Attachments = append(parsed.Attachments, attachment)
+
+	// Forwarded Outlook messages are surfaced like any other nested message
+	if isOutlookMsg(filename, contentType, content) {
+		budget := newNestedBudget(&s.backend.plugin.cfg.AttachmentStorage.Nested)
+		nested, err := parseOutlookMsg(content, budget)
+		parsed.Anomalies = append(parsed.Anomalies, budget.anomalies...)
+		if err != nil {
+			s.log.Warn("failed to parse outlook message", zap.String("filename", filename), zap.Error(err))
+			return nil
+		}
+		if len(budget.anomalies) > 0 {
+			s.log.Warn("outlook message truncated by nested limits",
+				zap.String("filename", filename),
+				zap.Strings("anomalies", budget.anomalies),
+			)
+		}
+
+		if len(nested) > 0 {
+			nested[0].Attachment = filename
+			parsed.Nested = append(parsed.Nested, nested...)
+		}
+	}
+
+	return nil
+}
+
+// extractUUEncodedParsed moves uuencoded blocks of the text body into attachments
+func (s *Session) extractUUEncodedParsed(parsed *ParsedMessage) {
+	body, files := extractUUEncoded(parsed.TextBody)
+	if len(files) == 0 {
+		return
+	}
+	parsed.TextBody = body
+
+	for _, f := range files {
+		contentType := mime.TypeByExtension(filepath.Ext(f.name))
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		attachment := Attachment{
+			Filename: f.name,
+			Type:     contentType,
+			Source:   attachmentSourceUUEncode,
+		}
+
+		if err := s.storeAttachment(&attachment, f.content); err != nil {
+			s.log.Error("failed to store uuencoded attachment", zap.String("filename", f.name), zap.Error(err))
+			continue
+		}
+
+		parsed.Attachments = append(parsed.Attachments, attachment)
+	}
+}
+
+// storeAttachment fills attachment content according to the storage mode
+func (s *Session) storeAttachment(attachment *Attachment, content []byte) error {
 	cfg := s.backend.plugin.cfg
+	storageStart := time.Now()
+	defer func() { s.storageTime += time.Since(storageStart) }()
+
+	// Checksum and size are reported in every storage mode
+	sum := sha256.Sum256(content)
+	attachment.SHA256 = hex.EncodeToString(sum[:])
+	attachment.Size = int64(len(content))
+
 	if cfg.AttachmentStorage.Mode == "memory" {
 		// Base64 encode for JSON
 		attachment.Content = base64.StdEncoding.EncodeToString(content)
-	} else {
-		// Write to temp file and store path in Content field
-		path, err := s.saveTempFile(content, filename)
-		if err != nil {
-			return err
-		}
-		attachment.Content = path
+		return nil
 	}
 
-	parsed.Attachments = append(parsed.Attachments, attachment)
+	// Write to temp file and store path in Content field
+	path, err := s.saveTempFile(content, attachment.Filename)
+	if err != nil {
+		return err
+	}
+	attachment.Content = path
+
 	return nil
 }
 
@@ -239,7 +425,7 @@ func (s *Session) saveTempFile(content []byte, filename string) (string, error)
 	// Create temp file with unique name
 	tmpFile, err := os.CreateTemp(
 		cfg.AttachmentStorage.TempDir,
-		fmt.Sprintf("smtp-att-%s-*-%s", s.uuid[:8], filename),
+		fmt.Sprintf(tempAttachmentPrefix+"%s-*-%s", shortID(s.uuid), filename),
 	)
 	if err != nil {
 		return "", err
@@ -253,6 +439,26 @@ func (s *Session) saveTempFile(content []byte, filename string) (string, error)
 	return tmpFile.Name(), nil
 }
 
+// decodeCharset converts 8-bit text in a legacy charset to UTF-8, so non-ASCII
+// bytes survive JSON encoding. Unknown charsets are passed through unchanged.
+func decodeCharset(data []byte, charset string) []byte {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8", "us-ascii":
+		return data
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return data
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(data)
+	if err != nil {
+		return data
+	}
+	return decoded
+}
+
 // decodeContent decodes content based on transfer encoding
 func (s *Session) decodeContent(data []byte, encoding string) []byte {
 	switch strings.ToLower(encoding) {
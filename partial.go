@@ -0,0 +1,62 @@
+package smtp
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// partialFilePrefix names partial message files in temp_dir, next to tempfile attachments
+const partialFilePrefix = "smtp-partial-"
+
+// PartialConfig keeps the bytes of transfers that were cut off mid-DATA
+type PartialConfig struct {
+	Enabled bool  `mapstructure:"enabled"`
+	MaxSize int64 `mapstructure:"max_size"` // bytes kept from the start of the message
+}
+
+// initDefaults fills partial message defaults
+func (c *PartialConfig) initDefaults() {
+	if c.MaxSize == 0 {
+		c.MaxSize = 1024 * 1024
+	}
+}
+
+// validate checks the size cap
+func (c *PartialConfig) validate() error {
+	const op = errors.Op("smtp_partial_validate")
+
+	if c.MaxSize < 0 {
+		return errors.E(op, errors.Str("attachment_storage.partial_messages.max_size cannot be negative"))
+	}
+
+	return nil
+}
+
+// savePartial writes the bytes received so far to temp_dir, reporting whether they were cut at max_size
+func (s *Session) savePartial() (string, bool, error) {
+	cfg := s.backend.plugin.cfg
+
+	data := s.emailData.Bytes()
+	truncated := int64(len(data)) > cfg.AttachmentStorage.PartialMessages.MaxSize
+	if truncated {
+		data = data[:cfg.AttachmentStorage.PartialMessages.MaxSize]
+	}
+
+	if err := os.MkdirAll(cfg.AttachmentStorage.TempDir, 0755); err != nil {
+		return "", false, err
+	}
+
+	f, err := os.CreateTemp(cfg.AttachmentStorage.TempDir, fmt.Sprintf("%s%s-*.eml", partialFilePrefix, shortID(s.uuid)))
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(data); err != nil {
+		return "", false, err
+	}
+
+	return f.Name(), truncated, nil
+}
@@ -0,0 +1,114 @@
+package smtp
+
+import (
+	"strconv"
+	"sync"
+)
+
+// payloadBuckets are the upper bounds of the payload size histogram in bytes, the last bucket is unbounded
+var payloadBuckets = []int64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+// PayloadSummary is the payload size histogram of one pipeline
+type PayloadSummary struct {
+	Count uint64 `json:"count"`
+	Sum   uint64 `json:"sum_bytes"`
+	Max   int64  `json:"max_bytes"`
+	// Payloads per upper bound in bytes ("le", as Prometheus does), "+Inf" counts the rest.
+	// Buckets are not cumulative.
+	Buckets map[string]uint64 `json:"buckets"`
+	// Payloads above jobs.payload_warn_ratio of jobs.max_payload_size
+	NearLimit uint64 `json:"near_limit"`
+	// Payloads above jobs.max_payload_size, the broker is likely to refuse them
+	OverLimit uint64 `json:"over_limit"`
+}
+
+// payloadHistogram counts payloads of one pipeline
+type payloadHistogram struct {
+	count     uint64
+	sum       uint64
+	max       int64
+	buckets   []uint64 // len(payloadBuckets)+1
+	nearLimit uint64
+	overLimit uint64
+}
+
+// payloadTracker records serialized payload sizes per pipeline
+type payloadTracker struct {
+	limit int64 // jobs.max_payload_size, 0 when unknown
+	warn  int64 // size from which payloads are close to the limit
+
+	mu        sync.Mutex
+	pipelines map[string]*payloadHistogram
+}
+
+func newPayloadTracker(cfg *JobsConfig) *payloadTracker {
+	return &payloadTracker{
+		limit:     cfg.MaxPayloadSize,
+		warn:      int64(float64(cfg.MaxPayloadSize) * cfg.PayloadWarnRatio),
+		pipelines: make(map[string]*payloadHistogram),
+	}
+}
+
+// observe adds a payload size, reporting whether it is near or over the limit
+func (t *payloadTracker) observe(pipeline string, size int64) (near, over bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	h, ok := t.pipelines[pipeline]
+	if !ok {
+		h = &payloadHistogram{buckets: make([]uint64, len(payloadBuckets)+1)}
+		t.pipelines[pipeline] = h
+	}
+
+	h.count++
+	h.sum += uint64(size)
+	h.max = max(h.max, size)
+
+	i := 0
+	for i < len(payloadBuckets) && size > payloadBuckets[i] {
+		i++
+	}
+	h.buckets[i]++
+
+	if t.limit > 0 {
+		over = size > t.limit
+		near = !over && size >= t.warn
+	}
+	if over {
+		h.overLimit++
+	}
+	if near {
+		h.nearLimit++
+	}
+
+	return near, over
+}
+
+// summary returns the histogram of every pipeline
+func (t *payloadTracker) summary() map[string]PayloadSummary {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	result := make(map[string]PayloadSummary, len(t.pipelines))
+	for pipeline, h := range t.pipelines {
+		buckets := make(map[string]uint64, len(h.buckets))
+		for i, n := range h.buckets {
+			le := "+Inf"
+			if i < len(payloadBuckets) {
+				le = strconv.FormatInt(payloadBuckets[i], 10)
+			}
+			buckets[le] = n
+		}
+
+		result[pipeline] = PayloadSummary{
+			Count:     h.count,
+			Sum:       h.sum,
+			Max:       h.max,
+			Buckets:   buckets,
+			NearLimit: h.nearLimit,
+			OverLimit: h.overLimit,
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,44 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"net"
+)
+
+// remoteAddrOf describes the client behind conn. Unix socket peers have no
+// address, they are reported as "unix" with peer credentials where available.
+func remoteAddrOf(conn net.Conn) string {
+	raw := conn
+	if tc, ok := raw.(*tls.Conn); ok {
+		raw = tc.NetConn()
+	}
+	if gc, ok := raw.(*greetingConn); ok {
+		raw = gc.Conn
+	}
+	if tc, ok := raw.(*transcriptConn); ok {
+		raw = tc.Conn
+	}
+	if ic, ok := raw.(*idleConn); ok {
+		raw = ic.Conn
+	}
+
+	if uc, ok := raw.(*net.UnixConn); ok {
+		if creds := peerCredentials(uc); creds != "" {
+			return "unix:" + creds
+		}
+		return "unix"
+	}
+
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return "unknown"
+}
+
+// remoteIP returns the client IP of a TCP connection, empty for Unix sockets
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
@@ -0,0 +1,27 @@
+//go:build linux
+
+package smtp
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns "pid=..,uid=..,gid=.." of the process on the other end of the socket
+func peerCredentials(conn *net.UnixConn) string {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return ""
+	}
+
+	var cred *syscall.Ucred
+	ctrlErr := raw.Control(func(fd uintptr) {
+		cred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if ctrlErr != nil || err != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("pid=%d,uid=%d,gid=%d", cred.Pid, cred.Uid, cred.Gid)
+}
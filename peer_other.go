@@ -0,0 +1,10 @@
+//go:build !linux
+
+package smtp
+
+import "net"
+
+// peerCredentials is only implemented on Linux
+func peerCredentials(_ *net.UnixConn) string {
+	return ""
+}
@@ -2,10 +2,16 @@ package smtp
 
 import (
 	"context"
+	"crypto/tls"
 	"net"
+	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-smtp"
+	"github.com/roadrunner-server/api/v4/plugins/v1/kv"
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
 	"github.com/roadrunner-server/endure/v2/dep"
 	"github.com/roadrunner-server/errors"
 	"go.uber.org/zap"
@@ -30,6 +36,11 @@ type Configurer interface {
 
 // Plugin is the SMTP server plugin
 type Plugin struct {
+	// Timestamps and IDs of job payloads, set them before Init to inject your own.
+	// Left nil, they come from the deterministic config section or the system.
+	Clock Clock
+	IDs   IDGenerator
+
 	mu          sync.RWMutex
 	cfg         *Config
 	log         *zap.Logger
@@ -38,9 +49,78 @@ type Plugin struct {
 	// Jobs plugin reference
 	jobs Jobs
 
+	// Recent messages for Tail RPC readers
+	tail *tailHub
+
+	// Delivery records for reports
+	history *messageHistory
+
+	// Global throughput cap, nil when disabled
+	throughput throughputLimiter
+
+	// KV drivers by name, and the storage backing a cluster-wide throughput cap
+	kvDrivers       map[string]kv.Constructor
+	throughputKVDrv string
+	throughputKV    kv.Storage
+
+	stats    statsCounters
+	latency  *latencyTracker
+	payloads *payloadTracker
+
+	// Users checked by auth.verify, nil when every AUTH attempt is accepted
+	credentials *credentialStore
+
+	// Messages per minute per client IP and in total, nil when not limited
+	messageRate *messageRateLimiter
+
+	// Open connections in total and per client IP, nil when not limited
+	allConns   *connLimiter
+	perIPConns *connLimiter
+
+	// Strikes and bans per client IP, nil when limits.ban is disabled
+	bans *banList
+
+	// Parses and pushes messages after DATA was answered, nil in inline delivery mode
+	delivery *deliveryQueue
+	// Unix nanoseconds of the last failed push to Jobs, 0 once a push succeeded
+	pushFailedAt atomic.Int64
+	// DATA/BDAT transfers in progress, drained on Stop
+	transfers atomic.Int64
+
+	// Picks the messages pushed under sampling, nil when every message is
+	sampler *sampler
+
+	// Fault injection, nil unless chaos is configured
+	chaos *chaosInjector
+	// Misbehavior per client IP set over RPC
+	behaviors *clientBehaviors
+
+	// Command and extension usage per client
+	clients *clientTracker
+
+	// Per-sender baselines, nil when sender alerts are disabled
+	senders *senderTracker
+
+	// Attachment text extractor, nil when disabled
+	extractor textExtractor
+
 	// SMTP server components
 	smtpServer *smtp.Server
-	listener   net.Listener
+	listeners  []*smtpListener
+	stopped    atomic.Bool
+
+	// HAProxy agent-check listener, nil when disabled
+	healthListener net.Listener
+
+	// HTTP send endpoint, nil when disabled
+	sendServer *http.Server
+
+	// STARTTLS certificate sources, nil when not configured
+	certs      *certReloader
+	acme       *acmeManager
+	selfSigned *tls.Certificate
+	// ClientHello fingerprints of TLS connections, nil without TLS
+	hellos *helloTracker
 }
 
 // Init initializes the plugin with configuration and logger
@@ -65,9 +145,86 @@ func (p *Plugin) Init(log Logger, cfg Configurer) error {
 
 	// Setup logger
 	p.log = log.NamedLogger(PluginName)
+	p.initIdentity()
+
+	if p.cfg.Jobs.SchemaVersion < currentSchemaVersion {
+		p.log.Warn("jobs.schema_version is deprecated, move consumers to the current payload layout",
+			zap.Int("schema_version", p.cfg.Jobs.SchemaVersion),
+			zap.Int("current", currentSchemaVersion),
+		)
+	}
+
+	p.tail = newTailHub()
+	p.history = newMessageHistory()
+	p.latency = newLatencyTracker()
+	p.payloads = newPayloadTracker(&p.cfg.Jobs)
+	p.clients = newClientTracker()
+	p.behaviors = newClientBehaviors()
+
+	if p.cfg.Limits.MessagesPerMinute.PerIP > 0 || p.cfg.Limits.MessagesPerMinute.Global > 0 {
+		p.messageRate = newMessageRateLimiter(&p.cfg.Limits.MessagesPerMinute)
+	}
+
+	if p.cfg.Limits.MaxConnections > 0 {
+		p.allConns = newConnLimiter(p.cfg.Limits.MaxConnections)
+	}
+
+	if p.cfg.Limits.MaxConnectionsPerIP > 0 {
+		p.perIPConns = newConnLimiter(p.cfg.Limits.MaxConnectionsPerIP)
+	}
+
+	if p.cfg.Limits.Ban.Threshold > 0 {
+		p.bans = newBanList(&p.cfg.Limits.Ban, p.log)
+	}
+	if p.cfg.Delivery.Mode == deliveryAsync {
+		p.delivery = newDeliveryQueue(p)
+	}
+
+	if p.cfg.Sampling.KeepOneIn > 1 {
+		p.sampler = &sampler{keepOneIn: p.cfg.Sampling.KeepOneIn}
+	}
+
+	if p.cfg.Chaos.enabled() {
+		p.chaos = newChaosInjector(&p.cfg.Chaos, p.log)
+	}
+	p.extractor = newTextExtractor(&p.cfg.AttachmentStorage.TextExtraction)
+
+	if p.cfg.SenderAlerts.Enabled {
+		p.senders = newSenderTracker(&p.cfg.SenderAlerts)
+	}
+
+	if p.cfg.Auth.Verify {
+		p.credentials, err = newCredentialStore(&p.cfg.Auth)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	p.kvDrivers = make(map[string]kv.Constructor)
+
+	if p.cfg.Throughput.KV != "" {
+		// The storage is declared in the kv section, like for the kv plugin itself
+		key := kvConfigKey(p.cfg.Throughput.KV)
+		if !cfg.Has(key) {
+			return errors.E(op, errors.Errorf("throughput.kv: no %q section configured", key))
+		}
+
+		var section struct {
+			Driver string `mapstructure:"driver"`
+		}
+		if err := cfg.UnmarshalKey(key, &section); err != nil {
+			return errors.E(op, err)
+		}
+		p.throughputKVDrv = section.Driver
+	}
+
+	// A KV-backed cap is created in Serve, once the driver plugins are collected
+	if p.cfg.Throughput.MessagesPerSecond > 0 && p.cfg.Throughput.KV == "" {
+		p.throughput = newTokenBucket(p.cfg.Throughput.MessagesPerSecond, p.cfg.Throughput.Burst)
+	}
 
 	p.log.Info("SMTP plugin initialized",
-		zap.String("addr", p.cfg.Addr),
+		zap.Strings("addr", p.cfg.Addr),
 		zap.String("hostname", p.cfg.Hostname),
 		zap.Int64("max_message_size", p.cfg.MaxMessageSize),
 		zap.String("jobs_pipeline", p.cfg.Jobs.Pipeline),
@@ -89,47 +246,150 @@ func (p *Plugin) Serve() chan error {
 		return errCh
 	}
 
+	// Fail fast on environment problems
+	if err := p.preflight(); err != nil {
+		errCh <- err
+		return errCh
+	}
+
+	if p.cfg.Throughput.KV != "" {
+		if err := p.initThroughputKV(); err != nil {
+			errCh <- err
+			return errCh
+		}
+	}
+
 	// 1. Create SMTP backend
 	backend := NewBackend(p)
 
 	// 2. Create SMTP server
 	p.smtpServer = smtp.NewServer(backend)
-	p.smtpServer.Addr = p.cfg.Addr
+	p.smtpServer.Addr = p.cfg.Addr[0]
 	p.smtpServer.Domain = p.cfg.Hostname
 	p.smtpServer.ReadTimeout = p.cfg.ReadTimeout
 	p.smtpServer.WriteTimeout = p.cfg.WriteTimeout
 	p.smtpServer.MaxMessageBytes = p.cfg.MaxMessageSize
-	p.smtpServer.MaxRecipients = 100
+	p.smtpServer.MaxLineLength = p.cfg.Limits.MaxLineLength
+	// max_recipients is enforced by Session.Rcpt so the rejection text is configurable
+	p.smtpServer.MaxRecipients = 0
 	p.smtpServer.AllowInsecureAuth = true
+	p.smtpServer.EnableSMTPUTF8 = true
+	// Accept REQUIRETLS so clients can declare it, it is reported in envelope.params
+	p.smtpServer.EnableREQUIRETLS = true
+
+	switch {
+	case p.cfg.TLS.ACME.Enabled:
+		p.acme = newACMEManager(&p.cfg.TLS.ACME, p.log)
+		if err := p.acme.start(errCh); err != nil {
+			errCh <- err
+			return errCh
+		}
+
+		p.smtpServer.TLSConfig = &tls.Config{
+			GetCertificate: p.acme.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	case p.cfg.TLS.SelfSigned:
+		var err error
+		p.selfSigned, err = generateSelfSigned(p.cfg.Hostname)
+		if err != nil {
+			errCh <- errors.E(errors.Op("smtp_self_signed"), err)
+			return errCh
+		}
+
+		p.log.Info("generated self-signed TLS certificate",
+			zap.String("hostname", p.cfg.Hostname),
+			zap.String("sha256_fingerprint", fingerprint(p.selfSigned.Leaf)),
+			zap.Time("not_after", p.selfSigned.Leaf.NotAfter),
+		)
+
+		p.smtpServer.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{*p.selfSigned},
+			MinVersion:   tls.VersionTLS12,
+		}
+	case p.cfg.TLS.hasFiles():
+		var err error
+		p.certs, err = newCertReloader(p.cfg.TLS.Cert, p.cfg.TLS.Key, p.log)
+		if err != nil {
+			errCh <- err
+			return errCh
+		}
+
+		p.smtpServer.TLSConfig = &tls.Config{
+			GetCertificate: p.certs.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+	}
+
+	if p.smtpServer.TLSConfig != nil {
+		p.hellos = newHelloTracker()
+		p.smtpServer.TLSConfig.GetConfigForClient = p.hellos.GetConfigForClient
+		if p.cfg.TLS.RequestClientCert {
+			p.smtpServer.TLSConfig.ClientAuth = tls.RequestClientCert
+		}
+	}
 
 	p.log.Info("SMTP server configured",
-		zap.String("addr", p.smtpServer.Addr),
+		zap.Strings("addr", p.cfg.Addr),
 		zap.String("domain", p.smtpServer.Domain),
+		zap.Bool("starttls", p.smtpServer.TLSConfig != nil),
 		zap.String("jobs_pipeline", p.cfg.Jobs.Pipeline),
 	)
 
-	// 3. Create listener
-	var err error
-	p.listener, err = net.Listen("tcp", p.cfg.Addr)
-	if err != nil {
-		errCh <- errors.E(errors.Op("smtp_listen"), err)
-		return errCh
+	// 3. Create listeners
+	p.listeners = make([]*smtpListener, 0, len(p.cfg.Addr)+1)
+	for _, addr := range p.cfg.Addr {
+		p.listeners = append(p.listeners, &smtpListener{addr: addr})
+	}
+	if p.cfg.TLS.SMTPSAddr != "" {
+		p.listeners = append(p.listeners, &smtpListener{addr: p.cfg.TLS.SMTPSAddr, implicitTLS: true})
 	}
 
-	p.log.Info("SMTP listener created", zap.String("addr", p.cfg.Addr))
+	for _, sl := range p.listeners {
+		if err := p.listen(sl); err != nil {
+			errCh <- errors.E(errors.Op("smtp_listen"), err)
+			return errCh
+		}
 
-	// 4. Start SMTP server in goroutine
-	go func() {
-		p.log.Info("SMTP server starting", zap.String("addr", p.cfg.Addr))
-		if err := p.smtpServer.Serve(p.listener); err != nil {
-			p.log.Error("SMTP server error", zap.Error(err))
-			errCh <- err
+		p.log.Info("SMTP listener created", zap.String("addr", sl.addr), zap.Bool("implicit_tls", sl.implicitTLS))
+
+		// go-smtp needs the *tls.Conn itself, so the banner cannot be rewritten inside TLS
+		if sl.implicitTLS && p.cfg.Greeting.listenerBanner(sl.addr) != nil {
+			p.log.Warn("greeting.banner is not applied on tls.smtps_addr, clients there get the default 220 banner",
+				zap.String("addr", sl.addr),
+			)
 		}
-	}()
+	}
+
+	// Delivery workers are running before the first message can be queued
+	if p.delivery != nil {
+		p.delivery.start()
+	}
+
+	// 4. Start SMTP server on every listener
+	p.log.Info("SMTP server starting", zap.Int("listeners", len(p.listeners)))
+	for _, sl := range p.listeners {
+		go p.serveListener(sl, errCh)
+	}
 
 	// 5. Start temp file cleanup routine
 	p.startCleanupRoutine(context.Background())
 
+	// 6. Start TLS certificate reloader
+	p.startCertReloader(context.Background())
+
+	// 7. Start load balancer health agent
+	if err := p.startHealthAgent(errCh); err != nil {
+		errCh <- err
+		return errCh
+	}
+
+	// 8. Start HTTP send endpoint
+	if err := p.startSendAPI(errCh); err != nil {
+		errCh <- err
+		return errCh
+	}
+
 	return errCh
 }
 
@@ -143,21 +403,47 @@ func (p *Plugin) Stop(ctx context.Context) error {
 		p.mu.Lock()
 		defer p.mu.Unlock()
 
-		// 1. Close listener (stops accepting new connections)
-		if p.listener != nil {
-			_ = p.listener.Close()
+		p.stopped.Store(true)
+
+		// 1. Close listeners (stops accepting new connections)
+		for _, sl := range p.listeners {
+			if sl.l != nil {
+				_ = sl.l.Close()
+			}
 		}
 
-		// 2. Close SMTP server
+		// 2. Let message transfers in progress finish, idle sessions get 421 at MAIL FROM
+		p.drainTransfers(ctx)
+
+		// 3. Send 421 to sessions waiting for a command and close them
+		p.closeSessions(ctx)
+
+		// 4. Close SMTP server, with connections that never greeted
 		if p.smtpServer != nil {
 			_ = p.smtpServer.Close()
 		}
 
-		// 3. Close all tracked connections
-		p.connections.Range(func(key, value any) bool {
-			// Sessions will be cleaned up by Logout()
-			return true
-		})
+		// Stop answering ACME challenges
+		if p.acme != nil {
+			p.acme.stop(ctx)
+		}
+
+		// Stop accepting HTTP submissions
+		p.stopSendAPI(ctx)
+
+		// Push the messages already answered with 250
+		if p.delivery != nil {
+			p.delivery.stop(ctx)
+		}
+
+		if p.throughputKV != nil {
+			p.throughputKV.Stop()
+		}
+
+		// Health agent is closed last, balancers see "maint" while the rest shuts down
+		if p.healthListener != nil {
+			_ = p.healthListener.Close()
+		}
 
 		doneCh <- struct{}{}
 	}()
@@ -184,6 +470,11 @@ func (p *Plugin) Collects() []*dep.In {
 			p.jobs = pp.(Jobs)
 			p.log.Debug("collected jobs plugin")
 		}, (*Jobs)(nil)),
+		dep.Fits(func(pp any) {
+			// KV drivers (memory, redis, ...) for the cluster-wide throughput cap
+			c := pp.(kv.Constructor)
+			p.kvDrivers[c.Name()] = c
+		}, (*kv.Constructor)(nil)),
 	}
 }
 
@@ -192,6 +483,20 @@ func (p *Plugin) RPC() any {
 	return &rpc{p: p}
 }
 
+// deliver pushes the email to Jobs, records it for reports and notifies Tail readers
+func (p *Plugin) deliver(email *EmailData) error {
+	if err := p.pushToJobs(email); err != nil {
+		p.pushFailedAt.Store(time.Now().UnixNano())
+		return err
+	}
+	p.pushFailedAt.Store(0)
+
+	p.stats.accepted.Add(1)
+	p.history.record(email)
+	p.tail.publish(email)
+	return nil
+}
+
 // pushToJobs sends email as job to Jobs plugin
 func (p *Plugin) pushToJobs(email *EmailData) error {
 	const op = errors.Op("smtp_push_to_jobs")
@@ -201,10 +506,15 @@ func (p *Plugin) pushToJobs(email *EmailData) error {
 	}
 
 	// Convert to domain model
-	msg := emailToJobMessage(email, &p.cfg.Jobs)
+	msg, err := emailToJobMessage(email, &p.cfg.Jobs)
+	if err != nil {
+		return errors.E(op, err)
+	}
 
 	// Push directly to Jobs plugin
-	err := p.jobs.Push(context.Background(), msg)
+	pushStart := time.Now()
+	err = p.push(msg)
+	p.latency.observe(stagePush, time.Since(pushStart))
 	if err != nil {
 		return errors.E(op, err)
 	}
@@ -216,3 +526,110 @@ func (p *Plugin) pushToJobs(email *EmailData) error {
 
 	return nil
 }
+
+// push records the payload size of msg and pushes it to Jobs within the pipeline's push timeout
+func (p *Plugin) push(msg jobs.Message) error {
+	size := int64(len(msg.Payload()))
+	near, over := p.payloads.observe(msg.GroupID(), size)
+
+	switch {
+	case over:
+		p.log.Warn("job payload exceeds jobs.max_payload_size, the broker may refuse it",
+			zap.String("job", msg.ID()),
+			zap.String("pipeline", msg.GroupID()),
+			zap.Int64("size", size),
+			zap.Int64("limit", p.cfg.Jobs.MaxPayloadSize),
+		)
+	case near:
+		p.log.Warn("job payload approaching jobs.max_payload_size",
+			zap.String("job", msg.ID()),
+			zap.String("pipeline", msg.GroupID()),
+			zap.Int64("size", size),
+			zap.Int64("limit", p.cfg.Jobs.MaxPayloadSize),
+		)
+	}
+
+	ctx := context.Background()
+	if timeout := p.cfg.Jobs.pushTimeout(msg.GroupID()); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := p.jobs.Push(ctx, msg)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		p.stats.pushTimeouts.Add(1)
+		p.log.Warn("job push timed out",
+			zap.String("job", msg.ID()),
+			zap.String("pipeline", msg.GroupID()),
+			zap.Error(err),
+		)
+	}
+
+	return err
+}
+
+// closeConnection drops an active connection on admin request
+func (p *Plugin) closeConnection(uuid, closedBy, reason string) error {
+	const op = errors.Op("smtp_close_connection")
+
+	value, ok := p.connections.Load(uuid)
+	if !ok {
+		return errors.E(op, errors.Str("connection not found"))
+	}
+
+	session := value.(*Session)
+	info := session.info()
+
+	// Close underlying connection
+	if session.conn != nil && session.conn.Conn() != nil {
+		_ = session.conn.Conn().Close()
+	}
+
+	p.connections.Delete(uuid)
+
+	p.log.Info("connection closed by admin",
+		zap.String("uuid", uuid),
+		zap.String("remote_addr", info.RemoteAddr),
+		zap.String("closed_by", closedBy),
+		zap.String("reason", reason),
+	)
+
+	if !p.cfg.Jobs.NotifyAdminClose || p.jobs == nil {
+		return nil
+	}
+
+	event := &ConnectionClosedEvent{
+		Event:      "CONNECTION_CLOSED_BY_ADMIN",
+		UUID:       uuid,
+		RemoteAddr: info.RemoteAddr,
+		ClosedAt:   p.now(),
+		ClosedBy:   closedBy,
+		Reason:     reason,
+		From:       info.From,
+		To:         info.To,
+	}
+
+	// The connection is already gone, a failed notification is only logged
+	msg, err := closeEventToJobMessage(event, p.newID(), &p.cfg.Jobs)
+	if err == nil {
+		err = p.push(msg)
+	}
+	if err != nil {
+		p.log.Error("failed to push connection close event", zap.String("uuid", uuid), zap.Error(err))
+	}
+
+	return nil
+}
+
+// connectionInfos returns a snapshot of active SMTP connections
+func (p *Plugin) connectionInfos() []ConnectionInfo {
+	result := make([]ConnectionInfo, 0)
+
+	p.connections.Range(func(key, value any) bool {
+		result = append(result, value.(*Session).info())
+		return true
+	})
+
+	return result
+}
@@ -0,0 +1,71 @@
+package smtp
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// preflight verifies the environment before the server starts accepting traffic,
+// so misconfiguration is reported at startup instead of at the first message
+func (p *Plugin) preflight() error {
+	const op = errors.Op("smtp_preflight")
+
+	for _, addr := range p.cfg.Addr {
+		if network, path := listenNetwork(addr); network == "unix" {
+			if err := checkDirWritable(filepath.Dir(path)); err != nil {
+				return errors.E(op, errors.Errorf("addr %q: socket directory is not writable: %v", addr, err))
+			}
+			continue
+		}
+
+		if _, err := net.ResolveTCPAddr("tcp", addr); err != nil {
+			return errors.E(op, errors.Errorf("addr %q is not a valid listen address: %v", addr, err))
+		}
+	}
+
+	if p.cfg.TLS.SMTPSAddr != "" {
+		if _, err := net.ResolveTCPAddr("tcp", p.cfg.TLS.SMTPSAddr); err != nil {
+			return errors.E(op, errors.Errorf("tls.smtps_addr %q is not a valid listen address: %v", p.cfg.TLS.SMTPSAddr, err))
+		}
+	}
+
+	if p.cfg.AttachmentStorage.Mode == "tempfile" {
+		if err := checkDirWritable(p.cfg.AttachmentStorage.TempDir); err != nil {
+			return errors.E(op, errors.Errorf("attachment_storage.temp_dir %q is not writable: %v", p.cfg.AttachmentStorage.TempDir, err))
+		}
+	}
+
+	if p.cfg.TLS.ACME.Enabled {
+		if err := checkDirWritable(p.cfg.TLS.ACME.CacheDir); err != nil {
+			return errors.E(op, errors.Errorf("tls.acme.cache_dir %q is not writable: %v", p.cfg.TLS.ACME.CacheDir, err))
+		}
+	}
+
+	if p.cfg.TLS.hasFiles() {
+		if _, err := loadCertificate(p.cfg.TLS.Cert, p.cfg.TLS.Key); err != nil {
+			return errors.E(op, errors.Errorf("tls certificate is unusable: %v", err))
+		}
+	}
+
+	return nil
+}
+
+// checkDirWritable creates the directory if needed and probes it with a temp file
+func checkDirWritable(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".smtp-preflight-*")
+	if err != nil {
+		return err
+	}
+
+	name := f.Name()
+	_ = f.Close()
+
+	return os.Remove(name)
+}
@@ -0,0 +1,235 @@
+package smtp
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/api/v4/plugins/v1/kv"
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// tokenBucket is a classic token bucket refilled continuously at rate tokens per second
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes a token if one is available
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+
+	b.tokens--
+	return true
+}
+
+// messageRateMaxIPs bounds the per-IP buckets kept, idle full buckets are dropped first
+const messageRateMaxIPs = 10000
+
+// MessageRateConfig limits messages per minute from one client IP and in total
+type MessageRateConfig struct {
+	PerIP  float64 `mapstructure:"per_ip"` // 0 disables, Unix socket clients are not limited per IP
+	Global float64 `mapstructure:"global"` // 0 disables
+}
+
+// messageRateLimiter applies per-IP and global token buckets, each allowing a minute of traffic as burst
+type messageRateLimiter struct {
+	cfg    *MessageRateConfig
+	global *tokenBucket
+
+	mu    sync.Mutex
+	perIP map[string]*tokenBucket
+}
+
+func newMessageRateLimiter(cfg *MessageRateConfig) *messageRateLimiter {
+	l := &messageRateLimiter{
+		cfg:   cfg,
+		perIP: make(map[string]*tokenBucket),
+	}
+	if cfg.Global > 0 {
+		l.global = newTokenBucket(cfg.Global/60, int(math.Ceil(cfg.Global)))
+	}
+	return l
+}
+
+// allow takes a token from the client's bucket and the global one
+func (l *messageRateLimiter) allow(ip string) bool {
+	if l.cfg.PerIP > 0 && ip != "" && !l.bucket(ip).allow() {
+		return false
+	}
+
+	return l.global == nil || l.global.allow()
+}
+
+// bucket returns the bucket of ip, creating it on first use
+func (l *messageRateLimiter) bucket(ip string) *tokenBucket {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.perIP[ip]
+	if !ok {
+		if len(l.perIP) >= messageRateMaxIPs {
+			l.prune()
+		}
+		b = newTokenBucket(l.cfg.PerIP/60, int(math.Ceil(l.cfg.PerIP)))
+		l.perIP[ip] = b
+	}
+	return b
+}
+
+// prune drops buckets that have refilled completely, they behave like new ones.
+// When every client is active the map is reset. Caller must hold l.mu.
+func (l *messageRateLimiter) prune() {
+	now := time.Now()
+	for ip, b := range l.perIP {
+		b.mu.Lock()
+		full := b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+		b.mu.Unlock()
+		if full {
+			delete(l.perIP, ip)
+		}
+	}
+
+	if len(l.perIP) >= messageRateMaxIPs {
+		clear(l.perIP)
+	}
+}
+
+// throughputLimiter decides whether another transaction may start
+type throughputLimiter interface {
+	allow() bool
+}
+
+// kvWindowPrefix namespaces the shared throughput counters in the KV storage
+const kvWindowPrefix = "smtp:throughput:"
+
+// kvItem is a KV entry with an RFC 3339 expiry
+type kvItem struct {
+	key     string
+	value   []byte
+	timeout string
+}
+
+func (i *kvItem) Key() string     { return i.key }
+func (i *kvItem) Value() []byte   { return i.value }
+func (i *kvItem) Timeout() string { return i.timeout }
+
+// kvWindowLimiter shares a fixed-window counter between instances through a KV storage.
+// KV storages have no atomic increment, so concurrent instances may overshoot the
+// limit slightly within a window; KV failures let traffic through.
+type kvWindowLimiter struct {
+	mu      sync.Mutex
+	storage kv.Storage
+	window  time.Duration
+	limit   uint64
+	log     *zap.Logger
+}
+
+func newKVWindowLimiter(storage kv.Storage, rate float64, log *zap.Logger) *kvWindowLimiter {
+	// Rates below one per second count over a window long enough to admit one message
+	seconds := max(1, math.Ceil(1/rate))
+
+	return &kvWindowLimiter{
+		storage: storage,
+		window:  time.Duration(seconds) * time.Second,
+		limit:   uint64(max(1, math.Floor(rate*seconds))),
+		log:     log,
+	}
+}
+
+// allow counts the transaction in the current window unless the window is full
+func (l *kvWindowLimiter) allow() bool {
+	// Serializes this instance's read-modify-write, other instances may still race
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	start := now.Truncate(l.window)
+	key := kvWindowPrefix + strconv.FormatInt(start.Unix(), 10)
+
+	raw, err := l.storage.Get(key)
+	if err != nil {
+		l.log.Warn("throughput kv read failed, allowing transaction", zap.Error(err))
+		return true
+	}
+
+	var count uint64
+	if len(raw) > 0 {
+		count, _ = strconv.ParseUint(string(raw), 10, 64)
+	}
+	if count >= l.limit {
+		return false
+	}
+
+	err = l.storage.Set(&kvItem{
+		key:   key,
+		value: []byte(strconv.FormatUint(count+1, 10)),
+		// Keep the counter one extra window for instances with a skewed clock
+		timeout: start.Add(2 * l.window).Format(time.RFC3339),
+	})
+	if err != nil {
+		l.log.Warn("throughput kv write failed", zap.Error(err))
+	}
+
+	return true
+}
+
+// kvConfigKey is the config section of a storage declared under kv
+func kvConfigKey(storage string) string {
+	return "kv." + storage
+}
+
+// initThroughputKV opens the KV storage backing the cluster-wide throughput cap
+func (p *Plugin) initThroughputKV() error {
+	const op = errors.Op("smtp_throughput_kv")
+
+	driver, ok := p.kvDrivers[p.throughputKVDrv]
+	if !ok {
+		return errors.E(op, errors.Errorf("kv driver %q for storage %q is not available", p.throughputKVDrv, p.cfg.Throughput.KV))
+	}
+
+	storage, err := driver.KvFromConfig(kvConfigKey(p.cfg.Throughput.KV))
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	p.throughputKV = storage
+	p.throughput = newKVWindowLimiter(storage, p.cfg.Throughput.MessagesPerSecond, p.log)
+
+	p.log.Info("throughput cap shared through kv",
+		zap.String("storage", p.cfg.Throughput.KV),
+		zap.String("driver", p.throughputKVDrv),
+	)
+
+	return nil
+}
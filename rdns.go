@@ -0,0 +1,64 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ReverseDNSConfig looks up the PTR name of every client
+type ReverseDNSConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Longest a message waits for the lookup, default 2s
+	Timeout time.Duration `mapstructure:"timeout"`
+}
+
+func (r *ReverseDNSConfig) initDefaults() {
+	if r.Timeout == 0 {
+		r.Timeout = 2 * time.Second
+	}
+}
+
+// ptrLookup is a reverse lookup running alongside the session
+type ptrLookup struct {
+	done chan struct{}
+	name string // without the trailing dot, empty when the IP has none
+}
+
+// startReverseDNS looks up the client's PTR name in the background,
+// so the session is not held up by a slow resolver
+func (s *Session) startReverseDNS() {
+	cfg := &s.backend.plugin.cfg.ReverseDNS
+	if !cfg.Enabled || s.remoteIP == "" {
+		return
+	}
+
+	lookup := &ptrLookup{done: make(chan struct{})}
+	s.ptr = lookup
+
+	go func() {
+		defer close(lookup.done)
+
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+		defer cancel()
+
+		names, err := net.DefaultResolver.LookupAddr(ctx, s.remoteIP)
+		if err != nil || len(names) == 0 {
+			s.log.Debug("reverse DNS lookup failed", zap.Error(err))
+			return
+		}
+		lookup.name = strings.TrimSuffix(names[0], ".")
+	}()
+}
+
+// reverseDNS returns the client's PTR name, waiting at most reverse_dns.timeout for it
+func (s *Session) reverseDNS() string {
+	if s.ptr == nil {
+		return ""
+	}
+	<-s.ptr.done
+	return s.ptr.name
+}
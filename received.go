@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"strings"
+	"time"
+)
+
+// receivedHeader builds the Received: trace header a real MTA would prepend (RFC 5321
+// section 4.4), for the message the session is receiving under the given queue ID
+func (s *Session) receivedHeader(queueID string, at time.Time) []byte {
+	p := s.backend.plugin
+
+	helo := s.heloName
+	if helo == "" {
+		helo = "unknown"
+	}
+
+	var b strings.Builder
+	b.WriteString("Received: from " + helo + " (")
+	if name := s.reverseDNS(); name != "" {
+		b.WriteString(name + " ")
+	}
+	b.WriteString("[" + s.remoteIP + "])\r\n")
+
+	// RFC 3848 protocol names; HELO and EHLO sessions look alike to go-smtp, ESMTP is assumed
+	with := "ESMTP"
+	if state, ok := s.connectionState(); ok {
+		with += "S"
+		b.WriteString("\t(using " + tls.VersionName(state.Version) + " with cipher " + tls.CipherSuiteName(state.CipherSuite) + ")\r\n")
+	}
+	if s.authenticated {
+		with += "A"
+	}
+
+	b.WriteString("\tby " + p.cfg.Hostname + " with " + with + " id " + queueID)
+	if len(s.to) == 1 {
+		b.WriteString("\r\n\tfor <" + s.to[0] + ">")
+	}
+	b.WriteString("; " + at.Format(time.RFC1123Z) + "\r\n")
+
+	return []byte(b.String())
+}
+
+// withReceivedHeader prepends the Received: header to the raw message
+func (s *Session) withReceivedHeader(raw []byte, queueID string, at time.Time) []byte {
+	header := s.receivedHeader(queueID, at)
+	return bytes.Join([][]byte{header, raw}, nil)
+}
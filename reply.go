@@ -0,0 +1,50 @@
+package smtp
+
+import (
+	"regexp"
+	"strings"
+)
+
+var (
+	// "On Mon, 1 Jan 2024 at 10:00, Jane <jane@example.com> wrote:", possibly wrapped over two lines
+	replyHeaderRe = regexp.MustCompile(`(?is)^on\b.{0,200}\bwrote:\s*$`)
+	// Outlook and Apple Mail separators
+	replySeparatorRe = regexp.MustCompile(`(?i)^(-{2,}\s*original message\s*-{2,}|-{2,}\s*forwarded message\s*-{2,}|_{20,}|begin forwarded message:)$`)
+	// Mobile client footers
+	replySignatureRe = regexp.MustCompile(`(?i)^(sent from my \w+|get outlook for \w+)`)
+	// A quoted header block as left by Outlook: "From: ..." followed by "Sent:" or "Date:"
+	replyFromRe = regexp.MustCompile(`(?i)^from:\s+\S`)
+	replyDateRe = regexp.MustCompile(`(?i)^(sent|date):\s+\S`)
+)
+
+// extractReply returns the latest reply of a text body without quoted history and signature
+func extractReply(body string) string {
+	lines := strings.Split(strings.ReplaceAll(body, "\r\n", "\n"), "\n")
+
+	cut := len(lines)
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, ">") ||
+			line == "-- " || trimmed == "--" ||
+			replySeparatorRe.MatchString(trimmed) ||
+			replySignatureRe.MatchString(trimmed) ||
+			replyHeaderRe.MatchString(trimmed) {
+			cut = i
+			break
+		}
+
+		// Mail clients wrap long attribution lines
+		if i+1 < len(lines) && replyHeaderRe.MatchString(trimmed+" "+strings.TrimSpace(lines[i+1])) {
+			cut = i
+			break
+		}
+
+		if i+1 < len(lines) && replyFromRe.MatchString(trimmed) && replyDateRe.MatchString(strings.TrimSpace(lines[i+1])) {
+			cut = i
+			break
+		}
+	}
+
+	return strings.TrimSpace(strings.Join(lines[:cut], "\n"))
+}
@@ -0,0 +1,210 @@
+package smtp
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+	"github.com/roadrunner-server/errors"
+)
+
+// Response keys, usable in the `responses` config section to override message text
+const (
+	respReadFailed         = "read_failed"
+	respParseFailed        = "parse_failed"
+	respPushFailed         = "push_failed"
+	respEarlyTalker        = "early_talker"
+	respThrottled          = "throttled"
+	respTooLarge           = "too_large"
+	respTooManyRcpts       = "too_many_recipients"
+	respBadSender          = "bad_sender_syntax"
+	respBadRcpt            = "bad_recipient_syntax"
+	respAuthFailed         = "auth_failed"
+	respAuthRequired       = "auth_required"
+	respEncryptionRequired = "encryption_required"
+	respHeloTooLong        = "helo_too_long"
+	respArgTooLong         = "argument_too_long"
+	respTooManyConns       = "too_many_connections"
+	respTooBusy            = "too_busy"
+	respRateLimited        = "rate_limited"
+	respBanned             = "banned"
+	respAccepted           = "accepted"
+	respChaosTempfail      = "chaos_tempfail"
+	respChaosReject        = "chaos_reject"
+	respQueueFull          = "queue_full"
+	respBackpressure       = "backpressure"
+	respShuttingDown       = "shutting_down"
+)
+
+// defaultResponses holds the code, enhanced code and default text for every rejection,
+// and for the acceptance of a message
+var defaultResponses = map[string]smtp.SMTPError{
+	respAccepted: {
+		Code:         250,
+		EnhancedCode: smtp.EnhancedCode{2, 0, 0},
+		Message:      "OK: queued", // go-smtp's own text
+	},
+	respReadFailed: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 4, 2},
+		Message:      "Failed to read message",
+	},
+	respParseFailed: {
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "Failed to parse message",
+	},
+	respPushFailed: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Temporary failure, try again later",
+	},
+	respEarlyTalker: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Protocol violation: data sent before greeting",
+	},
+	respThrottled: {
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Server busy, try again later",
+	},
+	respTooLarge: {
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Maximum message size exceeded",
+	},
+	respTooManyRcpts: {
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients",
+	},
+	respBadSender: {
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 7},
+		Message:      "Bad sender address syntax",
+	},
+	respBadRcpt: {
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 3},
+		Message:      "Bad recipient address syntax",
+	},
+	respAuthFailed: {
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Authentication credentials invalid",
+	},
+	respAuthRequired: {
+		Code:         530,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 0},
+		Message:      "Authentication required",
+	},
+	respEncryptionRequired: {
+		Code:         538,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 11},
+		Message:      "Encryption required for requested authentication mechanism",
+	},
+	respHeloTooLong: {
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 2},
+		Message:      "HELO/EHLO argument too long",
+	},
+	respArgTooLong: {
+		Code:         501,
+		EnhancedCode: smtp.EnhancedCode{5, 5, 4},
+		Message:      "Argument too long",
+	},
+	respTooManyConns: {
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many connections from your IP, try again later",
+	},
+	respTooBusy: {
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Too busy, try again later",
+	},
+	respRateLimited: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Rate limit exceeded, try again later",
+	},
+	respBanned: {
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many errors from your IP, try again later",
+	},
+	respChaosTempfail: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Injected temporary failure",
+	},
+	respChaosReject: {
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 0},
+		Message:      "Injected permanent failure",
+	},
+	respQueueFull: {
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Delivery queue full, try again later",
+	},
+	respBackpressure: {
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 1},
+		Message:      "Delivery backlog, try again later",
+	},
+	respShuttingDown: {
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Service shutting down, try again later",
+	},
+}
+
+// smtpError returns the rejection for the key with the configured message text
+func (p *Plugin) smtpError(key string) *smtp.SMTPError {
+	resp := defaultResponses[key]
+	if msg, ok := p.cfg.Responses[key]; ok && msg != "" {
+		resp.Message = msg
+	}
+	return &resp
+}
+
+// acceptedReply returns the 250 reply for a delivered message, expanding {uuid} (message UUID),
+// {queue_id}, {session} (connection UUID), {seq} and {hostname} in its text
+func (p *Plugin) acceptedReply(email *EmailData) *smtp.SMTPError {
+	resp := p.smtpError(respAccepted)
+	resp.Message = strings.NewReplacer(
+		"{uuid}", email.MessageUUID,
+		"{queue_id}", email.QueueID,
+		"{session}", email.UUID,
+		"{seq}", strconv.FormatUint(email.Seq, 10),
+		"{hostname}", p.cfg.Hostname,
+	).Replace(resp.Message)
+	return resp
+}
+
+// queueID derives a Postfix-style queue ID, 10 uppercase hex digits, from a message UUID
+func queueID(messageUUID string) string {
+	id := strings.ToUpper(strings.ReplaceAll(messageUUID, "-", ""))
+	if len(id) > 10 {
+		id = id[:10]
+	}
+	return id
+}
+
+// validateResponses rejects overrides for unknown response keys
+func validateResponses(responses map[string]string) error {
+	for key := range responses {
+		if _, ok := defaultResponses[key]; !ok {
+			known := make([]string, 0, len(defaultResponses))
+			for k := range defaultResponses {
+				known = append(known, k)
+			}
+			sort.Strings(known)
+			return errors.Errorf("unknown responses key %q, expected one of: %s", key, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
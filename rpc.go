@@ -1,7 +1,18 @@
 package smtp
 
 import (
+	"regexp"
+	"time"
+
 	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultTailTimeout is used when the request timeout is not set
+	defaultTailTimeout = 30 * time.Second
+	// maxTailTimeout caps how long a single long-poll call may block
+	maxTailTimeout = 5 * time.Minute
 )
 
 // ConnectionInfo represents information about an active SMTP connection
@@ -14,50 +25,288 @@ type ConnectionInfo struct {
 	Username      string   `json:"username"`
 }
 
+// TailRequest is a long-poll request for new messages
+type TailRequest struct {
+	Filter TailFilter `json:"filter"`
+	// Cursor from the previous TailResponse, 0 starts from now
+	Cursor uint64 `json:"cursor"`
+	// Timeout in milliseconds to wait for a matching message
+	Timeout int64 `json:"timeout_ms"`
+}
+
+// TailResponse carries matching messages and the cursor for the next call
+type TailResponse struct {
+	Cursor   uint64       `json:"cursor"`
+	Messages []*EmailData `json:"messages"`
+}
+
+// ExpectResponse carries the expected message and the cursor for the next call
+type ExpectResponse struct {
+	Cursor  uint64     `json:"cursor"`
+	Message *EmailData `json:"message"`
+}
+
+// ExpectRequest describes the message a test waits for
+type ExpectRequest struct {
+	Filter TailFilter `json:"filter"`
+	// Body is a regular expression matched against text and HTML bodies
+	Body string `json:"body"`
+	// Cursor from a previous Tail/ExpectMessage call, 0 waits only for new messages
+	Cursor uint64 `json:"cursor"`
+	// Timeout in milliseconds to wait for the message
+	Timeout int64 `json:"timeout_ms"`
+}
+
 // rpc provides RPC interface for external management
 type rpc struct {
 	p *Plugin
 }
 
+// CloseRequest closes a connection and records who asked and why
+type CloseRequest struct {
+	UUID     string `json:"uuid"`
+	ClosedBy string `json:"closed_by"`
+	Reason   string `json:"reason"`
+}
+
 // CloseConnection closes SMTP connection by UUID
 func (r *rpc) CloseConnection(uuid string, success *bool) error {
+	return r.CloseConnectionWithReason(CloseRequest{UUID: uuid, ClosedBy: "rpc"}, success)
+}
+
+// CloseConnectionWithReason closes SMTP connection by UUID, notifying the consumer when enabled
+func (r *rpc) CloseConnectionWithReason(req CloseRequest, success *bool) error {
 	*success = false
 
-	value, ok := r.p.connections.Load(uuid)
+	if err := r.p.closeConnection(req.UUID, req.ClosedBy, req.Reason); err != nil {
+		return err
+	}
+
+	*success = true
+	return nil
+}
+
+// ListConnections returns active SMTP connections
+func (r *rpc) ListConnections(_ bool, connections *[]ConnectionInfo) error {
+	*connections = r.p.connectionInfos()
+	return nil
+}
+
+// Tail blocks until messages matching the filter arrive after the cursor or the timeout expires
+func (r *rpc) Tail(req TailRequest, resp *TailResponse) error {
+	filter := req.Filter.normalized(r.p)
+	resp.Messages, resp.Cursor = r.wait(req.Cursor, req.Timeout, false, filter.matches)
+	return nil
+}
+
+// ExpectMessage blocks until a message matching the request arrives and returns it
+// with the cursor right after it, so the next call doesn't miss later messages
+func (r *rpc) ExpectMessage(req ExpectRequest, resp *ExpectResponse) error {
+	const op = errors.Op("smtp_rpc_expect_message")
+
+	var body *regexp.Regexp
+	if req.Body != "" {
+		var err error
+		body, err = regexp.Compile(req.Body)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
+	filter := req.Filter.normalized(r.p)
+	matches := func(e *EmailData) bool {
+		if !filter.matches(e) {
+			return false
+		}
+		return body == nil || body.MatchString(e.Message.TextBody) || body.MatchString(e.Message.HTMLBody)
+	}
+
+	found, cursor := r.wait(req.Cursor, req.Timeout, true, matches)
+	if len(found) == 0 {
+		return errors.E(op, errors.Str("no matching message received within timeout"))
+	}
+
+	resp.Cursor, resp.Message = cursor, found[0]
+	return nil
+}
+
+// wait long-polls the tail hub for messages accepted by match, returning as soon as
+// at least one is found (only the first one when first is set) or the timeout expires.
+// The cursor returned with the first match points at that message, not past the batch
+func (r *rpc) wait(cursor uint64, timeoutMs int64, first bool, match func(*EmailData) bool) ([]*EmailData, uint64) {
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultTailTimeout
+	}
+	if timeout > maxTailTimeout {
+		timeout = maxTailTimeout
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	if cursor == 0 {
+		_, cursor, _ = r.p.tail.since(0)
+	}
+
+	result := make([]*EmailData, 0)
+
+	for {
+		emails, latest, notify := r.p.tail.since(cursor)
+		cursor = latest
+
+		for i, email := range emails {
+			if match(email) {
+				result = append(result, email)
+				if first {
+					// The buffer holds consecutive sequence numbers ending at latest
+					return result, latest - uint64(len(emails)-1-i)
+				}
+			}
+		}
+
+		if len(result) > 0 {
+			return result, cursor
+		}
+
+		select {
+		case <-notify:
+		case <-timer.C:
+			return result, cursor
+		}
+	}
+}
+
+// ExportState writes a diagnostic archive for bug reports
+func (r *rpc) ExportState(req ExportRequest, success *bool) error {
+	*success = false
+
+	if err := r.p.exportState(req); err != nil {
+		return err
+	}
+
+	*success = true
+	return nil
+}
+
+// TLSCertificate returns details about the served STARTTLS certificate (file or self-signed)
+func (r *rpc) TLSCertificate(_ bool, info *CertificateInfo) error {
+	cert, ok := r.p.certificateInfo()
 	if !ok {
-		return errors.Str("connection not found")
+		return errors.Str("tls certificate is not available")
 	}
 
-	session := value.(*Session)
+	*info = cert
+	return nil
+}
+
+// ImportFile parses an .eml or mbox file, or a Maildir or MailHog maildir directory,
+// and optionally delivers its messages
+func (r *rpc) ImportFile(req ImportRequest, resp *ImportResponse) error {
+	return r.p.importFile(req, resp)
+}
+
+// Stats returns plugin counters
+func (r *rpc) Stats(_ bool, stats *Stats) error {
+	*stats = r.p.statsSnapshot()
+	return nil
+}
+
+// SenderStats returns per-sender baselines, busiest sender first
+func (r *rpc) SenderStats(_ bool, stats *[]SenderStat) error {
+	if r.p.senders == nil {
+		return errors.Str("sender alerts are disabled")
+	}
+
+	*stats = r.p.senders.snapshot()
+	return nil
+}
+
+// ClientUsage reports the commands and extensions each client (HELO name and IP) uses,
+// busiest client first
+func (r *rpc) ClientUsage(_ bool, usage *[]ClientUsage) error {
+	*usage = r.p.clients.snapshot()
+	return nil
+}
+
+// Bans lists client IPs currently banned by limits.ban
+func (r *rpc) Bans(_ bool, bans *[]Ban) error {
+	*bans = r.p.activeBans()
+	return nil
+}
+
+// ClearBans lifts the ban of an IP, or every ban when ip is empty, and reports how many were lifted
+func (r *rpc) ClearBans(ip string, lifted *int) error {
+	*lifted = 0
+	if r.p.bans != nil {
+		*lifted = r.p.bans.clear(ip)
+	}
+	return nil
+}
 
-	// Close underlying connection
-	if session.conn != nil && session.conn.Conn() != nil {
-		_ = session.conn.Conn().Close()
+// SetClientBehavior makes the server tempfail, drop after DATA or answer slowly for one
+// client IP, behavior "normal" restores it
+func (r *rpc) SetClientBehavior(req ClientBehaviorRequest, success *bool) error {
+	*success = false
+	if err := r.p.behaviors.set(req); err != nil {
+		return err
 	}
 
-	r.p.connections.Delete(uuid)
+	r.p.log.Info("client behavior set",
+		zap.String("ip", req.IP),
+		zap.String("behavior", req.Behavior),
+	)
 	*success = true
+	return nil
+}
 
+// ClientBehaviors lists the behaviors set by SetClientBehavior
+func (r *rpc) ClientBehaviors(_ bool, behaviors *[]ClientBehavior) error {
+	*behaviors = r.p.behaviors.list()
 	return nil
 }
 
-// ListConnections returns active SMTP connections
-func (r *rpc) ListConnections(_ bool, connections *[]ConnectionInfo) error {
-	result := make([]ConnectionInfo, 0)
-
-	r.p.connections.Range(func(key, value any) bool {
-		session := value.(*Session)
-		result = append(result, ConnectionInfo{
-			UUID:          session.uuid,
-			RemoteAddr:    session.remoteAddr,
-			From:          session.from,
-			To:            session.to,
-			Authenticated: session.authenticated,
-			Username:      session.authUsername,
-		})
-		return true
-	})
-
-	*connections = result
+// Transcript returns the SMTP dialogue of an active connection so far, with transcript.enabled
+func (r *rpc) Transcript(uuid string, transcript *string) error {
+	const op = errors.Op("smtp_rpc_transcript")
+
+	value, ok := r.p.connections.Load(uuid)
+	if !ok {
+		return errors.E(op, errors.Str("connection not found"))
+	}
+
+	session := value.(*Session)
+	if session.transcript == nil {
+		return errors.E(op, errors.Str("transcript is not enabled or not available for this listener"))
+	}
+
+	*transcript = session.transcriptText()
+	return nil
+}
+
+// DuplicateReport lists messages sent more than once within the window, grouped by sender
+func (r *rpc) DuplicateReport(req DuplicateRequest, groups *[]DuplicateGroup) error {
+	window := time.Duration(req.Window) * time.Millisecond
+	if window <= 0 {
+		window = defaultReportWindow
+	}
+
+	*groups = r.p.history.duplicates(window)
+	return nil
+}
+
+// AttachmentReport lists the most common attachment contents within the window
+func (r *rpc) AttachmentReport(req AttachmentReportRequest, hashes *[]AttachmentHashCount) error {
+	window := time.Duration(req.Window) * time.Millisecond
+	if window <= 0 {
+		window = defaultReportWindow
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultAttachmentReportLimit
+	}
+
+	*hashes = r.p.history.attachmentHashes(window, limit)
 	return nil
 }
@@ -0,0 +1,42 @@
+package smtp
+
+import (
+	"testing"
+)
+
+// TestExpectMessageCursor checks that a second ExpectMessage call picks up a match
+// published in the same batch as the first one
+func TestExpectMessageCursor(t *testing.T) {
+	p := &Plugin{tail: newTailHub()}
+	r := &rpc{p: p}
+
+	publish := func(subject string) {
+		email := &EmailData{}
+		email.Message.Subject = subject
+		p.tail.publish(email)
+	}
+	publish("before")
+	for _, subject := range []string{"invoice 1", "welcome", "invoice 2"} {
+		publish(subject)
+	}
+
+	req := ExpectRequest{Filter: TailFilter{Subject: "invoice*"}, Cursor: 1, Timeout: 100}
+	for _, want := range []struct {
+		subject string
+		cursor  uint64
+	}{{"invoice 1", 2}, {"invoice 2", 4}} {
+		var resp ExpectResponse
+		if err := r.ExpectMessage(req, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.Message.Message.Subject != want.subject || resp.Cursor != want.cursor {
+			t.Fatalf("got %q at %d, want %q at %d", resp.Message.Message.Subject, resp.Cursor, want.subject, want.cursor)
+		}
+		req.Cursor = resp.Cursor
+	}
+
+	var resp ExpectResponse
+	if err := r.ExpectMessage(req, &resp); err == nil {
+		t.Fatalf("unexpected %q after the last match", resp.Message.Message.Subject)
+	}
+}
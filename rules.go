@@ -0,0 +1,320 @@
+package smtp
+
+import (
+	"fmt"
+	"mime"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// Rule actions
+const (
+	ruleAccept   = "accept"
+	ruleTempfail = "tempfail"
+	ruleReject   = "reject"
+	ruleDelay    = "delay"
+)
+
+// Stages a rule is evaluated at, the earliest one where all its conditions are known
+const (
+	ruleStageMail = "MAIL"
+	ruleStageRcpt = "RCPT"
+	ruleStageData = "DATA"
+)
+
+// RuleConfig matches transactions and decides how to answer them. Every set condition
+// has to match. Rules are evaluated in order and the first accept, tempfail or reject wins;
+// delay waits and goes on with the next rule.
+type RuleConfig struct {
+	Name string `mapstructure:"name"`
+
+	From    string `mapstructure:"from"`     // regex on MAIL FROM
+	To      string `mapstructure:"to"`       // regex on RCPT TO, at DATA any recipient may match
+	Subject string `mapstructure:"subject"`  // regex on the decoded Subject
+	MinSize int64  `mapstructure:"min_size"` // message bytes, 0 disables
+	MaxSize int64  `mapstructure:"max_size"` // message bytes, 0 disables
+
+	// Expression over the transaction, see expr.go, e.g. "count % 3 == 0" fails every third match
+	When string `mapstructure:"when"`
+	// "MAIL", "RCPT" or "DATA" to evaluate later than the conditions require
+	Stage string `mapstructure:"stage"`
+
+	// "accept" skips the remaining rules for the transaction, "tempfail", "reject" or "delay"
+	Action string `mapstructure:"action"`
+	// Reply for tempfail (4xx, default 451 4.7.1) and reject (5xx, default 550 5.7.1)
+	Code         int    `mapstructure:"code"`
+	EnhancedCode string `mapstructure:"enhanced_code"` // e.g. "5.1.1"
+	Message      string `mapstructure:"message"`
+	// Wait of the delay action
+	Delay time.Duration `mapstructure:"delay"`
+}
+
+// rule is a compiled RuleConfig
+type rule struct {
+	cfg     RuleConfig
+	stage   string
+	from    *regexp.Regexp
+	to      *regexp.Regexp
+	subject *regexp.Regexp
+	when    exprNode
+	reply   *smtp.SMTPError // tempfail and reject
+	matches atomic.Uint64
+	// Times the other conditions held and when was evaluated, the count variable
+	evaluated atomic.Int64
+}
+
+// ruleVars are the variables of rules.when; rcpt is only known at RCPT, subject and size at DATA
+var ruleVars = []string{
+	"stage", "from", "to", "rcpt", "subject", "size", "seq", "count",
+	"remote_ip", "helo", "authenticated", "username", "inbox", "tls",
+}
+
+// ruleStages in transaction order
+var ruleStages = []string{ruleStageMail, ruleStageRcpt, ruleStageData}
+
+// compileRules checks and compiles the rules section
+func compileRules(configs []RuleConfig) ([]*rule, error) {
+	const op = errors.Op("smtp_rules_compile")
+
+	rules := make([]*rule, 0, len(configs))
+	for i, cfg := range configs {
+		if cfg.Name == "" {
+			cfg.Name = "rule" + strconv.Itoa(i+1)
+		}
+
+		r := &rule{cfg: cfg, stage: ruleStageMail}
+		var err error
+		if r.from, err = compileRuleRegexp(cfg.From); err != nil {
+			return nil, errors.E(op, errors.Errorf("rules %s: from: %v", cfg.Name, err))
+		}
+		if r.to, err = compileRuleRegexp(cfg.To); err != nil {
+			return nil, errors.E(op, errors.Errorf("rules %s: to: %v", cfg.Name, err))
+		}
+		if r.subject, err = compileRuleRegexp(cfg.Subject); err != nil {
+			return nil, errors.E(op, errors.Errorf("rules %s: subject: %v", cfg.Name, err))
+		}
+
+		var whenVars []string
+		if cfg.When != "" {
+			if r.when, err = parseExpr(cfg.When, ruleVars); err != nil {
+				return nil, errors.E(op, errors.Errorf("rules %s: when: %v", cfg.Name, err))
+			}
+			whenVars = exprVars(r.when)
+		}
+
+		if r.to != nil || slices.Contains(whenVars, "rcpt") {
+			r.stage = ruleStageRcpt
+		}
+		if r.subject != nil || cfg.MinSize > 0 || cfg.MaxSize > 0 ||
+			slices.Contains(whenVars, "subject") || slices.Contains(whenVars, "size") {
+			r.stage = ruleStageData
+		}
+
+		if cfg.Stage != "" {
+			stage := strings.ToUpper(cfg.Stage)
+			if !slices.Contains(ruleStages, stage) {
+				return nil, errors.E(op, errors.Errorf("rules %s: stage must be MAIL, RCPT or DATA, got %q", cfg.Name, cfg.Stage))
+			}
+			if slices.Index(ruleStages, stage) < slices.Index(ruleStages, r.stage) {
+				return nil, errors.E(op, errors.Errorf("rules %s: conditions are only known at %s, not at %s", cfg.Name, r.stage, stage))
+			}
+			if stage != ruleStageRcpt && slices.Contains(whenVars, "rcpt") {
+				return nil, errors.E(op, errors.Errorf("rules %s: rcpt is only known at RCPT", cfg.Name))
+			}
+			r.stage = stage
+		}
+
+		if cfg.MinSize < 0 || cfg.MaxSize < 0 || (cfg.MaxSize > 0 && cfg.MinSize > cfg.MaxSize) {
+			return nil, errors.E(op, errors.Errorf("rules %s: invalid size range", cfg.Name))
+		}
+
+		switch cfg.Action {
+		case ruleAccept:
+		case ruleDelay:
+			if cfg.Delay <= 0 {
+				return nil, errors.E(op, errors.Errorf("rules %s: delay action requires delay", cfg.Name))
+			}
+		case ruleTempfail, ruleReject:
+			if r.reply, err = ruleReply(cfg); err != nil {
+				return nil, errors.E(op, errors.Errorf("rules %s: %v", cfg.Name, err))
+			}
+		default:
+			return nil, errors.E(op, errors.Errorf("rules %s: action must be accept, tempfail, reject or delay, got %q", cfg.Name, cfg.Action))
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+func compileRuleRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+// ruleReply builds the SMTP reply of a tempfail or reject rule
+func ruleReply(cfg RuleConfig) (*smtp.SMTPError, error) {
+	class := 4
+	reply := &smtp.SMTPError{Code: 451, EnhancedCode: smtp.EnhancedCode{4, 7, 1}, Message: "Temporarily rejected by policy"}
+	if cfg.Action == ruleReject {
+		class = 5
+		reply = &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Rejected by policy"}
+	}
+
+	if cfg.Code != 0 {
+		if cfg.Code/100 != class || cfg.Code%100 > 59 {
+			return nil, errors.Errorf("%s code must be %dxx, got %d", cfg.Action, class, cfg.Code)
+		}
+		reply.Code = cfg.Code
+	}
+
+	if cfg.EnhancedCode != "" {
+		var code smtp.EnhancedCode
+		if _, err := fmt.Sscanf(cfg.EnhancedCode, "%d.%d.%d", &code[0], &code[1], &code[2]); err != nil || code[0] != class {
+			return nil, errors.Errorf("enhanced_code must look like %d.x.y, got %q", class, cfg.EnhancedCode)
+		}
+		reply.EnhancedCode = code
+	}
+
+	if cfg.Message != "" {
+		reply.Message = cfg.Message
+	}
+
+	return reply, nil
+}
+
+// ruleInput is what is known about the transaction at a stage
+type ruleInput struct {
+	from    string
+	to      []string // the recipient being added at RCPT, all of them at DATA
+	subject string
+	size    int64
+}
+
+// whenEnv returns the variables of rules.when for the stage
+func (s *Session) whenEnv(stage string, in *ruleInput, count int64) map[string]any {
+	_, tls := s.connectionState()
+
+	env := map[string]any{
+		"stage":         stage,
+		"from":          in.from,
+		"to":            s.to,
+		"seq":           int64(s.seq + 1), // the message being received
+		"count":         count,
+		"remote_ip":     s.remoteIP,
+		"helo":          s.heloName,
+		"authenticated": s.authenticated,
+		"username":      s.authUsername,
+		"inbox":         s.inbox,
+		"tls":           tls,
+	}
+
+	switch stage {
+	case ruleStageRcpt:
+		env["rcpt"] = in.to[0]
+		env["to"] = append(slices.Clone(s.to), in.to[0])
+	case ruleStageData:
+		env["subject"] = in.subject
+		env["size"] = in.size
+	}
+
+	return env
+}
+
+// match reports whether every condition of the rule holds
+func (r *rule) match(in *ruleInput) bool {
+	if r.from != nil && !r.from.MatchString(in.from) {
+		return false
+	}
+	if r.to != nil && !slices.ContainsFunc(in.to, r.to.MatchString) {
+		return false
+	}
+	if r.subject != nil && !r.subject.MatchString(in.subject) {
+		return false
+	}
+	if r.cfg.MinSize > 0 && in.size < r.cfg.MinSize {
+		return false
+	}
+	if r.cfg.MaxSize > 0 && in.size > r.cfg.MaxSize {
+		return false
+	}
+	return true
+}
+
+// applyRules evaluates the rules of the stage, returning the reply of a tempfail or reject
+func (s *Session) applyRules(stage string, in *ruleInput) error {
+	for _, r := range s.backend.plugin.cfg.rules {
+		if s.rulesAccepted {
+			return nil
+		}
+		if r.stage != stage || !r.match(in) {
+			continue
+		}
+
+		if r.when != nil {
+			ok, err := evalBool(r.when, s.whenEnv(stage, in, r.evaluated.Add(1)))
+			if err != nil {
+				s.log.Warn("rule expression failed, rule skipped", zap.String("rule", r.cfg.Name), zap.Error(err))
+				continue
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		r.matches.Add(1)
+		s.rulesMatched = true
+		s.log.Info("rule matched",
+			zap.String("rule", r.cfg.Name),
+			zap.String("action", r.cfg.Action),
+			zap.String("stage", stage),
+		)
+
+		switch r.cfg.Action {
+		case ruleAccept:
+			s.rulesAccepted = true
+		case ruleDelay:
+			time.Sleep(r.cfg.Delay)
+		default:
+			return r.reply
+		}
+	}
+
+	return nil
+}
+
+// ruleMatches returns how often each rule matched, by name
+func (p *Plugin) ruleMatches() map[string]uint64 {
+	if len(p.cfg.rules) == 0 {
+		return nil
+	}
+
+	matches := make(map[string]uint64, len(p.cfg.rules))
+	for _, r := range p.cfg.rules {
+		matches[r.cfg.Name] += r.matches.Load()
+	}
+	return matches
+}
+
+// decodedSubject returns the Subject with RFC 2047 encoded words decoded
+func decodedSubject(subject string) string {
+	if !strings.Contains(subject, "=?") {
+		return subject
+	}
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil {
+		return subject
+	}
+	return decoded
+}
@@ -0,0 +1,198 @@
+package smtp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"go.uber.org/zap"
+)
+
+// ruleSession returns a session of a plugin running the given rules
+func ruleSession(t *testing.T, configs ...RuleConfig) *Session {
+	t.Helper()
+
+	rules, err := compileRules(configs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &Plugin{cfg: &Config{rules: rules}, log: zap.NewNop()}
+	return &Session{backend: &Backend{plugin: p, log: p.log}, log: p.log}
+}
+
+// ruleReplyOf returns the SMTP reply of a rule outcome, nil when the transaction goes on
+func ruleReplyOf(t *testing.T, err error) *smtp.SMTPError {
+	t.Helper()
+
+	if err == nil {
+		return nil
+	}
+	var reply *smtp.SMTPError
+	if !errors.As(err, &reply) {
+		t.Fatalf("rule returned %v, not an SMTP reply", err)
+	}
+	return reply
+}
+
+func TestCompileRules(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   RuleConfig
+		stage string
+		err   string
+	}{
+		{name: "from", cfg: RuleConfig{From: "@example", Action: ruleReject}, stage: ruleStageMail},
+		{name: "to", cfg: RuleConfig{To: "@example", Action: ruleReject}, stage: ruleStageRcpt},
+		{name: "rcpt in when", cfg: RuleConfig{When: `rcpt == "a@b"`, Action: ruleReject}, stage: ruleStageRcpt},
+		{name: "subject", cfg: RuleConfig{Subject: "x", Action: ruleReject}, stage: ruleStageData},
+		{name: "size in when", cfg: RuleConfig{When: "size > 10", Action: ruleReject}, stage: ruleStageData},
+		{name: "min size", cfg: RuleConfig{MinSize: 10, Action: ruleReject}, stage: ruleStageData},
+		{name: "later stage", cfg: RuleConfig{From: "x", Stage: "data", Action: ruleReject}, stage: ruleStageData},
+
+		{name: "earlier stage", cfg: RuleConfig{Subject: "x", Stage: "MAIL", Action: ruleReject}, err: "only known at DATA"},
+		{name: "rcpt at DATA", cfg: RuleConfig{When: `rcpt == "a@b"`, Stage: "DATA", Action: ruleReject}, err: "rcpt is only known at RCPT"},
+		{name: "unknown stage", cfg: RuleConfig{Stage: "QUIT", Action: ruleReject}, err: "stage must be"},
+		{name: "bad regexp", cfg: RuleConfig{From: "(", Action: ruleReject}, err: "from:"},
+		{name: "bad when", cfg: RuleConfig{When: "sender == 1", Action: ruleReject}, err: "unknown variable"},
+		{name: "no action", cfg: RuleConfig{From: "x"}, err: "action must be"},
+		{name: "delay without wait", cfg: RuleConfig{Action: ruleDelay}, err: "requires delay"},
+		{name: "tempfail with 5xx", cfg: RuleConfig{Action: ruleTempfail, Code: 550}, err: "code must be 4xx"},
+		{name: "reject with 4.x.x", cfg: RuleConfig{Action: ruleReject, EnhancedCode: "4.7.1"}, err: "enhanced_code"},
+		{name: "size range", cfg: RuleConfig{MinSize: 10, MaxSize: 5, Action: ruleReject}, err: "invalid size range"},
+	} {
+		rules, err := compileRules([]RuleConfig{tc.cfg})
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: error %v, want %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if rules[0].stage != tc.stage {
+			t.Errorf("%s: stage %s, want %s", tc.name, rules[0].stage, tc.stage)
+		}
+	}
+}
+
+func TestApplyRulesOutcomes(t *testing.T) {
+	in := &ruleInput{from: "bounce@example.com"}
+
+	for _, tc := range []struct {
+		name  string
+		rules []RuleConfig
+		code  int // 0 when the transaction goes on
+		text  string
+	}{
+		{
+			name:  "reject default reply",
+			rules: []RuleConfig{{From: "^bounce@", Action: ruleReject}},
+			code:  550,
+			text:  "Rejected by policy",
+		},
+		{
+			name:  "tempfail default reply",
+			rules: []RuleConfig{{From: "^bounce@", Action: ruleTempfail}},
+			code:  451,
+			text:  "Temporarily rejected by policy",
+		},
+		{
+			name:  "custom reply",
+			rules: []RuleConfig{{From: "^bounce@", Action: ruleReject, Code: 554, EnhancedCode: "5.1.1", Message: "No such user"}},
+			code:  554,
+			text:  "No such user",
+		},
+		{
+			name:  "no match",
+			rules: []RuleConfig{{From: "^postmaster@", Action: ruleReject}},
+		},
+		{
+			name: "first matching rule wins",
+			rules: []RuleConfig{
+				{From: "^postmaster@", Action: ruleReject},
+				{From: "@example\\.com$", Action: ruleTempfail, Message: "second"},
+				{Action: ruleReject, Message: "third"},
+			},
+			code: 451,
+			text: "second",
+		},
+		{
+			name: "accept skips the rest",
+			rules: []RuleConfig{
+				{From: "^bounce@", Action: ruleAccept},
+				{Action: ruleReject},
+			},
+		},
+		{
+			name: "delay goes on with the next rule",
+			rules: []RuleConfig{
+				{Action: ruleDelay, Delay: 20 * time.Millisecond},
+				{Action: ruleReject},
+			},
+			code: 550,
+		},
+		{
+			name:  "failing expression skips the rule",
+			rules: []RuleConfig{{When: "seq / 0 == 1", Action: ruleReject}},
+		},
+	} {
+		s := ruleSession(t, tc.rules...)
+
+		start := time.Now()
+		reply := ruleReplyOf(t, s.applyRules(ruleStageMail, in))
+		switch {
+		case tc.code == 0 && reply != nil:
+			t.Errorf("%s: got %d %s, want no reply", tc.name, reply.Code, reply.Message)
+		case tc.code != 0 && reply == nil:
+			t.Errorf("%s: no reply, want %d", tc.name, tc.code)
+		case reply != nil && (reply.Code != tc.code || tc.text != "" && reply.Message != tc.text):
+			t.Errorf("%s: got %d %s, want %d %s", tc.name, reply.Code, reply.Message, tc.code, tc.text)
+		}
+
+		if tc.rules[0].Action == ruleDelay && time.Since(start) < tc.rules[0].Delay {
+			t.Errorf("%s: returned after %v", tc.name, time.Since(start))
+		}
+	}
+}
+
+func TestApplyRulesStagesAndCount(t *testing.T) {
+	s := ruleSession(t,
+		RuleConfig{Name: "every-third", When: "count % 3 == 0", Action: ruleTempfail},
+		RuleConfig{Name: "big", MinSize: 100, Action: ruleReject},
+		RuleConfig{Name: "qa", To: "^qa@", Action: ruleReject, Code: 550, EnhancedCode: "5.1.1"},
+	)
+
+	// Only the rules of the stage are evaluated, count grows with every evaluation
+	var failed []int
+	for i := 1; i <= 6; i++ {
+		if ruleReplyOf(t, s.applyRules(ruleStageMail, &ruleInput{from: "a@example.com"})) != nil {
+			failed = append(failed, i)
+		}
+	}
+	if len(failed) != 2 || failed[0] != 3 || failed[1] != 6 {
+		t.Errorf("tempfailed transactions %v, want [3 6]", failed)
+	}
+
+	if reply := ruleReplyOf(t, s.applyRules(ruleStageRcpt, &ruleInput{to: []string{"dev@example.com"}})); reply != nil {
+		t.Errorf("RCPT dev: got %d", reply.Code)
+	}
+	if reply := ruleReplyOf(t, s.applyRules(ruleStageRcpt, &ruleInput{to: []string{"qa@example.com"}})); reply == nil || reply.EnhancedCode != (smtp.EnhancedCode{5, 1, 1}) {
+		t.Errorf("RCPT qa: got %v, want 550 5.1.1", reply)
+	}
+
+	if reply := ruleReplyOf(t, s.applyRules(ruleStageData, &ruleInput{size: 99})); reply != nil {
+		t.Errorf("DATA 99 bytes: got %d", reply.Code)
+	}
+	if reply := ruleReplyOf(t, s.applyRules(ruleStageData, &ruleInput{size: 100})); reply == nil || reply.Code != 550 {
+		t.Errorf("DATA 100 bytes: got %v, want 550", reply)
+	}
+
+	matches := s.backend.plugin.ruleMatches()
+	if matches["every-third"] != 2 || matches["big"] != 1 || matches["qa"] != 1 {
+		t.Errorf("matches %v", matches)
+	}
+}
@@ -0,0 +1,33 @@
+package smtp
+
+import (
+	"sync/atomic"
+)
+
+// SamplingConfig keeps only part of the messages for load-test runs. Every message
+// is still answered 250 and counted in stats, history and sender baselines.
+type SamplingConfig struct {
+	// Push 1 in N messages to Jobs, 0 or 1 pushes all of them.
+	// Messages a rule matched are always pushed.
+	KeepOneIn uint64 `mapstructure:"keep_one_in"`
+}
+
+// sampler picks the messages sampling keeps
+type sampler struct {
+	keepOneIn uint64
+	seen      atomic.Uint64
+}
+
+// keep reports whether the next message is pushed, the first one always is
+func (s *sampler) keep() bool {
+	return (s.seen.Add(1)-1)%s.keepOneIn == 0
+}
+
+// sampledOut reports whether sampling drops the session's current message
+func (s *Session) sampledOut() bool {
+	p := s.backend.plugin
+	if p.sampler == nil || s.rulesMatched {
+		return false
+	}
+	return !p.sampler.keep()
+}
@@ -0,0 +1,122 @@
+package smtp
+
+import (
+	"strconv"
+	"time"
+)
+
+// Job payload schema versions, sent in the schema_version job header
+const (
+	// schemaV1 is the original EMAIL_RECEIVED layout: connection UUID, envelope, authentication,
+	// message headers and bodies, attachments. Consumers decoding strictly into fixed
+	// classes reject the fields added since.
+	schemaV1 = 1
+	// schemaV2 adds message identity (seq, message_uuid, queue_id), connection and TLS
+	// details, MAIL FROM parameters, text_body, nested messages and anomalies
+	schemaV2 = 2
+
+	// currentSchemaVersion is the layout emitted unless jobs.schema_version asks for an older one
+	currentSchemaVersion = schemaV2
+)
+
+// schemaVersionHeader names the job header carrying the payload schema version
+const schemaVersionHeader = "schema_version"
+
+// emailDataV1 is the EMAIL_RECEIVED payload in schema version 1
+type emailDataV1 struct {
+	Event       string             `json:"event"`
+	UUID        string             `json:"uuid"`
+	RemoteAddr  string             `json:"remote_addr"`
+	ReceivedAt  time.Time          `json:"received_at"`
+	Envelope    envelopeDataV1     `json:"envelope"`
+	Auth        *authDataV1        `json:"authentication,omitempty"`
+	Message     messageDataV1      `json:"message"`
+	Attachments []attachmentDataV1 `json:"attachments"`
+}
+
+type envelopeDataV1 struct {
+	From          []EmailAddress `json:"from"`
+	To            []EmailAddress `json:"to"`
+	Ccs           []EmailAddress `json:"ccs"`
+	ReplyTo       []EmailAddress `json:"replyTo"`
+	AllRecipients []string       `json:"allRecipients"`
+	Helo          string         `json:"helo"`
+}
+
+type authDataV1 struct {
+	Attempted bool   `json:"attempted"`
+	Mechanism string `json:"mechanism"`
+	Username  string `json:"username"`
+	Password  string `json:"password"`
+}
+
+type messageDataV1 struct {
+	Headers  map[string][]string `json:"headers"`
+	Id       *string             `json:"id"`
+	Body     string              `json:"body"` // always the plain text body
+	HTMLBody string              `json:"html_body,omitempty"`
+	Raw      string              `json:"raw,omitempty"`
+	Subject  string              `json:"subject"`
+}
+
+type attachmentDataV1 struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Content     string `json:"content,omitempty"`
+	Path        string `json:"path,omitempty"`
+}
+
+// emailPayload returns the EMAIL_RECEIVED payload in the configured schema version
+func emailPayload(email *EmailData, cfg *JobsConfig) any {
+	if cfg.SchemaVersion != schemaV1 {
+		return email
+	}
+
+	v1 := &emailDataV1{
+		Event:      email.Event,
+		UUID:       email.UUID,
+		RemoteAddr: email.RemoteAddr,
+		ReceivedAt: email.ReceivedAt,
+		Envelope: envelopeDataV1{
+			From:          email.Envelope.From,
+			To:            email.Envelope.To,
+			Ccs:           email.Envelope.Ccs,
+			ReplyTo:       email.Envelope.ReplyTo,
+			AllRecipients: email.Envelope.AllRecipients,
+			Helo:          email.Envelope.Helo,
+		},
+		Message: messageDataV1{
+			Headers:  email.Message.Headers,
+			Id:       email.Message.Id,
+			Body:     email.Message.TextBody,
+			HTMLBody: email.Message.HTMLBody,
+			Raw:      email.Message.Raw,
+			Subject:  email.Message.Subject,
+		},
+		Attachments: make([]attachmentDataV1, 0, len(email.Attachments)),
+	}
+	if email.Auth != nil {
+		v1.Auth = &authDataV1{
+			Attempted: email.Auth.Attempted,
+			Mechanism: email.Auth.Mechanism,
+			Username:  email.Auth.Username,
+			Password:  email.Auth.Password,
+		}
+	}
+	for _, a := range email.Attachments {
+		v1.Attachments = append(v1.Attachments, attachmentDataV1{
+			Filename:    a.Filename,
+			ContentType: a.ContentType,
+			Size:        a.Size,
+			Content:     a.Content,
+			Path:        a.Path,
+		})
+	}
+	return v1
+}
+
+// setSchemaVersion adds the schema_version header to a job
+func setSchemaVersion(headers map[string][]string, cfg *JobsConfig) {
+	headers[schemaVersionHeader] = []string{strconv.Itoa(cfg.SchemaVersion)}
+}
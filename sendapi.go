@@ -0,0 +1,374 @@
+package smtp
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// sendRemoteAddr marks messages submitted through the HTTP send endpoint
+const sendRemoteAddr = "http"
+
+// sendPath is the endpoint accepting SendRequest
+const sendPath = "/send"
+
+// SendAPIConfig configures the HTTP endpoint that turns JSON into captured mail
+type SendAPIConfig struct {
+	Addr  string `mapstructure:"addr"`  // listen address, empty disables
+	Token string `mapstructure:"token"` // required as "Authorization: Bearer <token>" when set
+}
+
+// SendRequest describes a message to synthesize
+type SendRequest struct {
+	From        string            `json:"from"`
+	To          []string          `json:"to"`
+	Cc          []string          `json:"cc"`
+	Bcc         []string          `json:"bcc"` // envelope only, not written to headers
+	Subject     string            `json:"subject"`
+	Text        string            `json:"text"`
+	HTML        string            `json:"html"`
+	Headers     map[string]string `json:"headers"`
+	Attachments []SendAttachment  `json:"attachments"`
+}
+
+// SendAttachment is a base64 encoded attachment of a SendRequest
+type SendAttachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"` // defaults to application/octet-stream
+	Content     string `json:"content"`      // base64
+}
+
+// SendResponse identifies the captured message
+type SendResponse struct {
+	MessageUUID string `json:"message_uuid"`
+}
+
+// startSendAPI serves the send endpoint
+func (p *Plugin) startSendAPI(errCh chan error) error {
+	const op = errors.Op("smtp_send_api")
+
+	if p.cfg.SendAPI.Addr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", p.cfg.SendAPI.Addr)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(sendPath, p.handleSend)
+	mux.HandleFunc(attachmentPath, p.handleAttachment)
+	mux.HandleFunc(importPath, p.handleImport)
+	p.sendServer = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	p.log.Info("send API listening", zap.String("addr", p.cfg.SendAPI.Addr))
+
+	go func() {
+		if err := p.sendServer.Serve(l); err != nil && err != http.ErrServerClosed {
+			p.log.Error("send API error", zap.Error(err))
+			errCh <- errors.E(op, err)
+		}
+	}()
+
+	return nil
+}
+
+// stopSendAPI shuts the send endpoint down
+func (p *Plugin) stopSendAPI(ctx context.Context) {
+	if p.sendServer != nil {
+		_ = p.sendServer.Shutdown(ctx)
+	}
+}
+
+// sendAPIAuthorized checks the bearer token when send_api.token is set
+func (p *Plugin) sendAPIAuthorized(r *http.Request) bool {
+	token := p.cfg.SendAPI.Token
+	if token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// handleSend builds a MIME message from the request and runs it through the capture pipeline
+func (p *Plugin) handleSend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.sendAPIAuthorized(r) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	// Attachments are base64 in JSON, a third larger than in the message
+	r.Body = http.MaxBytesReader(w, r.Body, p.cfg.MaxMessageSize*2)
+
+	var req SendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	id := p.newID()
+	session := &Session{
+		backend:    &Backend{plugin: p, log: p.log},
+		uuid:       id,
+		remoteAddr: sendRemoteAddr,
+		log: p.log.With(
+			zap.String("uuid", id),
+			zap.String("remote_addr", sendRemoteAddr),
+		),
+	}
+
+	if reason := session.sendEnvelope(&req); reason != "" {
+		http.Error(w, reason, http.StatusUnprocessableEntity)
+		return
+	}
+
+	raw, err := buildMIME(&req, p.cfg.Hostname, p.now(), p.newID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if int64(len(raw)) > p.cfg.MaxMessageSize {
+		http.Error(w, "message exceeds max_message_size", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	parsed, err := session.parseEmail(raw)
+	if err != nil {
+		http.Error(w, "failed to parse generated message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	email := session.newEmailData(parsed)
+	if err := p.deliver(email); err != nil {
+		session.log.Error("failed to deliver sent message", zap.Error(err))
+		http.Error(w, "delivery failed", http.StatusServiceUnavailable)
+		return
+	}
+
+	session.log.Info("message received over send API",
+		zap.String("from", session.from),
+		zap.Strings("to", session.to),
+	)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(SendResponse{MessageUUID: email.MessageUUID})
+}
+
+// sendEnvelope validates the addresses of the request and fills the session envelope,
+// returning why the request is unusable
+func (s *Session) sendEnvelope(req *SendRequest) string {
+	p := s.backend.plugin
+
+	if reason := checkMailbox(req.From, true); reason != "" {
+		return fmt.Sprintf("from %q: %s", req.From, reason)
+	}
+	s.from = p.normalizeAddress(req.From)
+
+	for _, list := range [][]string{req.To, req.Cc, req.Bcc} {
+		for _, addr := range list {
+			if reason := checkMailbox(addr, true); reason != "" {
+				return fmt.Sprintf("recipient %q: %s", addr, reason)
+			}
+			s.to = append(s.to, p.normalizeAddress(addr))
+		}
+	}
+
+	if len(s.to) == 0 {
+		return "at least one of to, cc or bcc is required"
+	}
+	if len(s.to) > p.cfg.MaxRecipients {
+		return "too many recipients"
+	}
+
+	return ""
+}
+
+// buildMIME renders the request as an RFC 5322 message: text and HTML become
+// multipart/alternative, attachments wrap it in multipart/mixed
+func buildMIME(req *SendRequest, hostname string, date time.Time, id string) ([]byte, error) {
+	var buf bytes.Buffer
+
+	writeHeader := func(name, value string) {
+		fmt.Fprintf(&buf, "%s: %s\r\n", name, value)
+	}
+
+	writeHeader("From", req.From)
+	if len(req.To) > 0 {
+		writeHeader("To", strings.Join(req.To, ", "))
+	}
+	if len(req.Cc) > 0 {
+		writeHeader("Cc", strings.Join(req.Cc, ", "))
+	}
+	writeHeader("Subject", mime.QEncoding.Encode("utf-8", req.Subject))
+	writeHeader("Date", date.Format(time.RFC1123Z))
+	writeHeader("Message-ID", "<"+id+"@"+hostname+">")
+	writeHeader("MIME-Version", "1.0")
+	for name, value := range req.Headers {
+		if strings.ContainsAny(name+value, "\r\n") {
+			return nil, errors.Errorf("header %q contains a line break", name)
+		}
+		writeHeader(textproto.CanonicalMIMEHeaderKey(name), value)
+	}
+
+	if len(req.Attachments) == 0 {
+		if err := writeBody(&buf, nil, req); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	mixed := multipart.NewWriter(&buf)
+	writeHeader("Content-Type", "multipart/mixed; boundary="+mixed.Boundary())
+	buf.WriteString("\r\n")
+
+	if err := writeBody(&buf, mixed, req); err != nil {
+		return nil, err
+	}
+
+	for _, att := range req.Attachments {
+		content, err := base64.StdEncoding.DecodeString(att.Content)
+		if err != nil {
+			return nil, errors.Errorf("attachment %q: invalid base64: %v", att.Filename, err)
+		}
+
+		contentType := att.ContentType
+		if contentType == "" {
+			contentType = "application/octet-stream"
+		}
+
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {contentType},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": att.Filename})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := writeBase64Lines(part, content); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// writeBody writes the text and HTML bodies, as a part of parent when it is set,
+// otherwise as the remaining headers and body of the message in buf
+func writeBody(buf *bytes.Buffer, parent *multipart.Writer, req *SendRequest) error {
+	type alt struct {
+		mediaType string
+		content   string
+	}
+
+	var parts []alt
+	if req.Text != "" || req.HTML == "" {
+		parts = append(parts, alt{"text/plain", req.Text})
+	}
+	if req.HTML != "" {
+		parts = append(parts, alt{"text/html", req.HTML})
+	}
+
+	// start returns the writer for a part with the header, at top level or inside parent
+	start := func(header textproto.MIMEHeader) (io.Writer, error) {
+		if parent != nil {
+			return parent.CreatePart(header)
+		}
+		for _, name := range []string{"Content-Type", "Content-Transfer-Encoding"} {
+			if v := header.Get(name); v != "" {
+				fmt.Fprintf(buf, "%s: %s\r\n", name, v)
+			}
+		}
+		buf.WriteString("\r\n")
+		return buf, nil
+	}
+
+	writeText := func(w io.Writer, content string) error {
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(content)); err != nil {
+			return err
+		}
+		return qp.Close()
+	}
+
+	textHeader := func(mediaType string) textproto.MIMEHeader {
+		return textproto.MIMEHeader{
+			"Content-Type":              {mediaType + "; charset=utf-8"},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		}
+	}
+
+	if len(parts) == 1 {
+		w, err := start(textHeader(parts[0].mediaType))
+		if err != nil {
+			return err
+		}
+		return writeText(w, parts[0].content)
+	}
+
+	var altBuf bytes.Buffer
+	alternative := multipart.NewWriter(&altBuf)
+	for _, part := range parts {
+		w, err := alternative.CreatePart(textHeader(part.mediaType))
+		if err != nil {
+			return err
+		}
+		if err := writeText(w, part.content); err != nil {
+			return err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return err
+	}
+
+	w, err := start(textproto.MIMEHeader{
+		"Content-Type": {"multipart/alternative; boundary=" + alternative.Boundary()},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(altBuf.Bytes())
+	return err
+}
+
+// writeBase64Lines writes content as base64 wrapped at 76 characters
+func writeBase64Lines(w io.Writer, content []byte) error {
+	encoded := base64.StdEncoding.EncodeToString(content)
+	for len(encoded) > 0 {
+		n := min(76, len(encoded))
+		if _, err := fmt.Fprintf(w, "%s\r\n", encoded[:n]); err != nil {
+			return err
+		}
+		encoded = encoded[n:]
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package smtp
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sender anomalies
+const (
+	anomalyVolumeSpike  = "volume_spike"
+	anomalyLargeMessage = "large_message"
+)
+
+const (
+	// sendersMaxTracked bounds the baselines kept, the least recently seen sender is evicted
+	sendersMaxTracked = 10000
+	// senderRateSmoothing weights the latest window in the rate baseline
+	senderRateSmoothing = 0.2
+	// senderMaxIdleWindows caps the decay applied for windows without traffic
+	senderMaxIdleWindows = 64
+)
+
+// SenderAlertsConfig configures per-sender baselines and anomaly detection
+type SenderAlertsConfig struct {
+	Enabled      bool          `mapstructure:"enabled"`
+	Window       time.Duration `mapstructure:"window"`        // rate is measured per window
+	VolumeFactor float64       `mapstructure:"volume_factor"` // window count over baseline that is a spike
+	SizeFactor   float64       `mapstructure:"size_factor"`   // message size over the average that is unusual
+	MinMessages  int           `mapstructure:"min_messages"`  // messages before a baseline is trusted
+}
+
+// initDefaults fills sender alert defaults
+func (s *SenderAlertsConfig) initDefaults() {
+	if s.Window == 0 {
+		s.Window = time.Minute
+	}
+
+	if s.VolumeFactor == 0 {
+		s.VolumeFactor = 100
+	}
+
+	if s.SizeFactor == 0 {
+		s.SizeFactor = 10
+	}
+
+	if s.MinMessages == 0 {
+		s.MinMessages = 10
+	}
+}
+
+// SenderAnomalyEvent is sent to PHP when a sender departs from its baseline
+type SenderAnomalyEvent struct {
+	Event      string    `json:"event"`    // Always "SENDER_ANOMALY"
+	Sender     string    `json:"sender"`   // MAIL FROM, lowercased
+	Anomaly    string    `json:"anomaly"`  // "volume_spike" or "large_message"
+	Observed   float64   `json:"observed"` // messages in the window, or message size in bytes
+	Baseline   float64   `json:"baseline"` // usual messages per window, or average size in bytes
+	DetectedAt time.Time `json:"detected_at"`
+}
+
+// SenderStat is the baseline of one sender
+type SenderStat struct {
+	Sender        string    `json:"sender"`
+	Messages      uint64    `json:"messages"`
+	AverageSize   float64   `json:"average_size"`
+	Baseline      float64   `json:"baseline_per_window"` // smoothed messages per window
+	CurrentWindow uint64    `json:"current_window"`      // messages in the running window
+	Anomalies     uint64    `json:"anomalies"`
+	LastSeen      time.Time `json:"last_seen"`
+}
+
+// senderBaseline is the running state of one sender
+type senderBaseline struct {
+	messages    uint64
+	totalSize   int64
+	baseline    float64
+	windowStart time.Time
+	windowCount uint64
+	windows     int  // completed windows folded into baseline
+	spiked      bool // a volume spike was already reported for the running window
+	anomalies   uint64
+	lastSeen    time.Time
+}
+
+// senderTracker keeps baselines per MAIL FROM address
+type senderTracker struct {
+	mu      sync.Mutex
+	cfg     *SenderAlertsConfig
+	senders map[string]*senderBaseline
+}
+
+func newSenderTracker(cfg *SenderAlertsConfig) *senderTracker {
+	return &senderTracker{
+		cfg:     cfg,
+		senders: make(map[string]*senderBaseline),
+	}
+}
+
+// observe records a message and returns the anomalies it triggered
+func (t *senderTracker) observe(sender string, size int64, now time.Time) []SenderAnomalyEvent {
+	sender = strings.ToLower(sender)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.senders[sender]
+	if !ok {
+		if len(t.senders) >= sendersMaxTracked {
+			t.evictOldest()
+		}
+		b = &senderBaseline{windowStart: now}
+		t.senders[sender] = b
+	}
+
+	t.roll(b, now)
+
+	var events []SenderAnomalyEvent
+	trusted := b.messages >= uint64(t.cfg.MinMessages)
+
+	b.windowCount++
+	// A sender that barely sends still needs VolumeFactor messages to spike
+	expected := max(b.baseline, 1)
+	if trusted && b.windows > 0 && !b.spiked && float64(b.windowCount) > t.cfg.VolumeFactor*expected {
+		b.spiked = true
+		events = append(events, SenderAnomalyEvent{
+			Anomaly:  anomalyVolumeSpike,
+			Observed: float64(b.windowCount),
+			Baseline: b.baseline,
+		})
+	}
+
+	if trusted {
+		avg := float64(b.totalSize) / float64(b.messages)
+		if avg > 0 && float64(size) > t.cfg.SizeFactor*avg {
+			events = append(events, SenderAnomalyEvent{
+				Anomaly:  anomalyLargeMessage,
+				Observed: float64(size),
+				Baseline: avg,
+			})
+		}
+	}
+
+	b.messages++
+	b.totalSize += size
+	b.lastSeen = now
+	b.anomalies += uint64(len(events))
+
+	for i := range events {
+		events[i].Event = "SENDER_ANOMALY"
+		events[i].Sender = sender
+		events[i].DetectedAt = now
+	}
+
+	return events
+}
+
+// roll folds finished windows into the rate baseline. Caller must hold t.mu.
+func (t *senderTracker) roll(b *senderBaseline, now time.Time) {
+	elapsed := int(now.Sub(b.windowStart) / t.cfg.Window)
+	if elapsed < 1 {
+		return
+	}
+
+	b.baseline = b.baseline*(1-senderRateSmoothing) + float64(b.windowCount)*senderRateSmoothing
+	// Windows without traffic pull the baseline towards zero
+	for i := 1; i < min(elapsed, senderMaxIdleWindows); i++ {
+		b.baseline *= 1 - senderRateSmoothing
+	}
+
+	b.windows += elapsed
+	b.windowStart = b.windowStart.Add(time.Duration(elapsed) * t.cfg.Window)
+	b.windowCount = 0
+	b.spiked = false
+}
+
+// evictOldest drops the least recently seen sender. Caller must hold t.mu.
+func (t *senderTracker) evictOldest() {
+	var oldest string
+	var oldestSeen time.Time
+	for sender, b := range t.senders {
+		if oldest == "" || b.lastSeen.Before(oldestSeen) {
+			oldest, oldestSeen = sender, b.lastSeen
+		}
+	}
+	delete(t.senders, oldest)
+}
+
+// snapshot returns the baselines of every tracked sender, busiest first
+func (t *senderTracker) snapshot() []SenderStat {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	result := make([]SenderStat, 0, len(t.senders))
+	for sender, b := range t.senders {
+		t.roll(b, now)
+
+		stat := SenderStat{
+			Sender:        sender,
+			Messages:      b.messages,
+			Baseline:      b.baseline,
+			CurrentWindow: b.windowCount,
+			Anomalies:     b.anomalies,
+			LastSeen:      b.lastSeen,
+		}
+		if b.messages > 0 {
+			stat.AverageSize = float64(b.totalSize) / float64(b.messages)
+		}
+		result = append(result, stat)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Messages != result[j].Messages {
+			return result[i].Messages > result[j].Messages
+		}
+		return result[i].Sender < result[j].Sender
+	})
+
+	return result
+}
+
+// observeSender updates the baseline of the MAIL FROM address and reports anomalies
+func (p *Plugin) observeSender(sender string, size int64) {
+	for _, event := range p.senders.observe(sender, size, time.Now()) {
+		p.stats.senderAnomalies.Add(1)
+		p.log.Warn("sender anomaly",
+			zap.String("sender", event.Sender),
+			zap.String("anomaly", event.Anomaly),
+			zap.Float64("observed", event.Observed),
+			zap.Float64("baseline", event.Baseline),
+		)
+
+		if !p.cfg.Jobs.NotifySenderAnomaly || p.jobs == nil {
+			continue
+		}
+
+		// The message itself was delivered, a failed alert is only logged
+		msg, err := senderAnomalyToJobMessage(&event, p.newID(), &p.cfg.Jobs)
+		if err == nil {
+			err = p.push(msg)
+		}
+		if err != nil {
+			p.log.Error("failed to push sender anomaly event", zap.String("sender", event.Sender), zap.Error(err))
+		}
+	}
+}
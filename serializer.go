@@ -0,0 +1,167 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Built-in payload serializers
+const (
+	serializerJSON     = "json"
+	serializerMsgpack  = "msgpack"
+	serializerProtobuf = "protobuf"
+)
+
+// Serializer encodes job payloads. Implementations must be safe for concurrent use.
+type Serializer interface {
+	// ContentType is sent as the content-type job header
+	ContentType() string
+	// Marshal encodes one payload, v is one of the event types such as *EmailData
+	Marshal(v any) ([]byte, error)
+}
+
+var (
+	serializersMu sync.RWMutex
+	serializers   = map[string]Serializer{
+		serializerJSON:     jsonSerializer{},
+		serializerMsgpack:  msgpackSerializer{},
+		serializerProtobuf: protobufSerializer{},
+	}
+)
+
+// RegisterSerializer makes a custom serializer selectable by name in jobs.serializer.
+// It is meant to be called from init() of embedded builds and panics if the name is taken.
+func RegisterSerializer(name string, s Serializer) {
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+
+	if s == nil {
+		panic("smtp: RegisterSerializer serializer is nil")
+	}
+	if _, dup := serializers[name]; dup {
+		panic("smtp: RegisterSerializer called twice for " + name)
+	}
+	serializers[name] = s
+}
+
+// lookupSerializer returns the serializer registered under name
+func lookupSerializer(name string) (Serializer, bool) {
+	serializersMu.RLock()
+	defer serializersMu.RUnlock()
+
+	s, ok := serializers[name]
+	return s, ok
+}
+
+// marshalPayload encodes v with the serializer of the pipeline and records its content type
+func marshalPayload(cfg *JobsConfig, pipeline string, v any, headers map[string][]string) ([]byte, error) {
+	const op = errors.Op("smtp_marshal_payload")
+
+	s := cfg.serializerFor(pipeline)
+	payload, err := s.Marshal(v)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	headers["content-type"] = []string{s.ContentType()}
+	return payload, nil
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) ContentType() string { return "application/json" }
+
+func (jsonSerializer) Marshal(v any) ([]byte, error) { return json.Marshal(v) }
+
+// genericValue turns v into maps, slices and scalars through its JSON form, so binary
+// formats carry the same field names as the JSON payload
+func genericValue(v any) (any, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var out any
+	if err := dec.Decode(&out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// nativeNumbers replaces the json.Number values of a generic value by int64, or float64
+// for numbers with a fraction or out of range, so that encoders see typed numbers
+func nativeNumbers(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []any:
+		for i, item := range v {
+			v[i] = nativeNumbers(item)
+		}
+	case map[string]any:
+		for k, item := range v {
+			v[k] = nativeNumbers(item)
+		}
+	}
+	return v
+}
+
+// msgpackSerializer encodes payloads as MessagePack maps keyed by the JSON field names
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) ContentType() string { return "application/msgpack" }
+
+func (msgpackSerializer) Marshal(v any) ([]byte, error) {
+	g, err := genericValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	enc := msgpack.NewEncoder(&buf)
+	// Sorted keys keep payloads deterministic
+	enc.SetSortMapKeys(true)
+	enc.UseCompactInts(true)
+	if err := enc.Encode(nativeNumbers(g)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// protobufSerializer encodes payloads as a google.protobuf.Struct, so consumers decode
+// them with the well-known types instead of a schema owned by this plugin
+type protobufSerializer struct{}
+
+func (protobufSerializer) ContentType() string {
+	return "application/x-protobuf; messageType=google.protobuf.Struct"
+}
+
+func (protobufSerializer) Marshal(v any) ([]byte, error) {
+	g, err := genericValue(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := g.(map[string]any)
+	if !ok {
+		return nil, errors.Str("protobuf payload must be an object")
+	}
+	st, err := structpb.NewStruct(m)
+	if err != nil {
+		return nil, err
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(st)
+}
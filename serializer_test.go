@@ -0,0 +1,153 @@
+package smtp
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// serializerSample exercises every encoding path: nulls, booleans, small, negative and
+// large integers, floats, strings and collections of every length class
+func serializerSample() map[string]any {
+	many := make(map[string]any, 40)
+	for i := range 40 {
+		many["key"+strings.Repeat("x", i)] = i
+	}
+	list := make([]any, 70000)
+	for i := range list {
+		list[i] = i % 3
+	}
+
+	return map[string]any{
+		"null":     nil,
+		"true":     true,
+		"false":    false,
+		"fixint":   7,
+		"negfix":   -5,
+		"negative": -1000,
+		"large":    int64(1) << 40,
+		"float":    3.25,
+		"tiny":     math.SmallestNonzeroFloat64,
+		"empty":    "",
+		"unicode":  "Grüße, 世界",
+		"str8":     strings.Repeat("a", 200),
+		"str16":    strings.Repeat("b", 1000),
+		"str32":    strings.Repeat("c", 70000),
+		"list":     []any{"a", 1, nil, map[string]any{"nested": []any{}}},
+		"array16":  make([]any, 20),
+		"array32":  list,
+		"map16":    many,
+		"emptyMap": map[string]any{},
+	}
+}
+
+// sampleEmail is a payload as sent to Jobs
+func sampleEmail() *EmailData {
+	id := "<id@example.com>"
+	return &EmailData{
+		Event:       "EMAIL_RECEIVED",
+		UUID:        "conn",
+		Seq:         2,
+		MessageUUID: "msg",
+		ReceivedAt:  time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Envelope: EnvelopeData{
+			From:          []EmailAddress{{Email: "a@example.com", Name: "A"}},
+			AllRecipients: []string{"b@example.com"},
+		},
+		Message: MessageData{
+			Headers: map[string][]string{"Subject": {"Hi"}},
+			Id:      &id,
+			Body:    "body",
+			Subject: "Hi",
+			Size:    123,
+		},
+		Attachments: []AttachmentData{{Filename: "a.txt", ContentType: "text/plain", Size: 3, Content: "YWJj"}},
+	}
+}
+
+// jsonForm is what a JSON consumer decodes from v
+func jsonForm(t *testing.T, v any) any {
+	t.Helper()
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	for name, v := range map[string]any{"sample": serializerSample(), "email": sampleEmail()} {
+		payload, err := msgpackSerializer{}.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded any
+		if err := msgpack.Unmarshal(payload, &decoded); err != nil {
+			t.Fatalf("%s: reference decoder: %v", name, err)
+		}
+
+		// Integers decode as sized types, compare in their JSON form
+		if got, want := jsonForm(t, decoded), jsonForm(t, v); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded payload differs from the JSON form", name)
+		}
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	for name, v := range map[string]any{"sample": serializerSample(), "email": sampleEmail()} {
+		payload, err := protobufSerializer{}.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var decoded structpb.Struct
+		if err := proto.Unmarshal(payload, &decoded); err != nil {
+			t.Fatalf("%s: reference decoder: %v", name, err)
+		}
+
+		if got, want := decoded.AsMap(), jsonForm(t, v); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: decoded payload differs from the JSON form", name)
+		}
+	}
+}
+
+func TestPipelineSerializers(t *testing.T) {
+	cfg := &Config{Addr: []string{"127.0.0.1:1025"}}
+	cfg.Jobs.Pipeline = "emails"
+	cfg.Jobs.PipelineSerializers = map[string]string{"staging": serializerMsgpack}
+	cfg.Auth.Inboxes = map[string]InboxConfig{"staging": {Pipeline: "staging"}}
+	if err := cfg.InitDefaults(); err != nil {
+		t.Fatal(err)
+	}
+
+	for inbox, want := range map[string]string{"": "application/json", "staging": "application/msgpack"} {
+		email := sampleEmail()
+		email.Inbox = inbox
+
+		msg, err := emailToJobMessage(email, &cfg.Jobs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := msg.Headers()["content-type"]; len(got) != 1 || got[0] != want {
+			t.Errorf("inbox %q: content-type %v, want %s", inbox, got, want)
+		}
+	}
+
+	cfg.Jobs.PipelineSerializers = map[string]string{"staging": "yaml"}
+	if err := cfg.InitDefaults(); err == nil {
+		t.Error("unknown pipeline serializer accepted")
+	}
+}
@@ -2,7 +2,11 @@ package smtp
 
 import (
 	"bytes"
+	"crypto/tls"
+	"errors"
 	"io"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-smtp"
@@ -13,33 +17,171 @@ import (
 type Session struct {
 	backend    *Backend
 	conn       *smtp.Conn
+	tlsState   *tls.ConnectionState // taken by detach, the detached copy has no conn
 	uuid       string
 	remoteAddr string
+	remoteIP   string // empty for Unix socket clients
+	localAddr  string // socket address the client connected to
+	listener   string // configured listen address the connection arrived on
 	log        *zap.Logger
 
+	// mu guards the envelope and auth fields read by RPC while the session runs.
+	// Only the session goroutine writes them, so it reads them without locking.
+	mu sync.RWMutex
+
 	// Authentication data (captured but not verified)
 	authenticated bool
 	authUsername  string
 	authPassword  string
 	authMechanism string
+	authDigest    string // CRAM-MD5 response digest
+	authChallenge string // CRAM-MD5 challenge the digest answers
+	inbox         string // selected by the AUTH username when auth.inboxes is set
 
 	// SMTP envelope data
 	from     string
 	to       []string
-	heloName string
+	heloName string     // HELO/EHLO argument the session was started with
+	ptr      *ptrLookup // reverse DNS of the client, nil when disabled
+	utf8     bool       // MAIL FROM carried SMTPUTF8
+	bodyType string     // BODY= parameter of MAIL FROM
+	params   *MailParams
+
+	// Recorder of the SMTP dialogue, nil unless transcript is enabled
+	transcript *transcriptConn
 
 	// Email data (accumulated during DATA command)
 	emailData bytes.Buffer
 
+	// Whether the current message was sent in BDAT chunks instead of DATA
+	bdat bool
+
+	// Time spent storing attachments while parsing the current message
+	storageTime time.Duration
+
+	// Protocol violations reported with every message of the session
+	anomalies []string
+
+	// Messages built on the session so far, RSET keeps counting
+	seq uint64
+	// Message UUID and time taken before parsing for the Received: header
+	nextUUID string
+	nextAt   time.Time
+
+	// An accept rule matched, the remaining rules are skipped until the next MAIL FROM
+	rulesAccepted bool
+	// Any rule matched the transaction, which keeps it from being sampled out
+	rulesMatched bool
+
+	// Rejected commands counted by strike, and whether commands are delayed by the tarpit
+	strikes   int
+	tarpitted bool
+
 	// Connection control
 	shouldClose bool // Set to true when worker requests connection close
+
+	// Shutdown state, guarded by mu: go-smtp waits for the client, message data is
+	// being read, and Stop already sent 421
+	idle         bool
+	transferring bool
+	closed       bool
 }
 
 // Mail is called for MAIL FROM command
 func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
-	s.from = from
+	s.tarpit()
+	p := s.backend.plugin
+	if p.isStopped() {
+		return p.smtpError(respShuttingDown)
+	}
+
+	if p.cfg.Auth.Required && !s.authenticated {
+		s.log.Debug("MAIL FROM before AUTH rejected", zap.String("from", from))
+		return p.smtpError(respAuthRequired)
+	}
+
+	if len(from) > p.cfg.Limits.MaxArgumentLength {
+		s.log.Warn("MAIL FROM argument too long", zap.Int("length", len(from)), zap.String("from", truncateForLog(from)))
+		s.strike(respArgTooLong)
+		return p.smtpError(respArgTooLong)
+	}
+
+	if p.throughput != nil && !p.throughput.allow() {
+		p.stats.shed.Add(1)
+		s.log.Warn("transaction shed by throughput cap", zap.String("from", from))
+		return p.smtpError(respThrottled)
+	}
+
+	if reason := p.backpressure(); reason != "" {
+		p.stats.backpressured.Add(1)
+		s.log.Warn("transaction refused by backpressure", zap.String("from", from), zap.String("reason", reason))
+		return p.smtpError(respBackpressure)
+	}
+
+	if p.messageRate != nil && !p.messageRate.allow(s.remoteIP) {
+		p.stats.rateLimited.Add(1)
+		s.log.Warn("message rate limit exceeded", zap.String("from", from))
+		return p.smtpError(respRateLimited)
+	}
+
+	utf8 := opts != nil && opts.UTF8
+	// The null reverse-path <> is valid for bounces
+	if from != "" {
+		if reason := checkMailbox(from, utf8); reason != "" {
+			s.invalidAddress(anomalyInvalidSender, from, reason)
+			if p.cfg.Addresses.Validation == addressStrict {
+				s.strike(respBadSender)
+				return p.smtpError(respBadSender)
+			}
+		}
+	}
+
+	normalized := p.normalizeAddress(from)
+	s.rulesAccepted, s.rulesMatched = false, false
+	if err := s.applyRules(ruleStageMail, &ruleInput{from: normalized}); err != nil {
+		return err
+	}
+
+	if err := s.chaos(chaosMail); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.from = normalized
+	s.mu.Unlock()
+	s.utf8, s.bodyType = utf8, ""
+	s.params = &MailParams{SMTPUTF8: utf8}
+	if opts != nil {
+		s.bodyType = string(opts.Body)
+		s.params.Size = opts.Size
+		s.params.Body = s.bodyType
+		s.params.RequireTLS = opts.RequireTLS
+		s.params.Auth = opts.Auth
+	}
+
+	s.recordCommand("MAIL", func(u *ClientUsage) {
+		u.Transactions++
+		if _, isTLS := s.conn.TLSConnectionState(); isTLS {
+			u.TLS++
+			if s.listener != p.cfg.TLS.SMTPSAddr {
+				u.Extensions["STARTTLS"]++
+			}
+		}
+		if !s.authenticated {
+			u.Unauthenticated++
+		}
+		if utf8 {
+			u.Extensions["SMTPUTF8"]++
+		}
+		if s.bodyType == string(smtp.Body8BitMIME) || s.bodyType == string(smtp.BodyBinaryMIME) {
+			u.Extensions[s.bodyType]++
+		}
+		if opts != nil && opts.Size > 0 {
+			u.Extensions["SIZE"]++
+		}
+	})
+
 	s.log.Debug("MAIL FROM",
-		zap.String("uuid", s.uuid),
 		zap.String("from", from),
 	)
 	return nil
@@ -47,48 +189,258 @@ func (s *Session) Mail(from string, opts *smtp.MailOptions) error {
 
 // Rcpt is called for RCPT TO command
 func (s *Session) Rcpt(to string, opts *smtp.RcptOptions) error {
-	s.to = append(s.to, to)
+	s.tarpit()
+	p := s.backend.plugin
+	if len(s.to) >= p.cfg.MaxRecipients {
+		s.log.Debug("recipient over max_recipients rejected", zap.String("to", to))
+		return p.smtpError(respTooManyRcpts)
+	}
+
+	if len(to) > p.cfg.Limits.MaxArgumentLength {
+		s.log.Warn("RCPT TO argument too long", zap.Int("length", len(to)), zap.String("to", truncateForLog(to)))
+		s.strike(respArgTooLong)
+		return p.smtpError(respArgTooLong)
+	}
+
+	if reason := checkMailbox(to, s.utf8); reason != "" {
+		s.invalidAddress(anomalyInvalidRecipient, to, reason)
+		if p.cfg.Addresses.Validation == addressStrict {
+			s.strike(respBadRcpt)
+			return p.smtpError(respBadRcpt)
+		}
+	}
+
+	normalized := p.normalizeAddress(to)
+	if err := s.applyRules(ruleStageRcpt, &ruleInput{from: s.from, to: []string{normalized}}); err != nil {
+		return err
+	}
+
+	if err := s.chaos(chaosRcpt); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.to = append(s.to, normalized)
+	s.mu.Unlock()
+	s.recordCommand("RCPT", nil)
+
 	s.log.Debug("RCPT TO",
-		zap.String("uuid", s.uuid),
 		zap.String("to", to),
 	)
 	return nil
 }
 
-// Data is called when DATA command is received
+// Data is called when DATA command is received, or on the first BDAT chunk.
 // Returns error after reading complete email
 func (s *Session) Data(r io.Reader) error {
-	s.log.Debug("DATA command received", zap.String("uuid", s.uuid))
+	s.tarpit()
+	// go-smtp feeds BDAT chunks through a pipe, DATA uses its own dot-reader
+	_, s.bdat = r.(*io.PipeReader)
+	s.log.Debug("DATA command received", zap.Bool("bdat", s.bdat))
+	if s.bdat {
+		s.recordCommand("BDAT", func(u *ClientUsage) { u.Extensions["CHUNKING"]++ })
+	} else {
+		s.recordCommand("DATA", nil)
+	}
+
+	p := s.backend.plugin
+	p.transfers.Add(1)
+	defer p.transfers.Add(-1)
+	s.setTransferring(true)
+	defer s.setTransferring(false)
 
 	// 1. Read email data
 	s.emailData.Reset()
-	n, err := io.Copy(&s.emailData, r)
+	readStart := time.Now()
+	// Read one byte past the limit to tell a message of exactly max_message_size from a larger one
+	limit := p.cfg.MaxMessageSize
+	n, err := io.Copy(&s.emailData, io.LimitReader(r, limit+1))
+	if err == nil && n > limit {
+		s.log.Warn("message exceeds max_message_size", zap.Int64("limit", limit))
+		s.emailData.Reset()
+		return p.smtpError(respTooLarge)
+	}
 	if err != nil {
 		s.log.Error("failed to read email data", zap.Error(err))
-		return &smtp.SMTPError{
-			Code:    451,
-			Message: "Failed to read message",
+		// Keep protocol-level rejections from go-smtp, e.g. 552 for oversized messages
+		var smtpErr *smtp.SMTPError
+		if errors.As(err, &smtpErr) {
+			return smtpErr
 		}
+		s.messageAborted(n, err)
+		return p.smtpError(respReadFailed)
 	}
 
+	p.latency.observe(stageRead, time.Since(readStart))
+
 	s.log.Info("email received",
-		zap.String("uuid", s.uuid),
 		zap.String("from", s.from),
 		zap.Strings("to", s.to),
 		zap.Int64("size", n),
 	)
 
+	raw := s.emailData.Bytes()
+	s.nextUUID, s.nextAt = "", time.Time{}
+	if p.cfg.ReceivedHeader {
+		s.nextUUID, s.nextAt = p.newID(), p.now()
+		raw = s.withReceivedHeader(raw, queueID(s.nextUUID), s.nextAt)
+	}
+
+	if p.delivery != nil {
+		return s.acceptAsync(raw, n)
+	}
+
 	// 2. Parse email
-	parsedMessage, err := s.parseEmail(s.emailData.Bytes())
+	parseStart := time.Now()
+	parsedMessage, err := s.parseEmail(raw)
 	if err != nil {
 		s.log.Error("failed to parse email", zap.Error(err))
-		return &smtp.SMTPError{
-			Code:    554,
-			Message: "Failed to parse message",
-		}
+		return p.smtpError(respParseFailed)
+	}
+
+	p.latency.observe(stageParse, time.Since(parseStart)-s.storageTime)
+	if len(parsedMessage.Attachments) > 0 {
+		p.latency.observe(stageStorage, s.storageTime)
+	}
+
+	if err := s.applyRules(ruleStageData, &ruleInput{
+		from:    s.from,
+		to:      s.to,
+		subject: decodedSubject(parsedMessage.Subject),
+		size:    n,
+	}); err != nil {
+		return err
+	}
+
+	if err := s.chaos(chaosData); err != nil {
+		return err
 	}
 
 	// 3. Build EmailData for Jobs
+	emailData := s.newEmailData(parsedMessage)
+
+	if s.sampledOut() {
+		p.stats.sampledOut.Add(1)
+		p.history.record(emailData)
+		s.log.Debug("message sampled out", zap.String("message_uuid", emailData.MessageUUID))
+		if p.senders != nil {
+			p.observeSender(s.from, n)
+		}
+		return p.acceptedReply(emailData)
+	}
+
+	// 4. Push to Jobs
+	err = p.deliver(emailData)
+	if err != nil {
+		s.log.Error("failed to push email to jobs", zap.Error(err))
+		return p.smtpError(respPushFailed)
+	}
+
+	if p.senders != nil {
+		p.observeSender(s.from, n)
+	}
+
+	// go-smtp sends a 250 "error" as is, which carries the templated acceptance text
+	return p.acceptedReply(emailData)
+}
+
+// messageAborted reports a transfer the client broke off after n message bytes
+func (s *Session) messageAborted(n int64, readErr error) {
+	p := s.backend.plugin
+	p.stats.aborted.Add(1)
+	s.log.Warn("message transfer aborted",
+		zap.Int64("bytes_received", n),
+		zap.String("from", s.from),
+		zap.Strings("to", s.to),
+	)
+
+	var partialPath string
+	var partialCut bool
+	if p.cfg.AttachmentStorage.PartialMessages.Enabled && n > 0 {
+		var err error
+		partialPath, partialCut, err = s.savePartial()
+		if err != nil {
+			s.log.Error("failed to save partial message", zap.Error(err))
+		} else {
+			s.log.Info("partial message saved", zap.String("path", partialPath), zap.Bool("truncated", partialCut))
+		}
+	}
+
+	if !p.cfg.Jobs.NotifyMessageAborted || p.jobs == nil {
+		return
+	}
+
+	event := &MessageAbortedEvent{
+		Event:            "MESSAGE_ABORTED",
+		UUID:             s.uuid,
+		RemoteAddr:       s.remoteAddr,
+		AbortedAt:        p.now(),
+		BytesReceived:    n,
+		BDAT:             s.bdat,
+		Reason:           readErr.Error(),
+		From:             s.from,
+		To:               slices.Clone(s.to),
+		PartialPath:      partialPath,
+		PartialTruncated: partialCut,
+	}
+
+	// The client is gone, a failed notification is only logged
+	msg, err := messageAbortedToJobMessage(event, p.newID(), &p.cfg.Jobs)
+	if err == nil {
+		err = p.push(msg)
+	}
+	if err != nil {
+		s.log.Error("failed to push message aborted event", zap.Error(err))
+	}
+}
+
+// Reset is called for RSET command, and by go-smtp itself after every DATA/BDAT
+// and on a repeated EHLO, so it never tarpits
+func (s *Session) Reset() {
+	s.rulesAccepted, s.rulesMatched = false, false
+	s.mu.Lock()
+	s.from = ""
+	s.to = nil
+	s.mu.Unlock()
+	s.utf8, s.bodyType, s.params = false, "", nil
+
+	s.emailData.Reset()
+	s.log.Debug("session reset")
+}
+
+// Logout is called when connection closes
+func (s *Session) Logout() error {
+	if s.shouldClose {
+		s.log.Debug("closing connection as requested by worker")
+	} else {
+		s.log.Debug("connection closed")
+	}
+	p := s.backend.plugin
+	p.connections.Delete(s.uuid)
+	p.releaseConn(s.remoteIP, s.conn, true)
+	s.forgetHello()
+	return nil
+}
+
+// info returns a consistent snapshot of the session for RPC readers
+func (s *Session) info() ConnectionInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return ConnectionInfo{
+		UUID:          s.uuid,
+		RemoteAddr:    s.remoteAddr,
+		From:          s.from,
+		To:            append([]string(nil), s.to...),
+		Authenticated: s.authenticated,
+		Username:      s.authUsername,
+	}
+}
+
+// newEmailData builds the job payload from the parsed message and session state
+func (s *Session) newEmailData(parsedMessage *ParsedMessage) *EmailData {
+	s.seq++
+
 	var authData *AuthData
 	if s.authenticated {
 		authData = &AuthData{
@@ -96,24 +448,52 @@ func (s *Session) Data(r io.Reader) error {
 			Mechanism: s.authMechanism,
 			Username:  s.authUsername,
 			Password:  s.authPassword,
+			Digest:    s.authDigest,
+			Challenge: s.authChallenge,
 		}
 	}
 
+	// SNI is only known once STARTTLS or implicit TLS has completed,
+	// imported and HTTP-submitted messages have no connection at all
+	var serverName string
+	if state, ok := s.connectionState(); ok {
+		serverName = state.ServerName
+	}
+
 	// Convert attachments
 	attachments := make([]AttachmentData, 0, len(parsedMessage.Attachments))
 	for _, att := range parsedMessage.Attachments {
 		attachments = append(attachments, AttachmentData{
-			Filename:    att.Filename,
-			ContentType: att.Type,
-			Content:     att.Content,
+			Filename:      att.Filename,
+			ContentType:   att.Type,
+			Size:          att.Size,
+			Content:       att.Content,
+			SHA256:        att.SHA256,
+			Source:        att.Source,
+			ExtractedText: att.ExtractedText,
 		})
 	}
 
-	emailData := &EmailData{
-		Event:      "EMAIL_RECEIVED",
-		UUID:       s.uuid,
-		RemoteAddr: s.remoteAddr,
-		ReceivedAt: time.Now(),
+	// The Received: header may have taken the identity already
+	messageUUID, receivedAt := s.nextUUID, s.nextAt
+	s.nextUUID, s.nextAt = "", time.Time{}
+	if messageUUID == "" {
+		messageUUID, receivedAt = s.backend.plugin.newID(), s.backend.plugin.now()
+	}
+
+	return &EmailData{
+		Event:         "EMAIL_RECEIVED",
+		UUID:          s.uuid,
+		Seq:           s.seq,
+		MessageUUID:   messageUUID,
+		QueueID:       queueID(messageUUID),
+		CorrelationID: parsedMessage.CorrelationID,
+		RemoteAddr:    s.remoteAddr,
+		LocalAddr:     s.localAddr,
+		Listener:      s.listener,
+		ServerName:    serverName,
+		TLS:           s.tlsData(),
+		ReceivedAt:    receivedAt,
 		Envelope: EnvelopeData{
 			From:          parsedMessage.Sender,
 			To:            parsedMessage.Recipients,
@@ -121,54 +501,32 @@ func (s *Session) Data(r io.Reader) error {
 			ReplyTo:       parsedMessage.ReplyTo,
 			AllRecipients: parsedMessage.AllRecipients,
 			Helo:          s.heloName,
+			ReverseDNS:    s.reverseDNS(),
+			UTF8:          s.utf8,
+			BodyType:      s.bodyType,
+			Params:        s.params,
 		},
-		Auth: authData,
+		Auth:  authData,
+		Inbox: s.inbox,
 		Message: MessageData{
 			Id: parsedMessage.ID,
 			Headers: map[string][]string{
 				"Subject": {parsedMessage.Subject},
 			},
-			Body:     parsedMessage.TextBody,
-			HTMLBody: parsedMessage.HTMLBody,
-			Raw:      parsedMessage.Raw,
-			Subject:  parsedMessage.Subject,
+			Body:      selectBody(parsedMessage, s.backend.plugin.cfg.BodyPreference),
+			TextBody:  parsedMessage.TextBody,
+			ReplyText: parsedMessage.ReplyText,
+			HTMLBody:  parsedMessage.HTMLBody,
+			Raw:       parsedMessage.Raw,
+			Subject:   parsedMessage.Subject,
+			Priority:  parsedMessage.Priority,
+			Size:      parsedMessage.Size,
+			Lint:      parsedMessage.Lint,
 		},
+		BDAT:        s.bdat,
 		Attachments: attachments,
+		Nested:      parsedMessage.Nested,
+		Anomalies:   append(slices.Clone(s.anomalies), parsedMessage.Anomalies...),
+		Transcript:  s.transcriptText(),
 	}
-
-	// 4. Push to Jobs
-	err = s.backend.plugin.pushToJobs(emailData)
-	if err != nil {
-		s.log.Error("failed to push email to jobs",
-			zap.Error(err),
-			zap.String("uuid", s.uuid),
-		)
-		return &smtp.SMTPError{
-			Code:         451,
-			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
-			Message:      "Temporary failure, try again later",
-		}
-	}
-
-	// Always return nil to send 250 OK to client
-	return nil
-}
-
-// Reset is called for RSET command
-func (s *Session) Reset() {
-	s.from = ""
-	s.to = nil
-	s.emailData.Reset()
-	s.log.Debug("session reset", zap.String("uuid", s.uuid))
-}
-
-// Logout is called when connection closes
-func (s *Session) Logout() error {
-	if s.shouldClose {
-		s.log.Debug("closing connection as requested by worker", zap.String("uuid", s.uuid))
-	} else {
-		s.log.Debug("connection closed", zap.String("uuid", s.uuid))
-	}
-	s.backend.plugin.connections.Delete(s.uuid)
-	return nil
 }
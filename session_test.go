@@ -0,0 +1,133 @@
+package smtp
+
+import (
+	"context"
+	"net/smtp"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roadrunner-server/api/v4/plugins/v4/jobs"
+	"go.uber.org/zap"
+)
+
+type testConfigurer struct {
+	configure func(*Config)
+}
+
+func (c testConfigurer) UnmarshalKey(_ string, out any) error {
+	cfg := &Config{}
+	c.configure(cfg)
+	*out.(**Config) = cfg
+	return nil
+}
+
+func (c testConfigurer) Has(string) bool { return true }
+
+type testLogger struct{}
+
+func (testLogger) NamedLogger(string) *zap.Logger { return zap.NewNop() }
+
+type testJobs struct{}
+
+func (testJobs) Push(context.Context, jobs.Message) error { return nil }
+
+// startTestPlugin serves the plugin on a free local port and returns its address
+func startTestPlugin(t *testing.T, configure func(*Config)) (*Plugin, string) {
+	t.Helper()
+
+	p := &Plugin{}
+	err := p.Init(testLogger{}, testConfigurer{configure: func(c *Config) {
+		c.Addr = []string{"127.0.0.1:0"}
+		c.Jobs.Pipeline = "test"
+		if configure != nil {
+			configure(c)
+		}
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.jobs = testJobs{}
+
+	errCh := p.Serve()
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = p.Stop(ctx)
+	})
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p, p.listeners[0].l.Addr().String()
+}
+
+// TestSessionConcurrentRPC reads live sessions over RPC while clients run
+// transactions on them; run with -race
+func TestSessionConcurrentRPC(t *testing.T) {
+	p, addr := startTestPlugin(t, nil)
+	r := &rpc{p: p}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					runtime.Gosched()
+				}
+
+				var list []ConnectionInfo
+				if err := r.ListConnections(false, &list); err != nil {
+					t.Error(err)
+					return
+				}
+				p.connections.Range(func(_, value any) bool {
+					_ = value.(*Session).info()
+					return true
+				})
+			}
+		}()
+	}
+
+	for i := 0; i < 20; i++ {
+		c, err := smtp.Dial(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Hello("client.test"); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Auth(smtp.PlainAuth("", "user", "secret", "127.0.0.1")); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 5; j++ {
+			if err := c.Mail("sender@example.com"); err != nil {
+				t.Fatal(err)
+			}
+			for _, rcpt := range []string{"a@example.com", "b@example.com"} {
+				if err := c.Rcpt(rcpt); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := c.Reset(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_ = c.Quit()
+	}
+
+	close(done)
+	wg.Wait()
+}
@@ -0,0 +1,104 @@
+package smtp
+
+import "sync/atomic"
+
+// Stats is a snapshot of plugin counters
+type Stats struct {
+	Accepted   uint64 `json:"accepted"`    // messages delivered to Jobs
+	Shed       uint64 `json:"shed"`        // transactions refused by the throughput cap
+	Limited    uint64 `json:"limited"`     // transactions refused by limits.messages_per_minute
+	Aborted    uint64 `json:"aborted"`     // transfers cut off by the client mid-DATA
+	SampledOut uint64 `json:"sampled_out"` // messages answered 250 but not pushed, by sampling
+	Banned     uint64 `json:"banned"`      // connections refused from IPs banned by limits.ban
+
+	// Async delivery: messages refused with 452 as the queue was full,
+	// and messages lost after 250 as parsing or the push failed
+	QueueFull     uint64 `json:"queue_full"`
+	AsyncFailures uint64 `json:"async_failures"`
+
+	// Async delivery queue: messages waiting for a worker, and room for them
+	QueueDepth    int `json:"queue_depth"`
+	QueueCapacity int `json:"queue_capacity"`
+
+	// MAIL FROM refused with 451 as the queue was saturated or pushes to Jobs failed
+	Backpressured uint64 `json:"backpressured"`
+
+	// Pushes abandoned after jobs.push_timeout, emails among them were answered with 451
+	PushTimeouts uint64 `json:"push_timeouts"`
+
+	// Connections closed by greeting.early_talker "drop" for talking before the banner
+	EarlyTalkers uint64 `json:"early_talkers"`
+
+	// AUTH attempts rejected by auth.verify
+	AuthFailures uint64 `json:"auth_failures"`
+
+	// MAIL FROM / RCPT TO paths that failed address validation
+	InvalidAddresses uint64 `json:"invalid_addresses"`
+
+	// Volume spikes and unusually large messages flagged by sender alerts
+	SenderAnomalies uint64 `json:"sender_anomalies"`
+
+	// Rolling per-stage latency percentiles: read, parse, storage, push
+	Latency map[string]LatencySummary `json:"latency"`
+
+	// Times each rule matched, by rule name
+	Rules map[string]uint64 `json:"rules,omitempty"`
+
+	// Faults injected by chaos mode, keyed "<phase>.<fault>"
+	Chaos map[string]uint64 `json:"chaos,omitempty"`
+
+	// Serialized job payload sizes per pipeline
+	Payloads map[string]PayloadSummary `json:"payloads"`
+}
+
+// statsCounters holds the live counters behind Stats
+type statsCounters struct {
+	accepted         atomic.Uint64
+	shed             atomic.Uint64
+	aborted          atomic.Uint64
+	sampledOut       atomic.Uint64
+	rateLimited      atomic.Uint64
+	banned           atomic.Uint64
+	pushTimeouts     atomic.Uint64
+	earlyTalkers     atomic.Uint64
+	senderAnomalies  atomic.Uint64
+	invalidAddresses atomic.Uint64
+	authFailures     atomic.Uint64
+	queueFull        atomic.Uint64
+	asyncFailures    atomic.Uint64
+	backpressured    atomic.Uint64
+}
+
+// snapshot copies current counter values
+func (c *statsCounters) snapshot() Stats {
+	return Stats{
+		Accepted:         c.accepted.Load(),
+		Shed:             c.shed.Load(),
+		Aborted:          c.aborted.Load(),
+		SampledOut:       c.sampledOut.Load(),
+		Limited:          c.rateLimited.Load(),
+		Banned:           c.banned.Load(),
+		PushTimeouts:     c.pushTimeouts.Load(),
+		EarlyTalkers:     c.earlyTalkers.Load(),
+		SenderAnomalies:  c.senderAnomalies.Load(),
+		InvalidAddresses: c.invalidAddresses.Load(),
+		AuthFailures:     c.authFailures.Load(),
+		QueueFull:        c.queueFull.Load(),
+		AsyncFailures:    c.asyncFailures.Load(),
+		Backpressured:    c.backpressured.Load(),
+	}
+}
+
+// statsSnapshot returns the counters together with latency, payload, rule and chaos summaries
+func (p *Plugin) statsSnapshot() Stats {
+	stats := p.stats.snapshot()
+	stats.Latency = p.latency.summary()
+	stats.Payloads = p.payloads.summary()
+	stats.Rules = p.ruleMatches()
+	stats.Chaos = p.chaos.summary()
+	if p.delivery != nil {
+		stats.QueueDepth = p.delivery.depth()
+		stats.QueueCapacity = cap(p.delivery.messages)
+	}
+	return stats
+}
@@ -0,0 +1,137 @@
+package smtp
+
+import (
+	"strings"
+	"sync"
+)
+
+// tailBufferSize is the number of recent messages kept for Tail cursors
+const tailBufferSize = 256
+
+// TailFilter selects messages by envelope/header fields.
+// Address and subject fields are case-insensitive glob patterns (e.g. "reset@*"),
+// empty fields match everything.
+type TailFilter struct {
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+}
+
+// tailEntry is a published message with its sequence number
+type tailEntry struct {
+	seq   uint64
+	email *EmailData
+}
+
+// tailHub fans out received messages to long-polling RPC readers
+type tailHub struct {
+	mu     sync.Mutex
+	seq    uint64
+	recent []tailEntry
+	notify chan struct{} // closed and replaced on every publish
+}
+
+func newTailHub() *tailHub {
+	return &tailHub{
+		recent: make([]tailEntry, 0, tailBufferSize),
+		notify: make(chan struct{}),
+	}
+}
+
+// publish records the message and wakes up all waiting readers
+func (h *tailHub) publish(email *EmailData) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.seq++
+	if len(h.recent) == tailBufferSize {
+		copy(h.recent, h.recent[1:])
+		h.recent = h.recent[:tailBufferSize-1]
+	}
+	h.recent = append(h.recent, tailEntry{seq: h.seq, email: email})
+
+	close(h.notify)
+	h.notify = make(chan struct{})
+}
+
+// since returns buffered messages newer than cursor, the latest sequence number
+// and a channel which is closed on the next publish
+func (h *tailHub) since(cursor uint64) ([]*EmailData, uint64, <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var result []*EmailData
+	for _, e := range h.recent {
+		if e.seq > cursor {
+			result = append(result, e.email)
+		}
+	}
+
+	return result, h.seq, h.notify
+}
+
+// matches reports whether the email satisfies the filter
+func (f *TailFilter) matches(email *EmailData) bool {
+	if f.From != "" && !matchAddresses(f.From, email.Envelope.From, nil) {
+		return false
+	}
+
+	if f.To != "" && !matchAddresses(f.To, email.Envelope.To, email.Envelope.AllRecipients) {
+		return false
+	}
+
+	if f.Subject != "" && !matchGlob(f.Subject, email.Message.Subject) {
+		return false
+	}
+
+	return true
+}
+
+// matchAddresses checks the pattern against parsed header addresses and raw envelope addresses
+func matchAddresses(pattern string, addrs []EmailAddress, raw []string) bool {
+	for _, addr := range addrs {
+		if matchGlob(pattern, addr.Email) {
+			return true
+		}
+	}
+
+	for _, addr := range raw {
+		if matchGlob(pattern, addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchGlob performs a case-insensitive wildcard match, '*' matches any sequence
+// and '?' matches a single character
+func matchGlob(pattern, value string) bool {
+	p := []rune(strings.ToLower(pattern))
+	v := []rune(strings.ToLower(value))
+
+	pi, vi := 0, 0
+	star, mark := -1, 0
+	for vi < len(v) {
+		switch {
+		case pi < len(p) && (p[pi] == '?' || p[pi] == v[vi]):
+			pi++
+			vi++
+		case pi < len(p) && p[pi] == '*':
+			star, mark = pi, vi
+			pi++
+		case star >= 0:
+			pi = star + 1
+			mark++
+			vi = mark
+		default:
+			return false
+		}
+	}
+
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+
+	return pi == len(p)
+}
@@ -0,0 +1,87 @@
+package smtp
+
+import (
+	"net/netip"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// TarpitConfig slows sessions down instead of dropping them
+type TarpitConfig struct {
+	// Delay before MAIL, RCPT, DATA/BDAT and AUTH of a tarpitted session, 0 disables
+	Delay time.Duration `mapstructure:"delay"`
+	// Errors after which a session is tarpitted, 0 only tarpits the networks below and banned IPs
+	AfterErrors int `mapstructure:"after_errors"`
+	// Client networks tarpitted from the first command, e.g. "203.0.113.0/24"
+	Networks []string `mapstructure:"networks"`
+
+	networks []netip.Prefix // parsed from Networks by validate
+}
+
+func (t *TarpitConfig) validate() error {
+	const op = errors.Op("smtp_tarpit_validate")
+
+	if t.Delay < 0 || t.AfterErrors < 0 {
+		return errors.E(op, errors.Str("tarpit values cannot be negative"))
+	}
+
+	t.networks = make([]netip.Prefix, 0, len(t.Networks))
+	for _, network := range t.Networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			// A single address is a network of one
+			addr, addrErr := netip.ParseAddr(network)
+			if addrErr != nil {
+				return errors.E(op, errors.Errorf("tarpit.networks: %v", err))
+			}
+			prefix = netip.PrefixFrom(addr, addr.BitLen())
+		}
+		t.networks = append(t.networks, prefix.Masked())
+	}
+
+	return nil
+}
+
+// denied reports whether ip is in one of the tarpitted networks
+func (t *TarpitConfig) denied(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+
+	for _, prefix := range t.networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// startTarpit tarpits the session if its client is denied or banned with limits.ban.action "tarpit"
+func (s *Session) startTarpit() {
+	p := s.backend.plugin
+	if p.cfg.Tarpit.Delay == 0 || s.remoteIP == "" {
+		return
+	}
+
+	switch {
+	case p.cfg.Tarpit.denied(s.remoteIP):
+		s.tarpitted = true
+	case p.bans != nil && p.cfg.Limits.Ban.Action == banTarpit && p.bans.banned(s.remoteIP):
+		s.tarpitted = true
+	}
+
+	if s.tarpitted {
+		s.log.Info("session tarpitted", zap.Duration("delay", p.cfg.Tarpit.Delay))
+	}
+}
+
+// tarpit holds a command of a tarpitted session back
+func (s *Session) tarpit() {
+	if s.tarpitted {
+		time.Sleep(s.backend.plugin.cfg.Tarpit.Delay)
+	}
+}
@@ -0,0 +1,262 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// certExpiryWarning is how long before expiry a loaded certificate triggers a warning
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// CertificateInfo describes the currently served TLS certificate
+type CertificateInfo struct {
+	Subject         string    `json:"subject"`
+	DNSNames        []string  `json:"dns_names"`
+	NotAfter        time.Time `json:"not_after"`
+	DaysUntilExpiry int       `json:"days_until_expiry"`
+}
+
+// certReloader serves a certificate loaded from disk and swaps it when the files change
+type certReloader struct {
+	certFile string
+	keyFile  string
+	log      *zap.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the key pair and returns a reloader serving it
+func newCertReloader(certFile, keyFile string, log *zap.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log,
+	}
+
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// reload reads the key pair from disk and replaces the served certificate
+func (r *certReloader) reload() error {
+	const op = errors.Op("smtp_tls_reload")
+
+	modTime, err := r.filesModTime()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	cert, err := loadCertificate(r.certFile, r.keyFile)
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	r.mu.Lock()
+	r.cert = cert
+	r.modTime = modTime
+	r.mu.Unlock()
+
+	r.log.Info("TLS certificate loaded",
+		zap.String("cert", r.certFile),
+		zap.Time("not_after", cert.Leaf.NotAfter),
+	)
+
+	if time.Until(cert.Leaf.NotAfter) < certExpiryWarning {
+		r.log.Warn("TLS certificate expires soon",
+			zap.String("cert", r.certFile),
+			zap.Time("not_after", cert.Leaf.NotAfter),
+		)
+	}
+
+	return nil
+}
+
+// filesModTime returns the latest modification time of the cert and key files
+func (r *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// checkForChanges reloads the certificate if any of the files were modified
+func (r *certReloader) checkForChanges() {
+	modTime, err := r.filesModTime()
+	if err != nil {
+		r.log.Warn("failed to stat TLS certificate files", zap.Error(err))
+		return
+	}
+
+	r.mu.RLock()
+	changed := modTime.After(r.modTime)
+	r.mu.RUnlock()
+
+	if !changed {
+		return
+	}
+
+	// Keep serving the previous certificate when the new one is broken
+	if err := r.reload(); err != nil {
+		r.log.Error("failed to reload TLS certificate, keeping previous one", zap.Error(err))
+	}
+}
+
+// info returns details about the served certificate
+func (r *certReloader) info() CertificateInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return certificateInfo(r.cert.Leaf)
+}
+
+// certificateInfo describes the served certificate, file or self-signed
+func (p *Plugin) certificateInfo() (CertificateInfo, bool) {
+	switch {
+	case p.certs != nil:
+		return p.certs.info(), true
+	case p.selfSigned != nil:
+		return certificateInfo(p.selfSigned.Leaf), true
+	default:
+		return CertificateInfo{}, false
+	}
+}
+
+// startCertReloader periodically checks certificate files for changes
+func (p *Plugin) startCertReloader(ctx context.Context) {
+	if p.certs == nil {
+		return
+	}
+
+	ticker := time.NewTicker(p.cfg.TLS.ReloadInterval)
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			case <-ticker.C:
+				p.certs.checkForChanges()
+			}
+		}
+	}()
+}
+
+// loadCertificate parses the key pair and ensures the leaf certificate is currently valid
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if now.After(cert.Leaf.NotAfter) {
+		return nil, errors.Errorf("certificate %s expired at %s", certFile, cert.Leaf.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.Leaf.NotBefore) {
+		return nil, errors.Errorf("certificate %s is not valid before %s", certFile, cert.Leaf.NotBefore.Format(time.RFC3339))
+	}
+
+	return &cert, nil
+}
+
+// generateSelfSigned creates an in-memory ECDSA certificate for the hostname
+func generateSelfSigned(hostname string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"Buggregator SMTP (self-signed)"}},
+		NotBefore:             now.Add(-1 * time.Hour),
+		NotAfter:              now.Add(365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	if ip := net.ParseIP(hostname); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{hostname}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// certificateInfo describes a leaf certificate
+func certificateInfo(leaf *x509.Certificate) CertificateInfo {
+	return CertificateInfo{
+		Subject:         leaf.Subject.String(),
+		DNSNames:        leaf.DNSNames,
+		NotAfter:        leaf.NotAfter,
+		DaysUntilExpiry: int(time.Until(leaf.NotAfter).Hours() / 24),
+	}
+}
+
+// fingerprint returns the SHA-256 fingerprint of the certificate in colon-separated hex
+func fingerprint(leaf *x509.Certificate) string {
+	sum := sha256.Sum256(leaf.Raw)
+	parts := make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = hex.EncodeToString([]byte{b})
+	}
+	return strings.ToUpper(strings.Join(parts, ":"))
+}
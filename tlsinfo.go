@@ -0,0 +1,203 @@
+package smtp
+
+import (
+	"crypto/md5" //nolint:gosec // JA3 is defined as an MD5 hash
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// helloMaxAge is how long a ClientHello fingerprint waits for its session, handshakes
+// without one (the client left right after TLS) are pruned after it
+const helloMaxAge = time.Hour
+
+// TLSData describes the TLS connection a message arrived over
+type TLSData struct {
+	Version     string          `json:"version"`      // e.g. "TLS 1.3"
+	CipherSuite string          `json:"cipher_suite"` // e.g. "TLS_AES_128_GCM_SHA256"
+	ALPN        string          `json:"alpn,omitempty"`
+	ClientCert  *ClientCertData `json:"client_cert,omitempty"` // with tls.request_client_cert
+
+	// JA3 fingerprint of the ClientHello: the version, cipher, extension, curve and point
+	// format lists (GREASE removed), and its MD5. The version is the legacy one, at most TLS 1.2.
+	JA3     string `json:"ja3,omitempty"`
+	JA3Hash string `json:"ja3_hash,omitempty"`
+}
+
+// ClientCertData describes the certificate a client presented, it is not verified
+type ClientCertData struct {
+	Subject           string    `json:"subject"`
+	Issuer            string    `json:"issuer"`
+	SerialNumber      string    `json:"serial_number"`
+	NotBefore         time.Time `json:"not_before"`
+	NotAfter          time.Time `json:"not_after"`
+	DNSNames          []string  `json:"dns_names,omitempty"`
+	EmailAddresses    []string  `json:"email_addresses,omitempty"`
+	SHA256Fingerprint string    `json:"sha256_fingerprint"`
+}
+
+// clientHello is a fingerprinted ClientHello waiting for its session
+type clientHello struct {
+	ja3  string
+	seen time.Time
+}
+
+// helloTracker keeps the ClientHello fingerprints of TLS connections by their underlying conn
+type helloTracker struct {
+	mu     sync.Mutex
+	hellos map[net.Conn]clientHello
+}
+
+func newHelloTracker() *helloTracker {
+	return &helloTracker{
+		hellos: make(map[net.Conn]clientHello),
+	}
+}
+
+// GetConfigForClient implements tls.Config.GetConfigForClient, it only records the ClientHello
+func (t *helloTracker) GetConfigForClient(info *tls.ClientHelloInfo) (*tls.Config, error) {
+	ja3 := ja3String(info)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	for conn, hello := range t.hellos {
+		if now.Sub(hello.seen) > helloMaxAge {
+			delete(t.hellos, conn)
+		}
+	}
+	t.hellos[info.Conn] = clientHello{ja3: ja3, seen: now}
+
+	return nil, nil
+}
+
+// ja3 returns the fingerprint recorded for the connection
+func (t *helloTracker) ja3(conn net.Conn) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.hellos[conn].ja3
+}
+
+// forget drops the fingerprint of a closed connection
+func (t *helloTracker) forget(conn net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.hellos, conn)
+}
+
+// ja3String builds the JA3 string of a ClientHello
+func ja3String(info *tls.ClientHelloInfo) string {
+	// The legacy version field is frozen at TLS 1.2, newer versions are in supported_versions
+	var version uint16
+	for _, v := range info.SupportedVersions {
+		if !isGREASE(v) {
+			version = max(version, v)
+		}
+	}
+	version = min(version, tls.VersionTLS12)
+
+	curves := make([]uint16, len(info.SupportedCurves))
+	for i, c := range info.SupportedCurves {
+		curves[i] = uint16(c)
+	}
+	points := make([]uint16, len(info.SupportedPoints))
+	for i, p := range info.SupportedPoints {
+		points[i] = uint16(p)
+	}
+
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinJA3(info.CipherSuites),
+		joinJA3(info.Extensions),
+		joinJA3(curves),
+		joinJA3(points),
+	}, ",")
+}
+
+// joinJA3 joins values with dashes, leaving out GREASE values
+func joinJA3(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !isGREASE(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// isGREASE reports whether v is a reserved RFC 8701 value like 0x0a0a
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// tlsData describes the session's TLS connection, nil over plain text
+func (s *Session) tlsData() *TLSData {
+	state, ok := s.connectionState()
+	if !ok {
+		return nil
+	}
+
+	data := &TLSData{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ALPN:        state.NegotiatedProtocol,
+	}
+
+	if hellos, conn := s.backend.plugin.hellos, s.tlsNetConn(); hellos != nil && conn != nil {
+		if data.JA3 = hellos.ja3(conn); data.JA3 != "" {
+			sum := md5.Sum([]byte(data.JA3)) //nolint:gosec
+			data.JA3Hash = hex.EncodeToString(sum[:])
+		}
+	}
+
+	if len(state.PeerCertificates) > 0 {
+		cert := state.PeerCertificates[0]
+		data.ClientCert = &ClientCertData{
+			Subject:           cert.Subject.String(),
+			Issuer:            cert.Issuer.String(),
+			SerialNumber:      cert.SerialNumber.String(),
+			NotBefore:         cert.NotBefore,
+			NotAfter:          cert.NotAfter,
+			DNSNames:          cert.DNSNames,
+			EmailAddresses:    cert.EmailAddresses,
+			SHA256Fingerprint: fingerprint(cert),
+		}
+	}
+
+	return data
+}
+
+// connectionState returns the TLS state of the session's connection, or the one
+// taken by detach for a detached copy
+func (s *Session) connectionState() (tls.ConnectionState, bool) {
+	if s.conn != nil {
+		return s.conn.TLSConnectionState()
+	}
+	if s.tlsState != nil {
+		return *s.tlsState, true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// tlsNetConn returns the connection under the session's TLS layer, nil over plain text
+func (s *Session) tlsNetConn() net.Conn {
+	if s.conn == nil {
+		return nil
+	}
+	if tc, ok := s.conn.Conn().(*tls.Conn); ok {
+		return tc.NetConn()
+	}
+	return nil
+}
+
+// forgetHello drops the session's ClientHello fingerprint when it ends
+func (s *Session) forgetHello() {
+	if hellos, conn := s.backend.plugin.hellos, s.tlsNetConn(); hellos != nil && conn != nil {
+		hellos.forget(conn)
+	}
+}
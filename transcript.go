@@ -0,0 +1,205 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// TranscriptConfig records the SMTP dialogue of every session for debugging.
+// Message bodies are summarized by size and AUTH credentials are masked. Traffic after STARTTLS is encrypted
+// on the wire and not recorded, and implicit TLS listeners are not recorded at all.
+type TranscriptConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+	// Transcript size per session, default 64 KiB, the rest is cut off
+	MaxBytes int `mapstructure:"max_bytes"`
+}
+
+func (t *TranscriptConfig) initDefaults() {
+	if t.MaxBytes == 0 {
+		t.MaxBytes = 64 << 10
+	}
+}
+
+// transcriptListener records the dialogue of accepted connections
+type transcriptListener struct {
+	net.Listener
+	maxBytes int
+}
+
+func (l *transcriptListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &transcriptConn{Conn: conn, maxBytes: l.maxBytes}, nil
+}
+
+// transcriptConn records what goes through the connection as "C: " and "S: " lines
+type transcriptConn struct {
+	net.Conn
+	maxBytes int
+
+	mu         sync.Mutex
+	transcript strings.Builder
+	pending    [2][]byte // incomplete client and server lines
+	lastCmd    string    // verb of the last client command
+	inAuth     bool      // SASL exchange in progress, client lines carry credentials
+	inData     bool      // DATA body is being received
+	bdatLeft   int64     // BDAT chunk bytes still to come
+	bodyBytes  int64     // size of the body or chunk being received
+	stopped    bool      // STARTTLS started or max_bytes was reached
+}
+
+const (
+	fromClient = 0
+	fromServer = 1
+)
+
+func (c *transcriptConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.record(fromClient, b[:n])
+	}
+	return n, err
+}
+
+func (c *transcriptConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.record(fromServer, b[:n])
+	}
+	return n, err
+}
+
+// String returns the transcript so far
+func (c *transcriptConn) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.transcript.String()
+}
+
+func (c *transcriptConn) record(dir int, b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stopped {
+		return
+	}
+
+	c.pending[dir] = append(c.pending[dir], b...)
+	for !c.stopped {
+		if dir == fromClient && c.bdatLeft > 0 {
+			chunk := min(int64(len(c.pending[dir])), c.bdatLeft)
+			c.pending[dir] = c.pending[dir][chunk:]
+			c.bdatLeft -= chunk
+			c.bodyBytes += chunk
+			if c.bdatLeft == 0 {
+				c.add("C: <chunk, " + strconv.FormatInt(c.bodyBytes, 10) + " bytes>")
+			}
+			if len(c.pending[dir]) == 0 {
+				break
+			}
+			continue
+		}
+
+		i := bytes.IndexByte(c.pending[dir], '\n')
+		if i < 0 {
+			// A line without end is not kept growing beyond the transcript limit
+			if len(c.pending[dir]) > c.maxBytes {
+				c.pending[dir] = c.pending[dir][:0]
+			}
+			break
+		}
+		line := string(bytes.TrimRight(c.pending[dir][:i], "\r"))
+		c.pending[dir] = c.pending[dir][i+1:]
+
+		if dir == fromClient {
+			c.clientLine(line)
+		} else {
+			c.serverLine(line)
+		}
+	}
+}
+
+func (c *transcriptConn) clientLine(line string) {
+	if c.inData {
+		if line == "." {
+			c.inData = false
+			c.add("C: <message, " + strconv.FormatInt(c.bodyBytes, 10) + " bytes>")
+			c.add("C: .")
+			return
+		}
+		c.bodyBytes += int64(len(line)) + 2
+		return
+	}
+
+	if c.inAuth {
+		c.add("C: " + redactedValue)
+		return
+	}
+
+	verb, arg, _ := strings.Cut(line, " ")
+	c.lastCmd = strings.ToUpper(verb)
+	if c.lastCmd == "AUTH" {
+		// Only the mechanism is kept, the initial response and continuations are credentials
+		mech, _, _ := strings.Cut(arg, " ")
+		c.add("C: " + verb + " " + mech + " " + redactedValue)
+		c.inAuth = true
+		return
+	}
+
+	c.add("C: " + line)
+	if c.lastCmd == "BDAT" {
+		size, _, _ := strings.Cut(arg, " ")
+		if n, err := strconv.ParseInt(size, 10, 64); err == nil && n > 0 {
+			c.bdatLeft, c.bodyBytes = n, 0
+		}
+	}
+}
+
+func (c *transcriptConn) serverLine(line string) {
+	c.add("S: " + line)
+	switch {
+	case c.inAuth && !strings.HasPrefix(line, "334"):
+		// 235 or an error ends the SASL exchange
+		c.inAuth = false
+	case strings.HasPrefix(line, "354"):
+		c.inData, c.bodyBytes = true, 0
+	case c.lastCmd == "STARTTLS" && strings.HasPrefix(line, "220"):
+		c.add("-- TLS started, the encrypted rest of the session is not recorded --")
+		c.stopped = true
+	}
+}
+
+func (c *transcriptConn) add(line string) {
+	if c.transcript.Len()+len(line) > c.maxBytes {
+		c.transcript.WriteString("-- transcript truncated at max_bytes --\r\n")
+		c.stopped = true
+		return
+	}
+	c.transcript.WriteString(line + "\r\n")
+}
+
+// transcriptOf finds the recorder under the TLS and greeting layers, nil when not recorded
+func transcriptOf(conn net.Conn) *transcriptConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if gc, ok := conn.(*greetingConn); ok {
+		conn = gc.Conn
+	}
+	t, _ := conn.(*transcriptConn)
+	return t
+}
+
+// transcriptText returns the session's transcript so far
+func (s *Session) transcriptText() string {
+	if s.transcript == nil {
+		return ""
+	}
+	return s.transcript.String()
+}
@@ -0,0 +1,40 @@
+package smtp
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranscriptMasksAuth(t *testing.T) {
+	c := &transcriptConn{maxBytes: 64 << 10}
+	for _, step := range []struct {
+		dir  int
+		line string
+	}{
+		{fromClient, "EHLO client.test"},
+		{fromServer, "250 localhost"},
+		{fromClient, "AUTH PLAIN AHVzZXIAc2VjcmV0"},
+		{fromServer, "535 5.7.8 Authentication failed"},
+		{fromClient, "AUTH LOGIN"},
+		{fromServer, "334 VXNlcm5hbWU6"},
+		{fromClient, "dXNlcg=="},
+		{fromServer, "334 UGFzc3dvcmQ6"},
+		{fromClient, "c2VjcmV0"},
+		{fromServer, "235 2.7.0 Authentication succeeded"},
+		{fromClient, "MAIL FROM:<a@example.com>"},
+	} {
+		c.record(step.dir, []byte(step.line+"\r\n"))
+	}
+
+	got := c.String()
+	for _, secret := range []string{"AHVzZXIAc2VjcmV0", "dXNlcg==", "c2VjcmV0"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("transcript contains credentials %q:\n%s", secret, got)
+		}
+	}
+	for _, want := range []string{"C: AUTH PLAIN [redacted]", "C: AUTH LOGIN [redacted]", "C: MAIL FROM:<a@example.com>"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("transcript lacks %q:\n%s", want, got)
+		}
+	}
+}
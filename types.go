@@ -4,14 +4,54 @@ import "time"
 
 // EmailData represents complete email information sent to PHP
 type EmailData struct {
-	Event       string           `json:"event"`                    // Always "EMAIL_RECEIVED"
-	UUID        string           `json:"uuid"`                     // Connection UUID
-	RemoteAddr  string           `json:"remote_addr"`              // Client IP:port
-	ReceivedAt  time.Time        `json:"received_at"`              // Timestamp
-	Envelope    EnvelopeData     `json:"envelope"`                 // SMTP envelope
-	Auth        *AuthData        `json:"authentication,omitempty"` // Auth if present
-	Message     MessageData      `json:"message"`                  // Email content
-	Attachments []AttachmentData `json:"attachments"`              // Parsed attachments
+	Event         string           `json:"event"`                     // Always "EMAIL_RECEIVED"
+	UUID          string           `json:"uuid"`                      // Connection UUID
+	Seq           uint64           `json:"seq"`                       // 1-based message number within the connection
+	MessageUUID   string           `json:"message_uuid"`              // Unique per accepted message
+	QueueID       string           `json:"queue_id"`                  // Postfix-style ID derived from message_uuid
+	CorrelationID string           `json:"correlation_id,omitempty"`  // Client-provided X-Correlation-ID
+	RemoteAddr    string           `json:"remote_addr"`               // Client IP:port, or "unix" with peer credentials
+	LocalAddr     string           `json:"local_addr"`                // Listener IP:port the client connected to
+	Listener      string           `json:"listener"`                  // Configured addr (or tls.smtps_addr) entry
+	ServerName    string           `json:"server_name,omitempty"`     // TLS SNI requested by the client
+	TLS           *TLSData         `json:"tls,omitempty"`             // Negotiated TLS, nil over plain text
+	ReceivedAt    time.Time        `json:"received_at"`               // Timestamp
+	Envelope      EnvelopeData     `json:"envelope"`                  // SMTP envelope
+	Auth          *AuthData        `json:"authentication,omitempty"`  // Auth if present
+	Inbox         string           `json:"inbox,omitempty"`           // auth.inboxes ID selected by the AUTH username
+	Message       MessageData      `json:"message"`                   // Email content
+	BDAT          bool             `json:"bdat"`                      // Message was sent with BDAT (CHUNKING)
+	Attachments   []AttachmentData `json:"attachments"`               // Parsed attachments
+	Nested        []NestedMessage  `json:"nested_messages,omitempty"` // Messages forwarded as attachments
+	Anomalies     []string         `json:"anomalies,omitempty"`       // Protocol violations seen on the connection
+	Transcript    string           `json:"transcript,omitempty"`      // SMTP dialogue up to this message, with transcript.enabled
+}
+
+// ConnectionClosedEvent is sent to PHP when an admin closes a connection
+type ConnectionClosedEvent struct {
+	Event      string    `json:"event"`       // Always "CONNECTION_CLOSED_BY_ADMIN"
+	UUID       string    `json:"uuid"`        // Connection UUID
+	RemoteAddr string    `json:"remote_addr"` // Client IP:port, or "unix" with peer credentials
+	ClosedAt   time.Time `json:"closed_at"`   // Timestamp
+	ClosedBy   string    `json:"closed_by"`   // Who requested the close
+	Reason     string    `json:"reason"`      // Why, as given by the caller
+	From       string    `json:"from"`        // MAIL FROM of the aborted transaction, if any
+	To         []string  `json:"to"`          // RCPT TO of the aborted transaction, if any
+}
+
+// MessageAbortedEvent is sent to PHP when a client drops the connection during DATA/BDAT
+type MessageAbortedEvent struct {
+	Event            string    `json:"event"`                       // Always "MESSAGE_ABORTED"
+	UUID             string    `json:"uuid"`                        // Connection UUID
+	RemoteAddr       string    `json:"remote_addr"`                 // Client IP:port, or "unix" with peer credentials
+	AbortedAt        time.Time `json:"aborted_at"`                  // Timestamp
+	BytesReceived    int64     `json:"bytes_received"`              // Message bytes read before the transfer broke
+	BDAT             bool      `json:"bdat"`                        // Message was sent in BDAT chunks
+	Reason           string    `json:"reason"`                      // Read error
+	PartialPath      string    `json:"partial_path,omitempty"`      // Saved bytes, with attachment_storage.partial_messages
+	PartialTruncated bool      `json:"partial_truncated,omitempty"` // Saved bytes stop at max_size
+	From             string    `json:"from"`                        // MAIL FROM of the aborted transaction
+	To               []string  `json:"to"`                          // RCPT TO of the aborted transaction
 }
 
 // EnvelopeData represents SMTP envelope information
@@ -21,34 +61,69 @@ type EnvelopeData struct {
 	Ccs           []EmailAddress `json:"ccs"`
 	ReplyTo       []EmailAddress `json:"replyTo"`
 	AllRecipients []string       `json:"allRecipients"`
-	Helo          string         `json:"helo"` // HELO/EHLO domain
+	Helo          string         `json:"helo"`                  // HELO/EHLO domain
+	ReverseDNS    string         `json:"reverse_dns,omitempty"` // PTR name of the client IP, with reverse_dns
+	UTF8          bool           `json:"utf8"`                  // MAIL FROM used SMTPUTF8
+	BodyType      string         `json:"body,omitempty"`        // BODY= of MAIL FROM: "7BIT" or "8BITMIME"
+	Params        *MailParams    `json:"params"`                // Every parameter MAIL FROM declared
+}
+
+// MailParams are the extension parameters of MAIL FROM as the client declared them
+type MailParams struct {
+	Size       int64   `json:"size,omitempty"` // SIZE=, 0 when not declared
+	Body       string  `json:"body,omitempty"` // BODY=: "7BIT", "8BITMIME" or "BINARYMIME"
+	SMTPUTF8   bool    `json:"smtputf8"`
+	RequireTLS bool    `json:"requiretls"`
+	Auth       *string `json:"auth,omitempty"` // AUTH= identity, "" for AUTH=<>, nil when not declared
 }
 
 // AuthData represents authentication attempt data
 type AuthData struct {
-	Attempted bool   `json:"attempted"` // true if AUTH was used
-	Mechanism string `json:"mechanism"` // "LOGIN" or "PLAIN"
-	Username  string `json:"username"`  // Captured username
-	Password  string `json:"password"`  // Captured password (plain text)
+	Attempted bool   `json:"attempted"`           // true if AUTH was used
+	Mechanism string `json:"mechanism"`           // "LOGIN", "PLAIN" or "CRAM-MD5"
+	Username  string `json:"username"`            // Captured username
+	Password  string `json:"password"`            // Captured password (plain text), empty for CRAM-MD5
+	Digest    string `json:"digest,omitempty"`    // CRAM-MD5 hex digest sent by the client
+	Challenge string `json:"challenge,omitempty"` // CRAM-MD5 challenge issued by the server
 }
 
 // MessageData represents parsed email message
 type MessageData struct {
-	Headers  map[string][]string `json:"headers"` // Parsed headers
-	Id       *string             `json:"id"`
-	Body     string              `json:"body"` // Plain text or HTML body
-	HTMLBody string              `json:"html_body,omitempty"`
-	Raw      string              `json:"raw,omitempty"` // Full RFC822 (optional)
-	Subject  string              `json:"subject"`
+	Headers   map[string][]string `json:"headers"` // Parsed headers
+	Id        *string             `json:"id"`
+	Body      string              `json:"body"`                 // Chosen by body_preference
+	TextBody  string              `json:"text_body,omitempty"`  // Plain text part
+	ReplyText string              `json:"reply_text,omitempty"` // Latest reply without quotes and signature
+	HTMLBody  string              `json:"html_body,omitempty"`
+	Raw       string              `json:"raw,omitempty"` // Full RFC822 (optional)
+	Subject   string              `json:"subject"`
+	Priority  string              `json:"priority"`       // "high", "normal" or "low"
+	Size      int64               `json:"size"`           // Raw message size in bytes
+	Lint      []LintFinding       `json:"lint,omitempty"` // Structural faults, with lint_mime
 }
 
 // AttachmentData represents an email attachment
 type AttachmentData struct {
-	Filename    string `json:"filename"`          // Original filename
-	ContentType string `json:"content_type"`      // MIME type
-	Size        int64  `json:"size"`              // Size in bytes
-	Content     string `json:"content,omitempty"` // Base64 (memory mode)
-	Path        string `json:"path,omitempty"`    // File path (tempfile mode)
+	Filename      string `json:"filename"`                 // Original filename
+	ContentType   string `json:"content_type"`             // MIME type
+	Size          int64  `json:"size"`                     // Size in bytes
+	Content       string `json:"content,omitempty"`        // Base64 (memory mode)
+	Path          string `json:"path,omitempty"`           // File path (tempfile mode)
+	SHA256        string `json:"sha256"`                   // Hex digest of the decoded content
+	Source        string `json:"source,omitempty"`         // "uuencode" when extracted from the text body
+	ExtractedText string `json:"extracted_text,omitempty"` // Searchable text from PDF/Office documents
+}
+
+// NestedMessage is a message carried inside an attachment, e.g. an Outlook .msg file
+type NestedMessage struct {
+	Source     string         `json:"source"`     // "msg"
+	Attachment string         `json:"attachment"` // Filename of the carrying attachment
+	Sender     []EmailAddress `json:"sender"`
+	Recipients []EmailAddress `json:"recipients"`
+	CCs        []EmailAddress `json:"ccs"`
+	Subject    string         `json:"subject"`
+	TextBody   string         `json:"textBody"`
+	HTMLBody   string         `json:"htmlBody"`
 }
 
 // EmailAddress represents an email address with name
@@ -59,23 +134,34 @@ type EmailAddress struct {
 
 // Attachment represents an email attachment for PHP
 type Attachment struct {
-	Filename  string  `json:"filename"`
-	Content   string  `json:"content"`
-	Type      string  `json:"type"`
-	ContentID *string `json:"contentId"`
+	Filename      string  `json:"filename"`
+	Content       string  `json:"content"`
+	Type          string  `json:"type"`
+	ContentID     *string `json:"contentId"`
+	Size          int64   `json:"size"`
+	SHA256        string  `json:"sha256"`
+	Source        string  `json:"source,omitempty"`
+	ExtractedText string  `json:"extractedText,omitempty"`
 }
 
 // ParsedMessage represents the structure expected by PHP Parser
 type ParsedMessage struct {
-	ID            *string        `json:"id"`
-	Raw           string         `json:"raw"`
-	Sender        []EmailAddress `json:"sender"`
-	Recipients    []EmailAddress `json:"recipients"`
-	CCs           []EmailAddress `json:"ccs"`
-	Subject       string         `json:"subject"`
-	HTMLBody      string         `json:"htmlBody"`
-	TextBody      string         `json:"textBody"`
-	ReplyTo       []EmailAddress `json:"replyTo"`
-	AllRecipients []string       `json:"allRecipients"`
-	Attachments   []Attachment   `json:"attachments"`
+	ID            *string         `json:"id"`
+	CorrelationID string          `json:"correlationId,omitempty"`
+	Raw           string          `json:"raw"`
+	Size          int64           `json:"size"`
+	Sender        []EmailAddress  `json:"sender"`
+	Recipients    []EmailAddress  `json:"recipients"`
+	CCs           []EmailAddress  `json:"ccs"`
+	Subject       string          `json:"subject"`
+	Priority      string          `json:"priority"`
+	HTMLBody      string          `json:"htmlBody"`
+	TextBody      string          `json:"textBody"`
+	ReplyText     string          `json:"replyText,omitempty"`
+	ReplyTo       []EmailAddress  `json:"replyTo"`
+	AllRecipients []string        `json:"allRecipients"`
+	Attachments   []Attachment    `json:"attachments"`
+	Nested        []NestedMessage `json:"nestedMessages,omitempty"`
+	Anomalies     []string        `json:"-"` // Limits hit while parsing, merged into EmailData
+	Lint          []LintFinding   `json:"lint,omitempty"`
 }
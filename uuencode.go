@@ -0,0 +1,91 @@
+package smtp
+
+import (
+	"path"
+	"regexp"
+	"strings"
+)
+
+// attachmentSourceUUEncode marks attachments extracted from uuencoded body blocks
+const attachmentSourceUUEncode = "uuencode"
+
+var uuBeginRe = regexp.MustCompile(`^begin [0-7]{3,4} (.+)$`)
+
+// uuFile is a file decoded from a uuencoded block
+type uuFile struct {
+	name    string
+	content []byte
+}
+
+// extractUUEncoded removes complete begin/end blocks from body and returns the decoded files.
+// Blocks without an end marker are left in place.
+func extractUUEncoded(body string) (string, []uuFile) {
+	if !strings.Contains(body, "begin ") {
+		return body, nil
+	}
+
+	lines := strings.Split(body, "\n")
+	kept := make([]string, 0, len(lines))
+	var files []uuFile
+
+	for i := 0; i < len(lines); i++ {
+		m := uuBeginRe.FindStringSubmatch(strings.TrimRight(lines[i], "\r"))
+		if m == nil {
+			kept = append(kept, lines[i])
+			continue
+		}
+
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if strings.TrimRight(lines[j], "\r") == "end" {
+				end = j
+				break
+			}
+		}
+		if end < 0 {
+			kept = append(kept, lines[i])
+			continue
+		}
+
+		var content []byte
+		for _, line := range lines[i+1 : end] {
+			content = append(content, uudecodeLine(strings.TrimRight(line, "\r"))...)
+		}
+
+		files = append(files, uuFile{name: path.Base(strings.TrimSpace(m[1])), content: content})
+		i = end
+	}
+
+	return strings.Join(kept, "\n"), files
+}
+
+// uudecodeLine decodes one line whose first character encodes the byte count
+func uudecodeLine(line string) []byte {
+	if line == "" {
+		return nil
+	}
+
+	n := int(line[0]-' ') & 63
+	out := make([]byte, 0, n)
+	data := line[1:]
+
+	for i := 0; len(out) < n; i += 4 {
+		var c [4]byte
+		for k := range c {
+			if i+k < len(data) {
+				c[k] = (data[i+k] - ' ') & 63
+			}
+		}
+
+		out = append(out, c[0]<<2|c[1]>>4, c[1]<<4|c[2]>>2, c[2]<<6|c[3])
+		if i+4 >= len(data) {
+			break
+		}
+	}
+
+	if len(out) > n {
+		out = out[:n]
+	}
+
+	return out
+}